@@ -30,13 +30,60 @@ import (
 // Below is the struct we're using to contain the data from a provided config file
 // TODO: Try to figure out how to make bucket ranges configurable
 type CaduceusConfig struct {
-	AuthHeader       []string
+	AuthHeader []string
+
+	// NumWorkerThreads is the number of workers handing the incoming
+	// messages to the senders.  0 handles the messages inline.
 	NumWorkerThreads int
-	JobQueueSize     int
+
+	// JobQueueSize is the number of incoming messages that can wait for a
+	// worker before requests are rejected with a 503.
+	JobQueueSize int
+
+	// MaxOutstanding is the most requests handled at once by the notify
+	// endpoints before requests are rejected with a 503.  0 means there is
+	// no limit.
+	MaxOutstanding int64
+
 	Sender           SenderConfig
 	JWTValidators    []JWTValidator
 	Webhook          ancla.Config
 	AllowInsecureTLS bool
+
+	// MaxRequestBodySize is the largest request body in bytes accepted by
+	// the notify endpoints.  0 means there is no limit.
+	MaxRequestBodySize int64
+
+	// MaxDeliveryWait is the longest a notify request that asked to wait
+	// for the delivery of its message will be held.
+	MaxDeliveryWait time.Duration
+
+	// WebhookOptions configures where the caduceus specific options of the
+	// webhook registrations are stored.
+	WebhookOptions WebhookOptionsConfig
+
+	// Validation sets how strictly incoming WRP messages are validated.
+	Validation ValidationConfig
+
+	// Normalizers configures how incoming WRP messages are normalized.
+	Normalizers NormalizerConfig
+
+	// Dedupe configures the suppression of duplicate messages.
+	Dedupe DedupeConfig
+
+	// PartnerIsolation configures which partners' events the webhooks get.
+	PartnerIsolation PartnerIsolationConfig
+
+	// QueueBudget limits the messages queued across all the webhooks.
+	QueueBudget QueueBudgetConfig
+
+	// DeadLetters configures the store of the events that couldn't be
+	// delivered.
+	DeadLetters DeadLetterConfig
+
+	// SecretRotation configures the rotations of the secrets of the
+	// webhooks.
+	SecretRotation SecretRotationConfig
 }
 
 type SenderConfig struct {
@@ -44,6 +91,13 @@ type SenderConfig struct {
 	QueueSizePerSender              int
 	CutOffPeriod                    time.Duration
 	Linger                          time.Duration
+	DrainRemoved                    bool
+	ShutdownTimeout                 time.Duration
+	SpillDirectory                  string
+	DurableQueue                    DurableQueueConfig
+	Backoff                         BackoffConfig
+	CircuitBreaker                  CircuitBreakerConfig
+	Signature                       SignatureConfig
 	ClientTimeout                   time.Duration
 	DisableClientHostnameValidation bool
 	ResponseHeaderTimeout           time.Duration
@@ -51,6 +105,8 @@ type SenderConfig struct {
 	DeliveryRetries                 int
 	DeliveryInterval                time.Duration
 	RetryCodes                      []int
+	WorkerPool                      WorkerPoolConfig
+	DeliveryBounds                  DeliveryBounds
 }
 
 type CaduceusMetricsRegistry interface {
@@ -0,0 +1,304 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"container/ring"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+const (
+	defaultBreakerWindow     = 20
+	defaultBreakerOpenPeriod = 30 * time.Second
+)
+
+// CircuitBreakerConfig configures the circuit breakers of the URLs of the
+// webhooks.  The URL of a breaker that opened is skipped in favor of the
+// other URLs of its webhook until a probe finds it healthy again.  When all
+// the URLs of a webhook are skipped they are tried in turn anyway, so the
+// events aren't held back.
+type CircuitBreakerConfig struct {
+	// ConsecutiveFailures opens the breaker of a URL after that many failed
+	// attempts in a row.  Attempts failing to connect or answered with a
+	// 5xx fail.
+	// 0 disables this trigger.
+	ConsecutiveFailures int
+
+	// FailureRate opens the breaker of a URL when at least this fraction of
+	// its last Window attempts failed.
+	// 0 disables this trigger.
+	FailureRate float64
+
+	// Window is the number of recent attempts the failure rate is measured
+	// over.
+	// (Optional) defaults to 20.
+	Window int
+
+	// OpenPeriod is how long an open breaker skips its URL before letting a
+	// probe through.
+	// (Optional) defaults to 30s.
+	OpenPeriod time.Duration
+
+	// ProbeSuccesses is the number of successful probes in a row that close
+	// the breaker again.
+	// (Optional) defaults to 1.
+	ProbeSuccesses int
+}
+
+// enabled determines if the URLs have breakers.
+func (c CircuitBreakerConfig) enabled() bool {
+	return 0 < c.ConsecutiveFailures || 0 < c.FailureRate
+}
+
+// withDefaults validates the configuration, filling in the defaults.
+func (c CircuitBreakerConfig) withDefaults() (CircuitBreakerConfig, error) {
+	if c.ConsecutiveFailures < 0 || c.FailureRate < 0 || c.Window < 0 || c.OpenPeriod < 0 || c.ProbeSuccesses < 0 {
+		return c, errors.New("the circuit breaker must not be negative")
+	}
+	if 1 < c.FailureRate {
+		return c, errors.New("the circuit breaker failure rate must not be more than 1")
+	}
+	if 0 == c.Window {
+		c.Window = defaultBreakerWindow
+	}
+	if 0 == c.OpenPeriod {
+		c.OpenPeriod = defaultBreakerOpenPeriod
+	}
+	if 0 == c.ProbeSuccesses {
+		c.ProbeSuccesses = 1
+	}
+	return c, nil
+}
+
+// breakerState is the state of a circuit breaker, also reported by its
+// gauge.
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker keeps track of the health of a single URL.
+type circuitBreaker struct {
+	state breakerState
+
+	// The outcomes of the last attempts while closed, true for failures.
+	results     []bool
+	next        int
+	failures    int
+	consecutive int
+
+	// When the breaker opened, or the last probe started.
+	since     time.Time
+	probing   bool
+	successes int
+}
+
+// urlBreakers are the circuit breakers of the URLs of a webhook.  A nil
+// *urlBreakers lets every URL through.
+type urlBreakers struct {
+	mutex    sync.Mutex
+	config   CircuitBreakerConfig
+	breakers map[string]*circuitBreaker
+
+	id     string
+	gauge  metrics.Gauge
+	logger log.Logger
+}
+
+// newURLBreakers creates the breakers of the webhook with the id, or nil when
+// they are disabled.  The config must have its defaults.
+func newURLBreakers(id string, c CircuitBreakerConfig, gauge metrics.Gauge, logger log.Logger) *urlBreakers {
+	if !c.enabled() {
+		return nil
+	}
+	return &urlBreakers{
+		config:   c,
+		breakers: make(map[string]*circuitBreaker),
+		id:       id,
+		gauge:    gauge,
+		logger:   logger,
+	}
+}
+
+// update keeps the breakers of the URLs still used by the webhook, starting
+// closed breakers for the new ones.
+func (b *urlBreakers) update(urls []string) {
+	if nil == b {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	breakers := make(map[string]*circuitBreaker, len(urls))
+	for _, u := range urls {
+		if cb, ok := b.breakers[u]; ok {
+			breakers[u] = cb
+			continue
+		}
+		breakers[u] = &circuitBreaker{results: make([]bool, 0, b.config.Window)}
+		b.gauge.With("endpoint", u).Set(float64(breakerClosed))
+	}
+	for u := range b.breakers {
+		if _, ok := breakers[u]; !ok {
+			// The URL is gone, so it no longer reports as skipped.
+			b.gauge.With("endpoint", u).Set(float64(breakerClosed))
+		}
+	}
+	b.breakers = breakers
+}
+
+// pick returns the first URL of the ring whose breaker lets an attempt
+// through, or the ring itself when none does.
+func (b *urlBreakers) pick(urls *ring.Ring, now time.Time) *ring.Ring {
+	if nil == b {
+		return urls
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	r := urls
+	for i := urls.Len(); 0 < i; i-- {
+		if b.allow(r.Value.(string), now) {
+			return r
+		}
+		r = r.Next()
+	}
+	return urls
+}
+
+// allow determines if an attempt may go to the URL.  An open breaker lets a
+// single probe through once it has been open for the open period, and
+// another one when a probe didn't report back for as long.  The mutex must
+// be held.
+func (b *urlBreakers) allow(u string, now time.Time) bool {
+	cb, ok := b.breakers[u]
+	if !ok || breakerClosed == cb.state {
+		return true
+	}
+	if (cb.probing || breakerOpen == cb.state) && now.Sub(cb.since) < b.config.OpenPeriod {
+		return false
+	}
+	if breakerOpen == cb.state {
+		b.transition(u, cb, breakerHalfOpen)
+	}
+	cb.probing = true
+	cb.since = now
+	return true
+}
+
+// record updates the breaker of the URL with the outcome of an attempt.
+func (b *urlBreakers) record(u string, failed bool, now time.Time) {
+	if nil == b {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	cb, ok := b.breakers[u]
+	if !ok {
+		return
+	}
+
+	switch cb.state {
+	case breakerClosed:
+		if len(cb.results) < b.config.Window {
+			cb.results = append(cb.results, failed)
+		} else {
+			if cb.results[cb.next] {
+				cb.failures--
+			}
+			cb.results[cb.next] = failed
+			cb.next = (cb.next + 1) % b.config.Window
+		}
+		if failed {
+			cb.failures++
+			cb.consecutive++
+		} else {
+			cb.consecutive = 0
+		}
+		if b.tripped(cb) {
+			cb.since = now
+			b.transition(u, cb, breakerOpen)
+		}
+	case breakerHalfOpen:
+		cb.probing = false
+		if failed {
+			cb.since = now
+			b.transition(u, cb, breakerOpen)
+			return
+		}
+		cb.successes++
+		if b.config.ProbeSuccesses <= cb.successes {
+			b.transition(u, cb, breakerClosed)
+		}
+	}
+	// The late outcomes of the attempts started before the breaker opened
+	// are ignored.
+}
+
+// tripped determines if the closed breaker must open.
+func (b *urlBreakers) tripped(cb *circuitBreaker) bool {
+	if 0 < b.config.ConsecutiveFailures && b.config.ConsecutiveFailures <= cb.consecutive {
+		return true
+	}
+	return 0 < b.config.FailureRate && len(cb.results) == b.config.Window &&
+		b.config.FailureRate <= float64(cb.failures)/float64(b.config.Window)
+}
+
+// transition moves the breaker to the state, resetting what the state keeps
+// track of.  The mutex must be held.
+func (b *urlBreakers) transition(u string, cb *circuitBreaker, state breakerState) {
+	cb.state = state
+	switch state {
+	case breakerClosed:
+		cb.results = cb.results[:0]
+		cb.next, cb.failures, cb.consecutive = 0, 0, 0
+		cb.probing = false
+	case breakerOpen:
+		cb.probing = false
+	}
+	cb.successes = 0
+
+	logger := level.Info(b.logger)
+	if breakerOpen == state {
+		logger = level.Warn(b.logger)
+	}
+	logger.Log(logging.MessageKey(), "Circuit breaker changed state.",
+		"id", b.id, "url", u, "state", state.String())
+	b.gauge.With("endpoint", u).Set(float64(state))
+}
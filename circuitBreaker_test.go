@@ -0,0 +1,141 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"container/ring"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBreakers(t *testing.T, c CircuitBreakerConfig, urls ...string) (*urlBreakers, *ring.Ring) {
+	c, err := c.withDefaults()
+	require.Nil(t, err)
+	b := newURLBreakers("webhook", c, permissiveRegistry().NewGauge(CircuitBreakerStateGauge), log.NewNopLogger())
+	require.NotNil(t, b)
+	b.update(urls)
+
+	r := ring.New(len(urls))
+	for _, u := range urls {
+		r.Value = u
+		r = r.Next()
+	}
+	return b, r
+}
+
+func TestCircuitBreakerConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(newURLBreakers("webhook", CircuitBreakerConfig{}, nil, nil))
+
+	c, err := CircuitBreakerConfig{FailureRate: 0.5}.withDefaults()
+	assert.Nil(err)
+	assert.Equal(defaultBreakerWindow, c.Window)
+	assert.Equal(defaultBreakerOpenPeriod, c.OpenPeriod)
+	assert.Equal(1, c.ProbeSuccesses)
+
+	_, err = CircuitBreakerConfig{FailureRate: 1.5}.withDefaults()
+	assert.NotNil(err)
+	_, err = CircuitBreakerConfig{ConsecutiveFailures: -1}.withDefaults()
+	assert.NotNil(err)
+
+	// Without breakers every URL is picked in turn.
+	var b *urlBreakers
+	r := ring.New(1)
+	assert.Equal(r, b.pick(r, time.Now()))
+	b.record("a", true, time.Now())
+}
+
+func TestCircuitBreakerConsecutiveFailures(t *testing.T) {
+	assert := assert.New(t)
+
+	b, r := newTestBreakers(t, CircuitBreakerConfig{ConsecutiveFailures: 2, OpenPeriod: time.Minute, ProbeSuccesses: 2}, "a", "b")
+	now := time.Now()
+
+	b.record("a", true, now)
+	b.record("a", false, now)
+	b.record("a", true, now)
+	assert.Equal(breakerClosed, b.breakers["a"].state)
+	b.record("a", true, now)
+	assert.Equal(breakerOpen, b.breakers["a"].state)
+
+	// The open URL is skipped until a probe may go through.
+	assert.Equal("b", b.pick(r, now).Value)
+	assert.Equal("b", b.pick(r, now.Add(30*time.Second)).Value)
+	assert.Equal("a", b.pick(r, now.Add(time.Minute)).Value)
+	assert.Equal(breakerHalfOpen, b.breakers["a"].state)
+
+	// A single probe at a time.
+	assert.Equal("b", b.pick(r, now.Add(time.Minute)).Value)
+
+	// A failed probe opens the breaker again.
+	b.record("a", true, now.Add(time.Minute))
+	assert.Equal(breakerOpen, b.breakers["a"].state)
+
+	// Enough successful probes close it.
+	later := now.Add(2 * time.Minute)
+	assert.Equal("a", b.pick(r, later).Value)
+	b.record("a", false, later)
+	assert.Equal(breakerHalfOpen, b.breakers["a"].state)
+	assert.Equal("a", b.pick(r, later).Value)
+	b.record("a", false, later)
+	assert.Equal(breakerClosed, b.breakers["a"].state)
+	assert.Equal("a", b.pick(r, later).Value)
+}
+
+func TestCircuitBreakerFailureRate(t *testing.T) {
+	assert := assert.New(t)
+
+	b, _ := newTestBreakers(t, CircuitBreakerConfig{FailureRate: 0.75, Window: 4}, "a")
+	now := time.Now()
+
+	// The rate isn't measured until the window is full.
+	for _, failed := range []bool{true, true, false, false} {
+		b.record("a", failed, now)
+	}
+	assert.Equal(breakerClosed, b.breakers["a"].state)
+
+	// The oldest outcomes leave the window.
+	for _, failed := range []bool{false, true, true} {
+		b.record("a", failed, now)
+		assert.Equal(breakerClosed, b.breakers["a"].state)
+	}
+	b.record("a", true, now)
+	assert.Equal(breakerOpen, b.breakers["a"].state)
+}
+
+func TestCircuitBreakerAllOpen(t *testing.T) {
+	assert := assert.New(t)
+
+	b, r := newTestBreakers(t, CircuitBreakerConfig{ConsecutiveFailures: 1}, "a", "b")
+	now := time.Now()
+	b.record("a", true, now)
+	b.record("b", true, now)
+
+	// The URLs are still tried in turn rather than holding the events back.
+	assert.Equal(r, b.pick(r, now))
+
+	// The breakers of removed URLs are dropped.
+	b.update([]string{"b", "c"})
+	assert.Equal(2, len(b.breakers))
+	assert.Equal(breakerOpen, b.breakers["b"].state)
+	assert.Equal(breakerClosed, b.breakers["c"].state)
+}
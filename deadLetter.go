@@ -0,0 +1,338 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+	"github.com/gorilla/mux"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// DeadLetterConfig configures the store of the events that couldn't be
+// delivered.  The store is node-local: every instance keeps the events it
+// failed to deliver in memory, without sharing them with the others, and
+// loses them when it stops.
+type DeadLetterConfig struct {
+	// MaxPerWebhook is the most events kept for a webhook.  The oldest
+	// events make room for new ones.
+	// 0 disables the store.
+	MaxPerWebhook int
+
+	// MaxAge is how long the events are kept.
+	// 0 keeps them until they make room for new ones.
+	MaxAge time.Duration
+}
+
+// DeliveryAttempt is a single attempt to deliver an event.  Either the
+// Status of the response or the Error of the request is set.
+type DeliveryAttempt struct {
+	Time   time.Time `json:"time"`
+	URL    string    `json:"url"`
+	Status int       `json:"status,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// DeadLetter is an event that couldn't be delivered to a webhook, with the
+// outcome of every attempt.
+type DeadLetter struct {
+	ID       string            `json:"id"`
+	Webhook  string            `json:"webhook"`
+	Time     time.Time         `json:"time"`
+	Reason   string            `json:"reason"`
+	Status   int               `json:"status,omitempty"`
+	Error    string            `json:"error,omitempty"`
+	Attempts []DeliveryAttempt `json:"attempts"`
+	Message  *wrp.Message      `json:"message"`
+}
+
+// deadLetterStore keeps the dead letters of every webhook, oldest first.  A
+// nil *deadLetterStore keeps nothing.
+type deadLetterStore struct {
+	mutex         sync.Mutex
+	maxPerWebhook int
+	maxAge        time.Duration
+	letters       map[string][]*DeadLetter
+	nextID        uint64
+
+	counter metrics.Counter
+	gauge   metrics.Gauge
+	size    int
+}
+
+// New creates the store, or nil when it is disabled.
+func (c DeadLetterConfig) New(m CaduceusMetricsRegistry) (*deadLetterStore, error) {
+	if c.MaxPerWebhook < 0 || c.MaxAge < 0 {
+		return nil, errors.New("the dead letter limits must not be negative")
+	}
+	if 0 == c.MaxPerWebhook {
+		return nil, nil
+	}
+
+	s := &deadLetterStore{
+		maxPerWebhook: c.MaxPerWebhook,
+		maxAge:        c.MaxAge,
+		letters:       make(map[string][]*DeadLetter),
+		counter:       m.NewCounter(DeadLetterCounter),
+		gauge:         m.NewGauge(DeadLettersGauge),
+	}
+	s.gauge.Set(0)
+	return s, nil
+}
+
+// add stores the dead letter, giving it an id.
+func (s *deadLetterStore) add(l *DeadLetter) {
+	if nil == s {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.nextID++
+	l.ID = strconv.FormatUint(s.nextID, 10)
+
+	letters := append(s.expire(l.Webhook, l.Time), l)
+	if s.maxPerWebhook < len(letters) {
+		letters = letters[len(letters)-s.maxPerWebhook:]
+	}
+	s.set(l.Webhook, letters)
+	s.counter.With("url", l.Webhook).Add(1.0)
+}
+
+// expire drops the dead letters of the webhook older than maxAge, returning
+// the others.  The mutex must be held.
+func (s *deadLetterStore) expire(webhook string, now time.Time) []*DeadLetter {
+	letters := s.letters[webhook]
+	if 0 < s.maxAge {
+		i := 0
+		for i < len(letters) && s.maxAge < now.Sub(letters[i].Time) {
+			i++
+		}
+		letters = letters[i:]
+	}
+	return letters
+}
+
+// set replaces the dead letters of the webhook.  The mutex must be held.
+func (s *deadLetterStore) set(webhook string, letters []*DeadLetter) {
+	s.size += len(letters) - len(s.letters[webhook])
+	if 0 == len(letters) {
+		delete(s.letters, webhook)
+	} else {
+		s.letters[webhook] = letters
+	}
+	s.gauge.Set(float64(s.size))
+}
+
+// list returns the dead letters of the webhook, oldest first.
+func (s *deadLetterStore) list(webhook string) []*DeadLetter {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	letters := s.expire(webhook, time.Now())
+	s.set(webhook, letters)
+	return append([]*DeadLetter{}, letters...)
+}
+
+// get returns the dead letter with the id, unless it has expired.
+func (s *deadLetterStore) get(id string) (*DeadLetter, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for webhook := range s.letters {
+		letters := s.expire(webhook, now)
+		s.set(webhook, letters)
+		for _, l := range letters {
+			if id == l.ID {
+				return l, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// remove drops the dead letters with the ids from the webhook, returning how
+// many there were.
+func (s *deadLetterStore) remove(webhook string, ids ...string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	removed := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		removed[id] = true
+	}
+
+	var kept []*DeadLetter
+	for _, l := range s.letters[webhook] {
+		if !removed[l.ID] {
+			kept = append(kept, l)
+		}
+	}
+	count := len(s.letters[webhook]) - len(kept)
+	s.set(webhook, kept)
+	return count
+}
+
+// purge drops all the dead letters of the webhook, returning how many there
+// were.
+func (s *deadLetterStore) purge(webhook string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	count := len(s.letters[webhook])
+	s.set(webhook, nil)
+	return count
+}
+
+// deadLetterHandler serves the API of the dead letters.  The dead letters of
+// a webhook are selected with the webhook query parameter, holding the id
+// of the webhook reported by the metrics and the match endpoint.  Only the
+// owner of the webhook may see or act on its dead letters and, with partner
+// isolation, only if allowed every partner of the webhook.
+type deadLetterHandler struct {
+	store         *deadLetterStore
+	senderWrapper SenderWrapper
+	options       WebhookOptionsStore
+	isolation     PartnerIsolationConfig
+}
+
+// RedeliveryReport is the response body of a redelivery.
+type RedeliveryReport struct {
+	Redelivered []string `json:"redelivered"`
+	Failed      []string `json:"failed"`
+}
+
+// PurgeReport is the response body of a purge.
+type PurgeReport struct {
+	Purged int `json:"purged"`
+}
+
+func writeJSON(response http.ResponseWriter, request *http.Request, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if nil != err {
+		level.Error(logging.GetLogger(request.Context())).Log(logging.MessageKey(), "Unable to marshal the response.",
+			logging.ErrorKey(), err)
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response.Header().Set("Content-Type", wrp.MimeTypeJson)
+	response.WriteHeader(status)
+	response.Write(body)
+}
+
+// webhook returns the webhook the request is for, responding with a 400 if
+// it doesn't say.
+func (h deadLetterHandler) webhook(response http.ResponseWriter, request *http.Request) (string, bool) {
+	webhook := request.URL.Query().Get("webhook")
+	if "" == webhook {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write([]byte("The webhook query parameter is required.\n"))
+		return "", false
+	}
+	return webhook, h.authorize(response, request, webhook)
+}
+
+// letter returns the dead letter in the path, responding with a 404 if there
+// is none.
+func (h deadLetterHandler) letter(response http.ResponseWriter, request *http.Request) (*DeadLetter, bool) {
+	l, ok := h.store.get(mux.Vars(request)["id"])
+	if !ok {
+		response.WriteHeader(http.StatusNotFound)
+		response.Write([]byte("Dead letter not found.\n"))
+		return nil, false
+	}
+	return l, h.authorize(response, request, l.Webhook)
+}
+
+// authorize responds with an error unless the webhook is registered and the
+// request is allowed to act on it.
+func (h deadLetterHandler) authorize(response http.ResponseWriter, request *http.Request, webhook string) bool {
+	return authorizeWebhook(response, request, h.isolation, h.options.Get(webhook))
+}
+
+// ServeList lists the dead letters of a webhook.
+func (h deadLetterHandler) ServeList(response http.ResponseWriter, request *http.Request) {
+	if webhook, ok := h.webhook(response, request); ok {
+		writeJSON(response, request, http.StatusOK, h.store.list(webhook))
+	}
+}
+
+// ServePurge drops all the dead letters of a webhook.
+func (h deadLetterHandler) ServePurge(response http.ResponseWriter, request *http.Request) {
+	if webhook, ok := h.webhook(response, request); ok {
+		writeJSON(response, request, http.StatusOK, PurgeReport{Purged: h.store.purge(webhook)})
+	}
+}
+
+// ServeRedeliverAll queues all the dead letters of a webhook again.
+func (h deadLetterHandler) ServeRedeliverAll(response http.ResponseWriter, request *http.Request) {
+	if webhook, ok := h.webhook(response, request); ok {
+		h.redeliver(response, request, webhook, h.store.list(webhook))
+	}
+}
+
+// ServeGet reports a single dead letter.
+func (h deadLetterHandler) ServeGet(response http.ResponseWriter, request *http.Request) {
+	if l, ok := h.letter(response, request); ok {
+		writeJSON(response, request, http.StatusOK, l)
+	}
+}
+
+// ServeDelete drops a single dead letter.
+func (h deadLetterHandler) ServeDelete(response http.ResponseWriter, request *http.Request) {
+	if l, ok := h.letter(response, request); ok {
+		writeJSON(response, request, http.StatusOK, PurgeReport{Purged: h.store.remove(l.Webhook, l.ID)})
+	}
+}
+
+// ServeRedeliver queues a single dead letter again.
+func (h deadLetterHandler) ServeRedeliver(response http.ResponseWriter, request *http.Request) {
+	if l, ok := h.letter(response, request); ok {
+		h.redeliver(response, request, l.Webhook, []*DeadLetter{l})
+	}
+}
+
+// redeliver queues the dead letters of the webhook again, dropping those
+// queued from the store.  Those not queued, because the queue is full or the
+// webhook is gone, are kept.
+func (h deadLetterHandler) redeliver(response http.ResponseWriter, request *http.Request, webhook string, letters []*DeadLetter) {
+	report := RedeliveryReport{Redelivered: []string{}, Failed: []string{}}
+	for _, l := range letters {
+		if h.senderWrapper.Redeliver(webhook, l.Message) {
+			report.Redelivered = append(report.Redelivered, l.ID)
+		} else {
+			report.Failed = append(report.Failed, l.ID)
+		}
+	}
+	h.store.remove(webhook, report.Redelivered...)
+
+	status := http.StatusOK
+	if 0 < len(report.Failed) && 0 == len(report.Redelivered) {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(response, request, status, report)
+}
@@ -0,0 +1,346 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/webpa-common/secure/handler"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func deadLetterIDs(letters []*DeadLetter) []string {
+	ids := []string{}
+	for _, l := range letters {
+		ids = append(ids, l.ID)
+	}
+	return ids
+}
+
+func TestDeadLetterConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := DeadLetterConfig{}.New(permissiveRegistry())
+	assert.Nil(err)
+	assert.Nil(store)
+
+	_, err = DeadLetterConfig{MaxPerWebhook: -1}.New(permissiveRegistry())
+	assert.NotNil(err)
+
+	// A disabled store keeps nothing.
+	store.add(&DeadLetter{Webhook: "a"})
+}
+
+func TestDeadLetterStore(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := DeadLetterConfig{MaxPerWebhook: 2, MaxAge: time.Hour}.New(permissiveRegistry())
+	require.Nil(t, err)
+
+	now := time.Now()
+	store.add(&DeadLetter{Webhook: "a", Time: now.Add(-2 * time.Hour)})
+	store.add(&DeadLetter{Webhook: "a", Time: now})
+	store.add(&DeadLetter{Webhook: "b", Time: now})
+	store.add(&DeadLetter{Webhook: "a", Time: now})
+	store.add(&DeadLetter{Webhook: "a", Time: now})
+
+	// The oldest make room for the newest, and the expired are gone.
+	assert.Equal([]string{"4", "5"}, deadLetterIDs(store.list("a")))
+	assert.Equal([]string{"3"}, deadLetterIDs(store.list("b")))
+	assert.Empty(store.list("c"))
+
+	l, ok := store.get("3")
+	assert.True(ok)
+	assert.Equal("b", l.Webhook)
+	_, ok = store.get("1")
+	assert.False(ok)
+
+	// An expired dead letter is gone even before its webhook is listed.
+	store.add(&DeadLetter{Webhook: "c", Time: now.Add(-2 * time.Hour)})
+	_, ok = store.get("6")
+	assert.False(ok)
+
+	assert.Equal(1, store.remove("a", "4", "3"))
+	assert.Equal([]string{"5"}, deadLetterIDs(store.list("a")))
+	assert.Equal(1, store.purge("b"))
+	assert.Empty(store.list("b"))
+	assert.Equal(1, store.size)
+}
+
+func TestDeadLetterHandler(t *testing.T) {
+	store, err := DeadLetterConfig{MaxPerWebhook: 10}.New(permissiveRegistry())
+	require.Nil(t, err)
+
+	// The webhook is registered without an owner.
+	options := newMemoryOptionsStore()
+	options.Put(context.Background(), "a", WebhookOptions{Registered: time.Now()})
+
+	tests := []struct {
+		description    string
+		values         *handler.ContextValues
+		method         string
+		url            string
+		redelivered    []bool
+		expectedStatus int
+		expectedIDs    []string
+	}{
+		{
+			description:    "No Webhook",
+			method:         "GET",
+			url:            "/deadletters",
+			expectedStatus: http.StatusBadRequest,
+			expectedIDs:    []string{"1", "2", "3"},
+		},
+		{
+			description:    "List",
+			method:         "GET",
+			url:            "/deadletters?webhook=a",
+			expectedStatus: http.StatusOK,
+			expectedIDs:    []string{"1", "2", "3"},
+		},
+		{
+			description:    "List Unknown Webhook",
+			method:         "GET",
+			url:            "/deadletters?webhook=b",
+			expectedStatus: http.StatusNotFound,
+			expectedIDs:    []string{"1", "2", "3"},
+		},
+		{
+			description:    "Purge By Other Owner",
+			values:         &handler.ContextValues{SatClientID: "client"},
+			method:         "DELETE",
+			url:            "/deadletters?webhook=a",
+			expectedStatus: http.StatusForbidden,
+			expectedIDs:    []string{"1", "2", "3"},
+		},
+		{
+			description:    "Get",
+			method:         "GET",
+			url:            "/deadletters/2",
+			expectedStatus: http.StatusOK,
+			expectedIDs:    []string{"1", "2", "3"},
+		},
+		{
+			description:    "Get Unknown",
+			method:         "GET",
+			url:            "/deadletters/42",
+			expectedStatus: http.StatusNotFound,
+			expectedIDs:    []string{"1", "2", "3"},
+		},
+		{
+			description:    "Delete",
+			method:         "DELETE",
+			url:            "/deadletters/2",
+			expectedStatus: http.StatusOK,
+			expectedIDs:    []string{"1", "3"},
+		},
+		{
+			description:    "Purge",
+			method:         "DELETE",
+			url:            "/deadletters?webhook=a",
+			expectedStatus: http.StatusOK,
+			expectedIDs:    []string{},
+		},
+		{
+			description:    "Delete By Other Owner",
+			values:         &handler.ContextValues{SatClientID: "client"},
+			method:         "DELETE",
+			url:            "/deadletters/2",
+			expectedStatus: http.StatusForbidden,
+			expectedIDs:    []string{"1", "2", "3"},
+		},
+		{
+			description:    "Redeliver",
+			method:         "POST",
+			url:            "/deadletters/2/redeliver",
+			redelivered:    []bool{true},
+			expectedStatus: http.StatusOK,
+			expectedIDs:    []string{"1", "3"},
+		},
+		{
+			description:    "Redeliver Failed",
+			method:         "POST",
+			url:            "/deadletters/2/redeliver",
+			redelivered:    []bool{false},
+			expectedStatus: http.StatusServiceUnavailable,
+			expectedIDs:    []string{"1", "2", "3"},
+		},
+		{
+			description:    "Redeliver All",
+			method:         "POST",
+			url:            "/deadletters/redeliver?webhook=a",
+			redelivered:    []bool{true, false, true},
+			expectedStatus: http.StatusOK,
+			expectedIDs:    []string{"2"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			store.purge("a")
+			store.nextID = 0
+			for i := 0; i < 3; i++ {
+				store.add(&DeadLetter{Webhook: "a", Time: time.Now(), Message: &wrp.Message{Type: wrp.SimpleEventMessageType}})
+			}
+
+			sw := new(mockSenderWrapper)
+			for _, ok := range tc.redelivered {
+				sw.On("Redeliver", "a", mock.Anything).Return(ok).Once()
+			}
+
+			h := deadLetterHandler{store: store, senderWrapper: sw, options: options}
+			router := mux.NewRouter()
+			router.HandleFunc("/deadletters", h.ServeList).Methods("GET")
+			router.HandleFunc("/deadletters", h.ServePurge).Methods("DELETE")
+			router.HandleFunc("/deadletters/redeliver", h.ServeRedeliverAll).Methods("POST")
+			router.HandleFunc("/deadletters/{id}", h.ServeGet).Methods("GET")
+			router.HandleFunc("/deadletters/{id}", h.ServeDelete).Methods("DELETE")
+			router.HandleFunc("/deadletters/{id}/redeliver", h.ServeRedeliver).Methods("POST")
+
+			request := httptest.NewRequest(tc.method, tc.url, nil)
+			if nil != tc.values {
+				request = request.WithContext(handler.NewContextWithValue(request.Context(), tc.values))
+			}
+
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+
+			assert.Equal(tc.expectedStatus, response.Code)
+			assert.Equal(tc.expectedIDs, deadLetterIDs(store.list("a")))
+			sw.AssertExpectations(t)
+
+			if "List" == tc.description {
+				var letters []*DeadLetter
+				assert.Nil(json.Unmarshal(response.Body.Bytes(), &letters))
+				assert.Equal(3, len(letters))
+			}
+		})
+	}
+}
+
+func TestDeadLetterHandlerPartnerIsolation(t *testing.T) {
+	tests := []struct {
+		description    string
+		values         *handler.ContextValues
+		method         string
+		url            string
+		expectedStatus int
+	}{
+		{
+			description:    "List By The Partner",
+			values:         &handler.ContextValues{SatClientID: "client", PartnerIDs: []string{"comcast"}},
+			method:         "GET",
+			url:            "/deadletters?webhook=http://localhost/foo",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			description:    "Get By The Partner",
+			values:         &handler.ContextValues{SatClientID: "client", PartnerIDs: []string{"comcast"}},
+			method:         "GET",
+			url:            "/deadletters/1",
+			expectedStatus: http.StatusOK,
+		},
+		{
+			description:    "Get By Privileged Other Owner",
+			values:         &handler.ContextValues{SatClientID: "admin", PartnerIDs: []string{"*"}},
+			method:         "GET",
+			url:            "/deadletters/1",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			description:    "List By Other Partner",
+			values:         &handler.ContextValues{SatClientID: "client", PartnerIDs: []string{"other"}},
+			method:         "GET",
+			url:            "/deadletters?webhook=http://localhost/foo",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			description:    "Purge By Other Partner",
+			values:         &handler.ContextValues{SatClientID: "client", PartnerIDs: []string{"other"}},
+			method:         "DELETE",
+			url:            "/deadletters?webhook=http://localhost/foo",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			description:    "Delete By Other Partner",
+			values:         &handler.ContextValues{SatClientID: "client", PartnerIDs: []string{"other"}},
+			method:         "DELETE",
+			url:            "/deadletters/1",
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			description:    "Redeliver Without Token",
+			method:         "POST",
+			url:            "/deadletters/1/redeliver",
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			store, err := DeadLetterConfig{MaxPerWebhook: 10}.New(permissiveRegistry())
+			require.Nil(t, err)
+			store.add(&DeadLetter{Webhook: "http://localhost/foo", Time: time.Now(), Message: &wrp.Message{Type: wrp.SimpleEventMessageType}})
+
+			options := newMemoryOptionsStore()
+			options.Put(context.Background(), "http://localhost/foo", WebhookOptions{Owner: "client", Registered: time.Now(), PartnerIDs: []string{"comcast"}})
+
+			h := deadLetterHandler{
+				store:         store,
+				senderWrapper: new(mockSenderWrapper),
+				options:       options,
+				isolation: PartnerIsolationConfig{
+					Enabled:           true,
+					PrivilegedClients: []string{"admin"},
+				},
+			}
+			router := mux.NewRouter()
+			router.HandleFunc("/deadletters", h.ServeList).Methods("GET")
+			router.HandleFunc("/deadletters", h.ServePurge).Methods("DELETE")
+			router.HandleFunc("/deadletters/{id}", h.ServeGet).Methods("GET")
+			router.HandleFunc("/deadletters/{id}", h.ServeDelete).Methods("DELETE")
+			router.HandleFunc("/deadletters/{id}/redeliver", h.ServeRedeliver).Methods("POST")
+
+			request := httptest.NewRequest(tc.method, tc.url, nil)
+			if nil != tc.values {
+				request = request.WithContext(handler.NewContextWithValue(request.Context(), tc.values))
+			}
+
+			response := httptest.NewRecorder()
+			router.ServeHTTP(response, request)
+			assert.Equal(tc.expectedStatus, response.Code)
+
+			// Nothing is dropped for the requests forbidden.
+			if http.StatusForbidden == tc.expectedStatus {
+				assert.Equal([]string{"1"}, deadLetterIDs(store.list("http://localhost/foo")))
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+const defaultDedupeMaxSize = 100000
+
+// DedupeConfig configures the suppression of duplicate messages, detected by
+// their TransactionUUID.
+type DedupeConfig struct {
+	// Window is how long the TransactionUUID of a message is remembered.
+	// 0 disables the suppression of duplicates.
+	Window time.Duration
+
+	// MaxSize is the most TransactionUUIDs remembered at once.  The oldest
+	// are forgotten first.
+	// (Optional) defaults to 100000.
+	MaxSize int
+}
+
+type dedupeEntry struct {
+	id   string
+	seen time.Time
+}
+
+// dedupeCache remembers the recently seen TransactionUUIDs.  A nil
+// *dedupeCache considers no message a duplicate.
+type dedupeCache struct {
+	mutex   sync.Mutex
+	window  time.Duration
+	maxSize int
+	entries map[string]*list.Element
+	order   *list.List
+	now     func() time.Time
+}
+
+// New creates the cache described by the configuration.  A nil cache is
+// returned when the suppression of duplicates is disabled.
+func (c DedupeConfig) New() (*dedupeCache, error) {
+	if c.Window < 0 {
+		return nil, errors.New("the dedupe window must not be negative")
+	}
+	if 0 == c.Window {
+		return nil, nil
+	}
+
+	if c.MaxSize <= 0 {
+		c.MaxSize = defaultDedupeMaxSize
+	}
+
+	return &dedupeCache{
+		window:  c.Window,
+		maxSize: c.MaxSize,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}, nil
+}
+
+// duplicate records the id and reports if it was already seen within the
+// window.
+func (d *dedupeCache) duplicate(id string) bool {
+	if nil == d {
+		return false
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := d.now()
+
+	// Entries are ordered by when they were seen, so the expired ones are
+	// all at the front.
+	for e := d.order.Front(); nil != e; e = d.order.Front() {
+		entry := e.Value.(dedupeEntry)
+		if now.Sub(entry.seen) < d.window {
+			break
+		}
+		d.order.Remove(e)
+		delete(d.entries, entry.id)
+	}
+
+	if _, ok := d.entries[id]; ok {
+		return true
+	}
+
+	if d.maxSize <= d.order.Len() {
+		oldest := d.order.Front()
+		d.order.Remove(oldest)
+		delete(d.entries, oldest.Value.(dedupeEntry).id)
+	}
+	d.entries[id] = d.order.PushBack(dedupeEntry{id: id, seen: now})
+
+	return false
+}
+
+// forget removes the id so it is no longer a duplicate.
+func (d *dedupeCache) forget(id string) {
+	if nil == d {
+		return
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if e, ok := d.entries[id]; ok {
+		d.order.Remove(e)
+		delete(d.entries, id)
+	}
+}
@@ -0,0 +1,98 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupeConfigNew(t *testing.T) {
+	assert := assert.New(t)
+
+	d, err := DedupeConfig{}.New()
+	assert.Nil(err)
+	assert.Nil(d)
+	assert.False(d.duplicate("1234"))
+
+	_, err = DedupeConfig{Window: -time.Second}.New()
+	assert.NotNil(err)
+
+	d, err = DedupeConfig{Window: time.Minute}.New()
+	assert.Nil(err)
+	assert.Equal(defaultDedupeMaxSize, d.maxSize)
+}
+
+func TestDedupeCacheWindow(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	d, err := DedupeConfig{Window: time.Minute}.New()
+	require.Nil(err)
+
+	now := time.Now()
+	d.now = func() time.Time { return now }
+
+	assert.False(d.duplicate("1234"))
+	assert.True(d.duplicate("1234"))
+	assert.False(d.duplicate("5678"))
+
+	now = now.Add(30 * time.Second)
+	assert.True(d.duplicate("1234"))
+
+	now = now.Add(31 * time.Second)
+	assert.False(d.duplicate("1234"))
+	assert.False(d.duplicate("5678"))
+	assert.Equal(2, d.order.Len())
+}
+
+func TestDedupeCacheMaxSize(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	d, err := DedupeConfig{Window: time.Minute, MaxSize: 2}.New()
+	require.Nil(err)
+
+	assert.False(d.duplicate("1"))
+	assert.False(d.duplicate("2"))
+	assert.False(d.duplicate("3"))
+	assert.Equal(2, len(d.entries))
+
+	// the oldest was forgotten to make room
+	assert.False(d.duplicate("1"))
+	assert.True(d.duplicate("3"))
+}
+
+func TestDedupeCacheForget(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	d, err := DedupeConfig{Window: time.Minute}.New()
+	require.Nil(err)
+
+	assert.False(d.duplicate("1234"))
+	d.forget("1234")
+	d.forget("5678")
+	assert.False(d.duplicate("1234"))
+	assert.True(d.duplicate("1234"))
+
+	var nilCache *dedupeCache
+	nilCache.forget("1234")
+}
@@ -0,0 +1,254 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// DeliveryBounds are the bounds the webhooks may set their own delivery
+// settings within.  A setting without a maximum can't be set by the
+// webhooks, so they always get the sender configuration.  MinWorkers and
+// MaxWorkers bound both the workers and the min_workers of the webhooks.
+type DeliveryBounds struct {
+	MinDeliveryRetries     int
+	MaxDeliveryRetries     int
+	MinDeliveryInterval    time.Duration
+	MaxDeliveryInterval    time.Duration
+	MinQueueSize           int
+	MaxQueueSize           int
+	MinWorkers             int
+	MaxWorkers             int
+	MinCutOffPeriod        time.Duration
+	MaxCutOffPeriod        time.Duration
+	MinClientTimeout       time.Duration
+	MaxClientTimeout       time.Duration
+	MinDeliveryMaxInterval time.Duration
+	MaxDeliveryMaxInterval time.Duration
+	MinBatchSize           int
+	MaxBatchSize           int
+	MinBatchBytes          int
+	MaxBatchBytes          int
+	MinBatchLinger         time.Duration
+	MaxBatchLinger         time.Duration
+	MinWeight              int
+	MaxWeight              int
+}
+
+// deliverySettings are the settings a sender delivers with.
+type deliverySettings struct {
+	retries       int
+	interval      time.Duration
+	queueSize     int
+	maxWorkers    int
+	cutOffPeriod  time.Duration
+	clientTimeout time.Duration
+	maxInterval   time.Duration
+	batchSize     int
+	batchBytes    int
+	batchLinger   time.Duration
+
+	// The share of the shared worker pool: the concurrent deliveries the
+	// sender is served first with and its weight.
+	minWorkers int
+	weight     int
+}
+
+// jsonDuration is a duration written in JSON like "10s".
+type jsonDuration time.Duration
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); nil != err {
+		return errors.New("durations must be strings like \"10s\"")
+	}
+	parsed, err := time.ParseDuration(s)
+	if nil != err {
+		return err
+	}
+	*d = jsonDuration(parsed)
+	return nil
+}
+
+// deliverySetting is a setting of the webhook options: where the webhook sets
+// it, where the sender gets it and its bounds.
+type deliverySetting struct {
+	name   string
+	get    func(WebhookOptions) (value int64, set bool)
+	assign func(*deliverySettings, int64)
+	min    func(DeliveryBounds) int64
+	max    func(DeliveryBounds) int64
+	format func(int64) string
+}
+
+func formatInt(v int64) string      { return fmt.Sprintf("%d", v) }
+func formatDuration(v int64) string { return time.Duration(v).String() }
+
+// deliverySettingsTable lists the delivery settings the webhooks may set.
+var deliverySettingsTable = []deliverySetting{
+	{
+		name: "delivery_retries",
+		get: func(o WebhookOptions) (int64, bool) {
+			if nil == o.DeliveryRetries {
+				return 0, false
+			}
+			return int64(*o.DeliveryRetries), true
+		},
+		assign: func(s *deliverySettings, v int64) { s.retries = int(v) },
+		min:    func(b DeliveryBounds) int64 { return int64(b.MinDeliveryRetries) },
+		max:    func(b DeliveryBounds) int64 { return int64(b.MaxDeliveryRetries) },
+		format: formatInt,
+	},
+	{
+		name:   "delivery_interval",
+		get:    func(o WebhookOptions) (int64, bool) { return int64(o.DeliveryInterval), 0 != o.DeliveryInterval },
+		assign: func(s *deliverySettings, v int64) { s.interval = time.Duration(v) },
+		min:    func(b DeliveryBounds) int64 { return int64(b.MinDeliveryInterval) },
+		max:    func(b DeliveryBounds) int64 { return int64(b.MaxDeliveryInterval) },
+		format: formatDuration,
+	},
+	{
+		name:   "queue_size",
+		get:    func(o WebhookOptions) (int64, bool) { return int64(o.QueueSize), 0 != o.QueueSize },
+		assign: func(s *deliverySettings, v int64) { s.queueSize = int(v) },
+		min:    func(b DeliveryBounds) int64 { return int64(b.MinQueueSize) },
+		max:    func(b DeliveryBounds) int64 { return int64(b.MaxQueueSize) },
+		format: formatInt,
+	},
+	{
+		name:   "workers",
+		get:    func(o WebhookOptions) (int64, bool) { return int64(o.Workers), 0 != o.Workers },
+		assign: func(s *deliverySettings, v int64) { s.maxWorkers = int(v) },
+		min:    func(b DeliveryBounds) int64 { return int64(b.MinWorkers) },
+		max:    func(b DeliveryBounds) int64 { return int64(b.MaxWorkers) },
+		format: formatInt,
+	},
+	{
+		name:   "cut_off_period",
+		get:    func(o WebhookOptions) (int64, bool) { return int64(o.CutOffPeriod), 0 != o.CutOffPeriod },
+		assign: func(s *deliverySettings, v int64) { s.cutOffPeriod = time.Duration(v) },
+		min:    func(b DeliveryBounds) int64 { return int64(b.MinCutOffPeriod) },
+		max:    func(b DeliveryBounds) int64 { return int64(b.MaxCutOffPeriod) },
+		format: formatDuration,
+	},
+	{
+		name:   "client_timeout",
+		get:    func(o WebhookOptions) (int64, bool) { return int64(o.ClientTimeout), 0 != o.ClientTimeout },
+		assign: func(s *deliverySettings, v int64) { s.clientTimeout = time.Duration(v) },
+		min:    func(b DeliveryBounds) int64 { return int64(b.MinClientTimeout) },
+		max:    func(b DeliveryBounds) int64 { return int64(b.MaxClientTimeout) },
+		format: formatDuration,
+	},
+	{
+		name:   "delivery_max_interval",
+		get:    func(o WebhookOptions) (int64, bool) { return int64(o.DeliveryMaxInterval), 0 != o.DeliveryMaxInterval },
+		assign: func(s *deliverySettings, v int64) { s.maxInterval = time.Duration(v) },
+		min:    func(b DeliveryBounds) int64 { return int64(b.MinDeliveryMaxInterval) },
+		max:    func(b DeliveryBounds) int64 { return int64(b.MaxDeliveryMaxInterval) },
+		format: formatDuration,
+	},
+	{
+		name:   "batch_size",
+		get:    func(o WebhookOptions) (int64, bool) { return int64(o.BatchSize), 0 != o.BatchSize },
+		assign: func(s *deliverySettings, v int64) { s.batchSize = int(v) },
+		min:    func(b DeliveryBounds) int64 { return int64(b.MinBatchSize) },
+		max:    func(b DeliveryBounds) int64 { return int64(b.MaxBatchSize) },
+		format: formatInt,
+	},
+	{
+		name:   "batch_bytes",
+		get:    func(o WebhookOptions) (int64, bool) { return int64(o.BatchBytes), 0 != o.BatchBytes },
+		assign: func(s *deliverySettings, v int64) { s.batchBytes = int(v) },
+		min:    func(b DeliveryBounds) int64 { return int64(b.MinBatchBytes) },
+		max:    func(b DeliveryBounds) int64 { return int64(b.MaxBatchBytes) },
+		format: formatInt,
+	},
+	{
+		name:   "batch_linger",
+		get:    func(o WebhookOptions) (int64, bool) { return int64(o.BatchLinger), 0 != o.BatchLinger },
+		assign: func(s *deliverySettings, v int64) { s.batchLinger = time.Duration(v) },
+		min:    func(b DeliveryBounds) int64 { return int64(b.MinBatchLinger) },
+		max:    func(b DeliveryBounds) int64 { return int64(b.MaxBatchLinger) },
+		format: formatDuration,
+	},
+	{
+		name:   "min_workers",
+		get:    func(o WebhookOptions) (int64, bool) { return int64(o.MinWorkers), 0 != o.MinWorkers },
+		assign: func(s *deliverySettings, v int64) { s.minWorkers = int(v) },
+		min:    func(b DeliveryBounds) int64 { return int64(b.MinWorkers) },
+		max:    func(b DeliveryBounds) int64 { return int64(b.MaxWorkers) },
+		format: formatInt,
+	},
+	{
+		name:   "weight",
+		get:    func(o WebhookOptions) (int64, bool) { return int64(o.Weight), 0 != o.Weight },
+		assign: func(s *deliverySettings, v int64) { s.weight = int(v) },
+		min:    func(b DeliveryBounds) int64 { return int64(b.MinWeight) },
+		max:    func(b DeliveryBounds) int64 { return int64(b.MaxWeight) },
+		format: formatInt,
+	},
+}
+
+// validate checks the delivery settings of the options are within bounds.
+func (b DeliveryBounds) validate(o WebhookOptions) error {
+	for _, s := range deliverySettingsTable {
+		value, set := s.get(o)
+		if !set {
+			continue
+		}
+		min, max := s.min(b), s.max(b)
+		if max <= 0 {
+			return fmt.Errorf("%s can't be set", s.name)
+		}
+		if value < min || max < value {
+			return fmt.Errorf("%s must be between %s and %s", s.name, s.format(min), s.format(max))
+		}
+	}
+	if 0 != o.Workers && o.Workers < o.MinWorkers {
+		return errors.New("min_workers must not be more than workers")
+	}
+	return nil
+}
+
+// apply returns the defaults overridden by the delivery settings of the
+// options, brought within bounds.  The options may have been validated by
+// another instance with other bounds.
+func (b DeliveryBounds) apply(defaults deliverySettings, o WebhookOptions) deliverySettings {
+	settings := defaults
+	for _, s := range deliverySettingsTable {
+		value, set := s.get(o)
+		min, max := s.min(b), s.max(b)
+		if !set || max <= 0 {
+			continue
+		}
+		switch {
+		case value < min:
+			value = min
+		case max < value:
+			value = max
+		}
+		s.assign(&settings, value)
+	}
+	return settings
+}
@@ -0,0 +1,152 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func TestDeliveryBoundsValidate(t *testing.T) {
+	bounds := DeliveryBounds{
+		MaxDeliveryRetries:  10,
+		MinDeliveryInterval: time.Second,
+		MaxDeliveryInterval: time.Minute,
+		MinQueueSize:        10,
+		MaxQueueSize:        1000,
+		MinWorkers:          1,
+		MaxWorkers:          20,
+		MinWeight:           1,
+		MaxWeight:           10,
+	}
+
+	tests := []struct {
+		description string
+		options     WebhookOptions
+		expected    string
+	}{
+		{
+			description: "Nothing Set",
+		},
+		{
+			description: "Within Bounds",
+			options: WebhookOptions{
+				DeliveryRetries:  intPtr(0),
+				DeliveryInterval: jsonDuration(time.Second),
+				QueueSize:        1000,
+			},
+		},
+		{
+			description: "Too Many Retries",
+			options:     WebhookOptions{DeliveryRetries: intPtr(11)},
+			expected:    "delivery_retries must be between 0 and 10",
+		},
+		{
+			description: "Interval Too Short",
+			options:     WebhookOptions{DeliveryInterval: jsonDuration(time.Millisecond)},
+			expected:    "delivery_interval must be between 1s and 1m0s",
+		},
+		{
+			description: "Without Bounds",
+			options:     WebhookOptions{BatchSize: 5},
+			expected:    "batch_size can't be set",
+		},
+		{
+			description: "Weight Out Of Bounds",
+			options:     WebhookOptions{Weight: 11},
+			expected:    "weight must be between 1 and 10",
+		},
+		{
+			description: "Minimum Over Maximum",
+			options:     WebhookOptions{Workers: 5, MinWorkers: 6},
+			expected:    "min_workers must not be more than workers",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			err := bounds.validate(tc.options)
+			if "" == tc.expected {
+				assert.Nil(t, err)
+			} else {
+				assert.EqualError(t, err, tc.expected)
+			}
+		})
+	}
+}
+
+func TestDeliveryBoundsApply(t *testing.T) {
+	assert := assert.New(t)
+
+	defaults := deliverySettings{
+		retries:      1,
+		interval:     10 * time.Millisecond,
+		queueSize:    100,
+		maxWorkers:   10,
+		cutOffPeriod: 30 * time.Second,
+	}
+	bounds := DeliveryBounds{
+		MaxDeliveryRetries: 5,
+		MinQueueSize:       10,
+		MaxQueueSize:       1000,
+		MaxWorkers:         20,
+		MaxClientTimeout:   time.Minute,
+		MaxBatchSize:       100,
+	}
+
+	assert.Equal(defaults, bounds.apply(defaults, WebhookOptions{}))
+
+	assert.Equal(deliverySettings{
+		retries:       0,
+		interval:      10 * time.Millisecond,
+		queueSize:     10,
+		maxWorkers:    20,
+		cutOffPeriod:  30 * time.Second,
+		clientTimeout: 5 * time.Second,
+		batchSize:     100,
+	}, bounds.apply(defaults, WebhookOptions{
+		DeliveryRetries:  intPtr(0),
+		DeliveryInterval: jsonDuration(time.Second),
+		QueueSize:        1,
+		Workers:          50,
+		ClientTimeout:    jsonDuration(5 * time.Second),
+		BatchSize:        500,
+		BatchLinger:      jsonDuration(time.Second),
+	}))
+}
+
+func TestJSONDuration(t *testing.T) {
+	assert := assert.New(t)
+
+	b, err := json.Marshal(jsonDuration(90 * time.Second))
+	assert.Nil(err)
+	assert.Equal(`"1m30s"`, string(b))
+
+	var d jsonDuration
+	assert.Nil(json.Unmarshal([]byte(`"250ms"`), &d))
+	assert.Equal(jsonDuration(250*time.Millisecond), d)
+
+	assert.NotNil(json.Unmarshal([]byte(`250`), &d))
+	assert.NotNil(json.Unmarshal([]byte(`"soon"`), &d))
+}
@@ -0,0 +1,222 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+const (
+	// waitForDeliveryHeader is the request header used to ask the notify
+	// endpoint to wait until the message has been delivered.  The value is
+	// either a boolean or the duration to wait.
+	waitForDeliveryHeader = "X-Caduceus-Wait-For-Delivery"
+
+	// waitForDeliveryParam is the query parameter equivalent of
+	// waitForDeliveryHeader.
+	waitForDeliveryParam = "wait"
+
+	// defaultDeliveryWaitTimeout is used when no maximum wait is configured.
+	defaultDeliveryWaitTimeout = 30 * time.Second
+)
+
+// DeliveryResult is the final outcome of delivering a message to a single
+// webhook.  Either the Status of the last attempt or the Reason the message
+// was dropped is set.
+type DeliveryResult struct {
+	Webhook string `json:"webhook"`
+	Status  int    `json:"status,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// DeliveryReport is the response body of a notify request that waited for
+// delivery.
+type DeliveryReport struct {
+	TransactionUUID string           `json:"transaction_uuid"`
+	TimedOut        bool             `json:"timed_out"`
+	Webhooks        []DeliveryResult `json:"webhooks"`
+}
+
+// deliveryTracker collects the delivery results of one message across all
+// the webhooks it matched.
+type deliveryTracker struct {
+	mutex   sync.Mutex
+	pending map[string]int
+	results []DeliveryResult
+	sealed  bool
+	done    chan struct{}
+}
+
+func newDeliveryTracker() *deliveryTracker {
+	return &deliveryTracker{
+		pending: make(map[string]int),
+		done:    make(chan struct{}),
+	}
+}
+
+// matched records that the message has been accepted for delivery to the
+// webhook with the given id.
+func (t *deliveryTracker) matched(id string) {
+	if nil == t {
+		return
+	}
+	t.mutex.Lock()
+	t.pending[id]++
+	t.mutex.Unlock()
+}
+
+// delivered records the status code of the final delivery attempt.
+func (t *deliveryTracker) delivered(id string, status int) {
+	t.finish(DeliveryResult{Webhook: id, Status: status})
+}
+
+// dropped records the reason the message was not delivered.
+func (t *deliveryTracker) dropped(id, reason string) {
+	t.finish(DeliveryResult{Webhook: id, Reason: reason})
+}
+
+func (t *deliveryTracker) finish(result DeliveryResult) {
+	if nil == t {
+		return
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if 0 == t.pending[result.Webhook] {
+		return
+	}
+	t.pending[result.Webhook]--
+	if 0 == t.pending[result.Webhook] {
+		delete(t.pending, result.Webhook)
+	}
+	t.results = append(t.results, result)
+	t.checkDone()
+}
+
+// seal is called once the fan-out of the message is complete so no more
+// webhooks can match it.
+func (t *deliveryTracker) seal() {
+	if nil == t {
+		return
+	}
+	t.mutex.Lock()
+	t.sealed = true
+	t.checkDone()
+	t.mutex.Unlock()
+}
+
+// checkDone must be called with the mutex held.
+func (t *deliveryTracker) checkDone() {
+	if t.sealed && 0 == len(t.pending) {
+		select {
+		case <-t.done:
+		default:
+			close(t.done)
+		}
+	}
+}
+
+// wait blocks until every matched webhook reported a result or the timeout
+// passes.  Webhooks without a result are reported as timed out.
+func (t *deliveryTracker) wait(timeout time.Duration) ([]DeliveryResult, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	timedOut := false
+	select {
+	case <-t.done:
+	case <-timer.C:
+		timedOut = true
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	results := make([]DeliveryResult, len(t.results), len(t.results)+len(t.pending))
+	copy(results, t.results)
+	for id, count := range t.pending {
+		for i := 0; i < count; i++ {
+			results = append(results, DeliveryResult{Webhook: id, Reason: "timeout"})
+		}
+	}
+
+	return results, timedOut
+}
+
+// deliveryTrackers associates in flight messages with the trackers waiting
+// on their delivery.  A nil *deliveryTrackers tracks nothing.
+type deliveryTrackers struct {
+	trackers sync.Map
+}
+
+func (d *deliveryTrackers) track(msg *wrp.Message) *deliveryTracker {
+	t := newDeliveryTracker()
+	d.trackers.Store(msg, t)
+	return t
+}
+
+func (d *deliveryTrackers) untrack(msg *wrp.Message) {
+	d.trackers.Delete(msg)
+}
+
+// get returns the tracker for the message, or nil if nobody is waiting on it.
+func (d *deliveryTrackers) get(msg *wrp.Message) *deliveryTracker {
+	if nil == d {
+		return nil
+	}
+	if t, ok := d.trackers.Load(msg); ok {
+		return t.(*deliveryTracker)
+	}
+	return nil
+}
+
+// deliveryWait determines if the request asked to wait for delivery and for
+// how long, never longer than max.
+func deliveryWait(request *http.Request, max time.Duration) (bool, time.Duration) {
+	if max <= 0 {
+		max = defaultDeliveryWaitTimeout
+	}
+
+	value := request.Header.Get(waitForDeliveryHeader)
+	if "" == value {
+		value = request.URL.Query().Get(waitForDeliveryParam)
+	}
+	if "" == value {
+		return false, 0
+	}
+
+	if wait, err := strconv.ParseBool(value); nil == err {
+		if !wait {
+			return false, 0
+		}
+		return true, max
+	}
+
+	d, err := time.ParseDuration(value)
+	if nil != err || d <= 0 {
+		return false, 0
+	}
+	if d > max {
+		d = max
+	}
+	return true, d
+}
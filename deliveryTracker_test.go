@@ -0,0 +1,147 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func TestDeliveryTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	trackers := new(deliveryTrackers)
+	msg := simpleRequest()
+
+	tracker := trackers.track(msg)
+	assert.Equal(tracker, trackers.get(msg))
+	assert.Nil(trackers.get(simpleRequest()))
+
+	tracker.matched("http://localhost:8888/foo")
+	tracker.matched("http://localhost:9999/foo")
+	tracker.seal()
+
+	go func() {
+		tracker.delivered("http://localhost:8888/foo", 200)
+		tracker.dropped("http://localhost:9999/foo", "cut_off")
+	}()
+
+	results, timedOut := tracker.wait(time.Second)
+	assert.False(timedOut)
+	assert.ElementsMatch([]DeliveryResult{
+		{Webhook: "http://localhost:8888/foo", Status: 200},
+		{Webhook: "http://localhost:9999/foo", Reason: "cut_off"},
+	}, results)
+
+	trackers.untrack(msg)
+	assert.Nil(trackers.get(msg))
+}
+
+func TestDeliveryTrackerTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	tracker := newDeliveryTracker()
+	tracker.matched("http://localhost:8888/foo")
+	tracker.seal()
+
+	results, timedOut := tracker.wait(time.Millisecond)
+	assert.True(timedOut)
+	assert.Equal([]DeliveryResult{{Webhook: "http://localhost:8888/foo", Reason: "timeout"}}, results)
+}
+
+func TestDeliveryTrackerNil(t *testing.T) {
+	var trackers *deliveryTrackers
+	tracker := trackers.get(&wrp.Message{})
+
+	assert.Nil(t, tracker)
+	assert.NotPanics(t, func() {
+		tracker.matched("http://localhost:8888/foo")
+		tracker.delivered("http://localhost:8888/foo", 200)
+		tracker.dropped("http://localhost:8888/foo", "cut_off")
+	})
+}
+
+func TestDeliveryWait(t *testing.T) {
+	tests := []struct {
+		description     string
+		header          string
+		target          string
+		expectedWait    bool
+		expectedTimeout time.Duration
+	}{
+		{
+			description: "Not requested",
+			target:      "/api/v3/notify",
+		},
+		{
+			description:     "Header",
+			header:          "true",
+			target:          "/api/v3/notify",
+			expectedWait:    true,
+			expectedTimeout: 10 * time.Second,
+		},
+		{
+			description:     "Header duration",
+			header:          "2s",
+			target:          "/api/v3/notify",
+			expectedWait:    true,
+			expectedTimeout: 2 * time.Second,
+		},
+		{
+			description:     "Header duration over the max",
+			header:          "2m",
+			target:          "/api/v3/notify",
+			expectedWait:    true,
+			expectedTimeout: 10 * time.Second,
+		},
+		{
+			description:     "Query parameter",
+			target:          "/api/v3/notify?wait=1s",
+			expectedWait:    true,
+			expectedTimeout: time.Second,
+		},
+		{
+			description: "Disabled",
+			header:      "false",
+			target:      "/api/v3/notify",
+		},
+		{
+			description: "Invalid",
+			header:      "soon",
+			target:      "/api/v3/notify",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			req := httptest.NewRequest("POST", tc.target, nil)
+			if "" != tc.header {
+				req.Header.Set(waitForDeliveryHeader, tc.header)
+			}
+
+			wait, timeout := deliveryWait(req, 10*time.Second)
+			assert.Equal(tc.expectedWait, wait)
+			assert.Equal(tc.expectedTimeout, timeout)
+		})
+	}
+}
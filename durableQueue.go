@@ -0,0 +1,508 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+const (
+	// The fsync policies of the durable queues.
+	fsyncAlways   = "always"
+	fsyncInterval = "interval"
+	fsyncNever    = "never"
+
+	defaultSegmentSize   = 64 << 20
+	defaultFsyncInterval = time.Second
+
+	// The kinds of records in the segments.
+	messageRecord byte = 1
+	ackRecord     byte = 2
+
+	// A record is its kind, sequence number, payload length and payload
+	// checksum, followed by the payload.
+	recordHeaderSize = 1 + 8 + 4 + 4
+
+	segmentSuffix = ".log"
+)
+
+var (
+	errLogFull   = errors.New("the durable queue is full")
+	errLogClosed = errors.New("the durable queue is closed")
+)
+
+// DurableQueueConfig configures the durable queues of the webhooks opting in
+// to them.  The messages queued for these webhooks are written to disk until
+// they are delivered or dropped, so the messages pending when caduceus
+// restarts or crashes are delivered once it is back: at least once, rather
+// than at most once.
+type DurableQueueConfig struct {
+	// Directory is where the queues are kept, in a directory per webhook.
+	// Empty disables the durable queues.
+	Directory string
+
+	// SegmentSize is the size in bytes a segment of a queue grows to before
+	// the next one is started.  Segments are removed once all their
+	// messages are acknowledged.
+	// (Optional) defaults to 64MiB.
+	SegmentSize int64
+
+	// MaxBytes is the most bytes a queue takes on disk.  Messages that don't
+	// fit are dropped.
+	// 0 means there is no limit.
+	MaxBytes int64
+
+	// Fsync is when the queued messages are flushed to disk: "always" after
+	// every message, "interval" every FsyncInterval or "never", leaving it
+	// to the operating system.
+	// (Optional) defaults to "interval".
+	Fsync string
+
+	// FsyncInterval is the time between flushes with the "interval" policy.
+	// (Optional) defaults to 1s.
+	FsyncInterval time.Duration
+}
+
+// enabled determines if the webhooks may opt in to durable queues.
+func (c DurableQueueConfig) enabled() bool {
+	return "" != c.Directory
+}
+
+// withDefaults validates the configuration, filling in the defaults.
+func (c DurableQueueConfig) withDefaults() (DurableQueueConfig, error) {
+	if c.SegmentSize < 0 || c.MaxBytes < 0 || c.FsyncInterval < 0 {
+		return c, errors.New("the durable queue sizes and interval must not be negative")
+	}
+	if 0 == c.SegmentSize {
+		c.SegmentSize = defaultSegmentSize
+	}
+	if 0 == c.FsyncInterval {
+		c.FsyncInterval = defaultFsyncInterval
+	}
+
+	switch c.Fsync {
+	case "":
+		c.Fsync = fsyncInterval
+	case fsyncAlways, fsyncInterval, fsyncNever:
+	default:
+		return c, fmt.Errorf("invalid durable queue fsync policy '%s'", c.Fsync)
+	}
+	return c, nil
+}
+
+// messageLog keeps the messages queued for a webhook until they are
+// acknowledged.
+type messageLog interface {
+	// Append records a message before it is queued.  The message must not
+	// be queued if it can't be recorded.
+	Append(*wrp.Message) error
+
+	// Ack records that the message is done with, delivered or dropped.
+	Ack(*wrp.Message)
+
+	// Close closes the log, removing it if no message is pending.
+	Close() error
+
+	// Remove closes the log and removes it with the pending messages.
+	Remove() error
+}
+
+// segment is a file of a segmentLog, named after the first sequence number
+// it may hold.
+type segment struct {
+	name string
+	size int64
+
+	// live is the number of messages of the segment not acknowledged.
+	live int
+}
+
+// segmentFile is the open file of the active segment.
+type segmentFile interface {
+	io.WriteSeeker
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+// segmentLog is a messageLog made of append-only segment files.  The
+// acknowledgements are appended like the messages, and the segments are
+// removed oldest first once all their messages are acknowledged, so an
+// acknowledgement is never removed before the message it is for.
+type segmentLog struct {
+	mutex    sync.Mutex
+	dir      string
+	config   DurableQueueConfig
+	segments []*segment
+	active   segmentFile
+	size     int64
+	nextSeq  uint64
+	dirty    bool
+	closed   bool
+	stop     chan struct{}
+	wg       sync.WaitGroup
+
+	// pending is the segment of each message not acknowledged, by sequence
+	// number.  seqs is the sequence numbers of each message, oldest first,
+	// since a message may be appended again before it is acknowledged.
+	pending map[uint64]*segment
+	seqs    map[*wrp.Message][]uint64
+}
+
+// openSegmentLog opens the log in the directory, returning the messages that
+// were pending in it in the order they were appended.  The config must have
+// its defaults.
+func openSegmentLog(dir string, config DurableQueueConfig) (*segmentLog, []*wrp.Message, error) {
+	if err := os.MkdirAll(dir, 0700); nil != err {
+		return nil, nil, err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if nil != err {
+		return nil, nil, err
+	}
+	// The zero padded names sort in the order the segments were started.
+	sort.Strings(names)
+
+	l := &segmentLog{
+		dir:     dir,
+		config:  config,
+		pending: make(map[uint64]*segment),
+		seqs:    make(map[*wrp.Message][]uint64),
+		stop:    make(chan struct{}),
+	}
+
+	recovered := make(map[uint64]*wrp.Message)
+	var order []uint64
+	for _, name := range names {
+		first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), segmentSuffix), 10, 64)
+		if nil != err {
+			continue
+		}
+		if l.nextSeq <= first {
+			l.nextSeq = first + 1
+		}
+
+		s := &segment{name: name}
+		err = readSegment(name, func(kind byte, seq uint64, payload []byte) {
+			switch kind {
+			case messageRecord:
+				msg := new(wrp.Message)
+				if nil != wrp.NewDecoderBytes(payload, wrp.Msgpack).Decode(msg) {
+					return
+				}
+				recovered[seq] = msg
+				order = append(order, seq)
+				l.pending[seq] = s
+				l.seqs[msg] = []uint64{seq}
+				s.live++
+				if l.nextSeq <= seq {
+					l.nextSeq = seq + 1
+				}
+			case ackRecord:
+				if msg, ok := recovered[seq]; ok {
+					l.pending[seq].live--
+					delete(l.pending, seq)
+					delete(l.seqs, msg)
+					delete(recovered, seq)
+				}
+			}
+		}, &s.size)
+		if nil != err {
+			return nil, nil, err
+		}
+
+		l.segments = append(l.segments, s)
+		l.size += s.size
+	}
+
+	if err = l.rotate(); nil != err {
+		return nil, nil, err
+	}
+
+	msgs := make([]*wrp.Message, 0, len(recovered))
+	for _, seq := range order {
+		if msg, ok := recovered[seq]; ok {
+			msgs = append(msgs, msg)
+		}
+	}
+
+	if fsyncInterval == config.Fsync {
+		l.wg.Add(1)
+		go l.syncLoop()
+	}
+	return l, msgs, nil
+}
+
+// readSegment calls fn with the records of the segment, setting size to the
+// end of the last complete one.  A record torn by a crash, and whatever
+// follows it, is cut off.
+func readSegment(name string, fn func(byte, uint64, []byte), size *int64) error {
+	f, err := os.OpenFile(name, os.O_RDWR, 0600)
+	if nil != err {
+		return err
+	}
+	defer f.Close()
+
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err = io.ReadFull(f, header); nil != err {
+			break
+		}
+		payload := make([]byte, binary.BigEndian.Uint32(header[9:]))
+		if _, err = io.ReadFull(f, payload); nil != err {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[13:]) {
+			break
+		}
+		fn(header[0], binary.BigEndian.Uint64(header[1:]), payload)
+		*size += int64(len(header) + len(payload))
+	}
+
+	if info, err := f.Stat(); nil == err && *size < info.Size() {
+		return f.Truncate(*size)
+	}
+	return nil
+}
+
+// rotate starts a new segment and removes the old ones no longer needed.
+// The mutex must be held.
+func (l *segmentLog) rotate() error {
+	if nil != l.active {
+		if fsyncNever != l.config.Fsync {
+			l.active.Sync()
+		}
+		l.active.Close()
+	}
+
+	name := filepath.Join(l.dir, fmt.Sprintf("%020d%s", l.nextSeq, segmentSuffix))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if nil != err {
+		l.active = nil
+		return err
+	}
+	l.active = f
+	l.segments = append(l.segments, &segment{name: name})
+	l.trim()
+	return nil
+}
+
+// trim removes the oldest segments as long as all their messages are
+// acknowledged, never the active one.  The mutex must be held.
+func (l *segmentLog) trim() {
+	for 1 < len(l.segments) && 0 == l.segments[0].live {
+		os.Remove(l.segments[0].name)
+		l.size -= l.segments[0].size
+		l.segments = l.segments[1:]
+	}
+}
+
+// write appends a record to the active segment.  The mutex must be held.
+func (l *segmentLog) write(kind byte, seq uint64, payload []byte) (*segment, error) {
+	if nil == l.active {
+		return nil, errLogClosed
+	}
+	s := l.segments[len(l.segments)-1]
+	if l.config.SegmentSize <= s.size {
+		if err := l.rotate(); nil != err {
+			return nil, err
+		}
+		s = l.segments[len(l.segments)-1]
+	}
+
+	record := make([]byte, recordHeaderSize+len(payload))
+	record[0] = kind
+	binary.BigEndian.PutUint64(record[1:], seq)
+	binary.BigEndian.PutUint32(record[9:], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[13:], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+
+	n, err := l.active.Write(record)
+	if nil != err {
+		// A torn record hides the ones appended after it when the segment
+		// is recovered, so it is cut off, or the segment given up for a new
+		// one if it can't be.
+		if 0 < n && !l.cutOff(s) {
+			s.size += int64(n)
+			l.size += int64(n)
+			l.rotate()
+		}
+		return s, err
+	}
+	s.size += int64(n)
+	l.size += int64(n)
+	l.dirty = true
+	return s, nil
+}
+
+// cutOff truncates the active segment back to the end of its last complete
+// record, reporting whether it could.  The mutex must be held.
+func (l *segmentLog) cutOff(s *segment) bool {
+	if nil != l.active.Truncate(s.size) {
+		return false
+	}
+	_, err := l.active.Seek(s.size, io.SeekStart)
+	return nil == err
+}
+
+func (l *segmentLog) Append(msg *wrp.Message) error {
+	var payload []byte
+	if err := wrp.NewEncoderBytes(&payload, wrp.Msgpack).Encode(msg); nil != err {
+		return err
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return errLogClosed
+	}
+	if 0 < l.config.MaxBytes && l.config.MaxBytes < l.size+int64(recordHeaderSize+len(payload)) {
+		return errLogFull
+	}
+
+	seq := l.nextSeq
+	l.nextSeq++
+	s, err := l.write(messageRecord, seq, payload)
+	if nil != err {
+		return err
+	}
+	s.live++
+	l.pending[seq] = s
+	l.seqs[msg] = append(l.seqs[msg], seq)
+
+	if fsyncAlways == l.config.Fsync {
+		if err = l.active.Sync(); nil != err {
+			// The message isn't queued, so its record is acknowledged
+			// right away rather than keeping its segment from being
+			// trimmed.
+			seqs := l.seqs[msg]
+			l.popSeq(msg, len(seqs)-1)
+			l.ack(seq)
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *segmentLog) Ack(msg *wrp.Message) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if 0 == len(l.seqs[msg]) || l.closed {
+		return
+	}
+	l.ack(l.popSeq(msg, 0))
+}
+
+// popSeq removes the i-th sequence number recorded for the message and
+// returns it.  The mutex must be held.
+func (l *segmentLog) popSeq(msg *wrp.Message, i int) uint64 {
+	seqs := l.seqs[msg]
+	seq := seqs[i]
+	if 1 == len(seqs) {
+		delete(l.seqs, msg)
+	} else {
+		l.seqs[msg] = append(seqs[:i:i], seqs[i+1:]...)
+	}
+	return seq
+}
+
+// ack writes the acknowledgement of the record and trims the segments no
+// longer needed.  The mutex must be held.
+func (l *segmentLog) ack(seq uint64) {
+	s := l.pending[seq]
+	delete(l.pending, seq)
+
+	// A lost acknowledgement only means the message is delivered again, so
+	// it isn't flushed right away.
+	l.write(ackRecord, seq, nil)
+	s.live--
+	l.trim()
+}
+
+// syncLoop flushes the active segment every FsyncInterval.
+func (l *segmentLog) syncLoop() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(l.config.FsyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			l.mutex.Lock()
+			if l.dirty && nil != l.active {
+				l.active.Sync()
+				l.dirty = false
+			}
+			l.mutex.Unlock()
+		}
+	}
+}
+
+func (l *segmentLog) close(remove bool) error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.stop)
+	l.mutex.Unlock()
+	l.wg.Wait()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var err error
+	if nil != l.active {
+		if fsyncNever != l.config.Fsync {
+			err = l.active.Sync()
+		}
+		if closeErr := l.active.Close(); nil == err {
+			err = closeErr
+		}
+		l.active = nil
+	}
+
+	if remove || 0 == len(l.pending) {
+		return os.RemoveAll(l.dir)
+	}
+	return err
+}
+
+func (l *segmentLog) Close() error {
+	return l.close(false)
+}
+
+func (l *segmentLog) Remove() error {
+	return l.close(true)
+}
@@ -0,0 +1,304 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func TestDurableQueueConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := DurableQueueConfig{}.withDefaults()
+	assert.Nil(err)
+	assert.False(c.enabled())
+	assert.Equal(int64(defaultSegmentSize), c.SegmentSize)
+	assert.Equal(fsyncInterval, c.Fsync)
+	assert.Equal(defaultFsyncInterval, c.FsyncInterval)
+
+	_, err = DurableQueueConfig{Fsync: "sometimes"}.withDefaults()
+	assert.NotNil(err)
+
+	_, err = DurableQueueConfig{MaxBytes: -1}.withDefaults()
+	assert.NotNil(err)
+}
+
+func testLogConfig(t *testing.T, c DurableQueueConfig) (string, DurableQueueConfig) {
+	dir, err := ioutil.TempDir("", "durable")
+	require.Nil(t, err)
+	c, err = c.withDefaults()
+	require.Nil(t, err)
+	return dir, c
+}
+
+func testMessages(count int) []*wrp.Message {
+	msgs := make([]*wrp.Message, count)
+	for i := range msgs {
+		msgs[i] = simpleRequest()
+		msgs[i].TransactionUUID = string(rune('a' + i))
+	}
+	return msgs
+}
+
+func transactionUUIDs(msgs []*wrp.Message) []string {
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.TransactionUUID
+	}
+	return ids
+}
+
+func TestSegmentLogRecovery(t *testing.T) {
+	for _, fsync := range []string{fsyncAlways, fsyncInterval, fsyncNever} {
+		t.Run(fsync, func(t *testing.T) {
+			assert := assert.New(t)
+			dir, config := testLogConfig(t, DurableQueueConfig{Fsync: fsync})
+			defer os.RemoveAll(dir)
+
+			l, recovered, err := openSegmentLog(dir, config)
+			require.Nil(t, err)
+			assert.Empty(recovered)
+
+			msgs := testMessages(3)
+			for _, msg := range msgs {
+				assert.Nil(l.Append(msg))
+			}
+			l.Ack(msgs[1])
+			assert.Nil(l.Close())
+
+			l, recovered, err = openSegmentLog(dir, config)
+			require.Nil(t, err)
+			assert.Equal([]string{"a", "c"}, transactionUUIDs(recovered))
+
+			// Once everything is acknowledged the log is removed on close.
+			for _, msg := range recovered {
+				l.Ack(msg)
+			}
+			assert.Nil(l.Close())
+			_, err = os.Stat(dir)
+			assert.True(os.IsNotExist(err))
+		})
+	}
+}
+
+// A message appended twice is pending until it is acknowledged twice.
+func TestSegmentLogAppendedTwice(t *testing.T) {
+	assert := assert.New(t)
+	dir, config := testLogConfig(t, DurableQueueConfig{})
+	defer os.RemoveAll(dir)
+
+	l, _, err := openSegmentLog(dir, config)
+	require.Nil(t, err)
+	msg := testMessages(1)[0]
+	assert.Nil(l.Append(msg))
+	assert.Nil(l.Append(msg))
+	l.Ack(msg)
+	assert.Nil(l.Close())
+
+	l, recovered, err := openSegmentLog(dir, config)
+	require.Nil(t, err)
+	assert.Equal([]string{"a"}, transactionUUIDs(recovered))
+
+	for _, msg := range recovered {
+		l.Ack(msg)
+	}
+	assert.Nil(l.Close())
+	_, err = os.Stat(dir)
+	assert.True(os.IsNotExist(err))
+}
+
+// The messages are recovered even when the log wasn't closed, and a record
+// torn by the crash is cut off.
+func TestSegmentLogCrash(t *testing.T) {
+	assert := assert.New(t)
+	dir, config := testLogConfig(t, DurableQueueConfig{Fsync: fsyncNever})
+	defer os.RemoveAll(dir)
+
+	l, _, err := openSegmentLog(dir, config)
+	require.Nil(t, err)
+	for _, msg := range testMessages(2) {
+		assert.Nil(l.Append(msg))
+	}
+
+	f, err := os.OpenFile(l.segments[len(l.segments)-1].name, os.O_APPEND|os.O_WRONLY, 0600)
+	require.Nil(t, err)
+	f.Write([]byte{messageRecord, 0, 0, 0})
+	f.Close()
+
+	l2, recovered, err := openSegmentLog(dir, config)
+	require.Nil(t, err)
+	assert.Equal([]string{"a", "b"}, transactionUUIDs(recovered))
+
+	l.Remove()
+	l2.Remove()
+}
+
+func TestSegmentLogSegments(t *testing.T) {
+	assert := assert.New(t)
+	dir, config := testLogConfig(t, DurableQueueConfig{SegmentSize: 1})
+	defer os.RemoveAll(dir)
+
+	l, _, err := openSegmentLog(dir, config)
+	require.Nil(t, err)
+
+	// Every message starts a segment of its own.
+	msgs := testMessages(3)
+	for _, msg := range msgs {
+		assert.Nil(l.Append(msg))
+	}
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	assert.Equal(3, len(names))
+
+	// Segments are only removed oldest first.
+	l.Ack(msgs[1])
+	names, _ = filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	assert.Equal(3, len(names))
+
+	l.Ack(msgs[0])
+	names, _ = filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	assert.Equal(1, len(names))
+
+	assert.Nil(l.Close())
+
+	_, recovered, err := openSegmentLog(dir, config)
+	require.Nil(t, err)
+	assert.Equal([]string{"c"}, transactionUUIDs(recovered))
+}
+
+func TestSegmentLogFull(t *testing.T) {
+	assert := assert.New(t)
+
+	// Only the first message fits.
+	msg := simpleRequest()
+	var encoded []byte
+	require.Nil(t, wrp.NewEncoderBytes(&encoded, wrp.Msgpack).Encode(msg))
+	maxBytes := int64(recordHeaderSize + len(encoded) + 10)
+
+	dir, config := testLogConfig(t, DurableQueueConfig{MaxBytes: maxBytes, FsyncInterval: time.Millisecond})
+	defer os.RemoveAll(dir)
+
+	l, _, err := openSegmentLog(dir, config)
+	require.Nil(t, err)
+
+	assert.Nil(l.Append(msg))
+	assert.Equal(errLogFull, l.Append(simpleRequest()))
+
+	// The space of acknowledged messages is only given back with their
+	// segment.
+	l.Ack(msg)
+	assert.Equal(errLogFull, l.Append(simpleRequest()))
+
+	assert.Nil(l.Remove())
+	assert.Equal(errLogClosed, l.Append(simpleRequest()))
+}
+
+// failingSync is a segment file whose writes can't be flushed.
+type failingSync struct {
+	segmentFile
+}
+
+func (f failingSync) Sync() error {
+	return errors.New("no space left on device")
+}
+
+// A message that couldn't be flushed isn't queued, so it is acknowledged
+// right away and doesn't keep its segment from being removed.
+func TestSegmentLogSyncFailure(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, config := testLogConfig(t, DurableQueueConfig{Fsync: fsyncAlways})
+	defer os.RemoveAll(dir)
+
+	l, _, err := openSegmentLog(dir, config)
+	require.Nil(t, err)
+
+	l.active = failingSync{l.active}
+	msg := simpleRequest()
+	assert.NotNil(l.Append(msg))
+	assert.Empty(l.pending)
+	assert.Empty(l.seqs)
+	assert.Equal(0, l.segments[0].live)
+
+	l.active = l.active.(failingSync).segmentFile
+	assert.Nil(l.Append(msg))
+	l.Ack(msg)
+	assert.Nil(l.Close())
+
+	_, msgs, err := openSegmentLog(dir, config)
+	require.Nil(t, err)
+	assert.Empty(msgs)
+}
+
+// tornWrite is a segment file that only writes half of a record, and can't
+// be truncated if told so.
+type tornWrite struct {
+	segmentFile
+	failTruncate bool
+}
+
+func (f tornWrite) Write(p []byte) (int, error) {
+	n, _ := f.segmentFile.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func (f tornWrite) Truncate(size int64) error {
+	if f.failTruncate {
+		return errors.New("read-only file system")
+	}
+	return f.segmentFile.Truncate(size)
+}
+
+// A record torn by a failed write doesn't cost the messages appended after
+// it when the log is recovered.
+func TestSegmentLogTornWrite(t *testing.T) {
+	for description, failTruncate := range map[string]bool{"Cut Off": false, "Rotated": true} {
+		failTruncate := failTruncate
+		t.Run(description, func(t *testing.T) {
+			assert := assert.New(t)
+			dir, config := testLogConfig(t, DurableQueueConfig{Fsync: fsyncNever})
+			defer os.RemoveAll(dir)
+
+			l, _, err := openSegmentLog(dir, config)
+			require.Nil(t, err)
+
+			msgs := testMessages(3)
+			assert.Nil(l.Append(msgs[0]))
+
+			active := l.active
+			l.active = tornWrite{segmentFile: active, failTruncate: failTruncate}
+			assert.NotNil(l.Append(msgs[1]))
+			if !failTruncate {
+				l.active = active
+			}
+			assert.Nil(l.Append(msgs[2]))
+			assert.Nil(l.Close())
+
+			_, recovered, err := openSegmentLog(dir, config)
+			require.Nil(t, err)
+			assert.Equal([]string{"a", "c"}, transactionUUIDs(recovered))
+		})
+	}
+}
@@ -0,0 +1,189 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"regexp"
+	"regexp/syntax"
+)
+
+// eventIndex finds the senders with an event regular expression matching an
+// event without evaluating the expressions of every sender.  Each distinct
+// expression is compiled and evaluated once no matter how many senders share
+// it.  Expressions that are plain literals are found by looking up the
+// substrings of the event with the length of a literal, and expressions
+// anchored to a literal prefix are only evaluated for the events starting
+// with it, found by looking up the prefixes of the event.  So the cost of
+// matching an event depends on the length of the event and the expressions
+// that may match it rather than on the number of senders.
+//
+// The index may only report more senders than really match, never fewer, so
+// the senders still check the message themselves.
+type eventIndex struct {
+	// all are the senders with an expression matching every event.
+	all []string
+
+	// literals are the senders by the literal their expression searches for.
+	literals map[string][]string
+
+	// literalLengths are the distinct lengths of the literals.
+	literalLengths []int
+
+	// prefixes are the expressions by the literal prefix they are anchored
+	// to.
+	prefixes map[string][]*indexedPattern
+
+	// others are the expressions evaluated for every event.
+	others []*indexedPattern
+}
+
+// indexedPattern is a distinct expression and the senders sharing it.
+type indexedPattern struct {
+	re  *regexp.Regexp
+	ids []string
+}
+
+// newEventIndex indexes the event expressions of each sender, by sender id.
+// Expressions that don't compile are left out since the senders reject them
+// too.
+func newEventIndex(events map[string][]string) *eventIndex {
+	byPattern := make(map[string][]string)
+	for id, patterns := range events {
+		for _, pattern := range patterns {
+			ids := byPattern[pattern]
+			if 0 < len(ids) && ids[len(ids)-1] == id {
+				continue
+			}
+			byPattern[pattern] = append(ids, id)
+		}
+	}
+
+	idx := &eventIndex{
+		literals: make(map[string][]string),
+		prefixes: make(map[string][]*indexedPattern),
+	}
+	lengths := make(map[int]bool)
+	for pattern, ids := range byPattern {
+		re, err := regexp.Compile(pattern)
+		if nil != err {
+			continue
+		}
+		tree, err := syntax.Parse(pattern, syntax.Perl)
+		if nil != err {
+			continue
+		}
+		tree = tree.Simplify()
+
+		switch {
+		case !hasAnchor(tree) && re.MatchString(""):
+			// Unanchored expressions matching an empty string match
+			// every event.
+			idx.all = append(idx.all, ids...)
+		case isLiteral(tree):
+			literal := string(tree.Rune)
+			idx.literals[literal] = append(idx.literals[literal], ids...)
+			if !lengths[len(literal)] {
+				lengths[len(literal)] = true
+				idx.literalLengths = append(idx.literalLengths, len(literal))
+			}
+		default:
+			p := &indexedPattern{re: re, ids: ids}
+			if prefix, ok := anchoredPrefix(tree); ok {
+				idx.prefixes[prefix] = append(idx.prefixes[prefix], p)
+			} else {
+				idx.others = append(idx.others, p)
+			}
+		}
+	}
+
+	return idx
+}
+
+// match calls fn once with the id of every sender that may match the event.
+func (idx *eventIndex) match(event string, fn func(id string)) {
+	if nil == idx {
+		return
+	}
+
+	var seen map[string]struct{}
+	visit := func(ids []string) {
+		if nil == seen {
+			seen = make(map[string]struct{}, len(ids))
+		}
+		for _, id := range ids {
+			if _, ok := seen[id]; !ok {
+				seen[id] = struct{}{}
+				fn(id)
+			}
+		}
+	}
+
+	visit(idx.all)
+
+	for _, length := range idx.literalLengths {
+		for i := 0; i+length <= len(event); i++ {
+			if ids, ok := idx.literals[event[i:i+length]]; ok {
+				visit(ids)
+			}
+		}
+	}
+
+	if 0 < len(idx.prefixes) {
+		for i := 0; i <= len(event); i++ {
+			for _, p := range idx.prefixes[event[:i]] {
+				if p.re.MatchString(event) {
+					visit(p.ids)
+				}
+			}
+		}
+	}
+
+	for _, p := range idx.others {
+		if p.re.MatchString(event) {
+			visit(p.ids)
+		}
+	}
+}
+
+func hasAnchor(tree *syntax.Regexp) bool {
+	switch tree.Op {
+	case syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText,
+		syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return true
+	}
+	for _, sub := range tree.Sub {
+		if hasAnchor(sub) {
+			return true
+		}
+	}
+	return false
+}
+
+func isLiteral(tree *syntax.Regexp) bool {
+	return syntax.OpLiteral == tree.Op && 0 == tree.Flags&syntax.FoldCase
+}
+
+// anchoredPrefix determines the literal every event matched by the
+// expression starts with, if the expression is anchored to one.
+func anchoredPrefix(tree *syntax.Regexp) (string, bool) {
+	if syntax.OpConcat != tree.Op || len(tree.Sub) < 2 ||
+		syntax.OpBeginText != tree.Sub[0].Op || !isLiteral(tree.Sub[1]) {
+		return "", false
+	}
+
+	return string(tree.Sub[1].Rune), true
+}
@@ -0,0 +1,164 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// linearMatch is how senders were found before the index: every expression of
+// every sender is evaluated.
+func linearMatch(compiled map[string][]*regexp.Regexp, event string, fn func(id string)) {
+	for id, res := range compiled {
+		for _, re := range res {
+			if re.MatchString(event) {
+				fn(id)
+				break
+			}
+		}
+	}
+}
+
+func compileEvents(events map[string][]string) map[string][]*regexp.Regexp {
+	compiled := make(map[string][]*regexp.Regexp, len(events))
+	for id, patterns := range events {
+		for _, pattern := range patterns {
+			if re, err := regexp.Compile(pattern); nil == err {
+				compiled[id] = append(compiled[id], re)
+			}
+		}
+	}
+	return compiled
+}
+
+func collect(match func(string, func(string)), event string) []string {
+	ids := []string{}
+	match(event, func(id string) { ids = append(ids, id) })
+	sort.Strings(ids)
+	return ids
+}
+
+func TestEventIndexClassification(t *testing.T) {
+	assert := assert.New(t)
+
+	idx := newEventIndex(map[string][]string{
+		"all":     {".*"},
+		"empty":   {""},
+		"literal": {"iot", "iot"},
+		"prefix":  {"^device-status/.*/online$"},
+		"exact":   {"^iot$"},
+		"other":   {"(?i)IOT", "online$"},
+		"invalid": {"[iot"},
+	})
+
+	assert.ElementsMatch([]string{"all", "empty"}, idx.all)
+	assert.Equal(map[string][]string{"iot": {"literal"}}, idx.literals)
+	assert.Equal([]int{3}, idx.literalLengths)
+	assert.Equal(1, len(idx.prefixes["device-status/"]))
+	assert.Equal(1, len(idx.prefixes["iot"]))
+	assert.Equal(2, len(idx.others))
+}
+
+func TestEventIndexMatch(t *testing.T) {
+	events := map[string][]string{
+		"all":       {".*"},
+		"literal":   {"iot"},
+		"shared1":   {"^device-status/.*/online$"},
+		"shared2":   {"^device-status/.*/online$", "iot"},
+		"exact":     {"^iot$"},
+		"fold":      {"(?i)^IOT"},
+		"suffix":    {"offline$"},
+		"alternate": {"^(iot|node-change)/"},
+		"prefix":    {"^node-change/mac:"},
+		"longer":    {"not-iot"},
+		"anchored":  {"^$"},
+		"invalid":   {"[iot"},
+	}
+	tests := []string{
+		"iot",
+		"iot/extra",
+		"IOT",
+		"device-status/mac:112233445566/online",
+		"device-status/mac:112233445566/offline",
+		"node-change/mac:112233445566",
+		"not-iot-at-all",
+		"",
+	}
+
+	idx := newEventIndex(events)
+	compiled := compileEvents(events)
+
+	for _, event := range tests {
+		t.Run(fmt.Sprintf("'%s'", event), func(t *testing.T) {
+			expected := collect(func(e string, fn func(string)) { linearMatch(compiled, e, fn) }, event)
+			assert.Equal(t, expected, collect(idx.match, event))
+		})
+	}
+
+	var nilIndex *eventIndex
+	assert.Empty(t, collect(nilIndex.match, "iot"))
+}
+
+// benchmarkEvents builds webhooks registered the way consumers usually do:
+// mostly for the events of specific devices, and a few for everything of a
+// kind.
+func benchmarkEvents(count int) map[string][]string {
+	events := make(map[string][]string, count)
+	for i := 0; i < count; i++ {
+		id := fmt.Sprintf("http://localhost/%d", i)
+		switch i % 4 {
+		case 0:
+			events[id] = []string{fmt.Sprintf("^device-status/mac:%012x/.*", i)}
+		case 1:
+			events[id] = []string{fmt.Sprintf("^node-change/mac:%012x$", i)}
+		case 2:
+			events[id] = []string{fmt.Sprintf("mac:%012x/online", i)}
+		case 3:
+			events[id] = []string{fmt.Sprintf("^iot-%d$", i%100), "^device-status/.*/offline$"}
+		}
+	}
+	return events
+}
+
+func BenchmarkEventMatching(b *testing.B) {
+	event := fmt.Sprintf("device-status/mac:%012x/online", 4)
+
+	for _, count := range []int{100, 1000, 10000} {
+		events := benchmarkEvents(count)
+
+		b.Run(fmt.Sprintf("Linear/%d", count), func(b *testing.B) {
+			compiled := compileEvents(events)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				linearMatch(compiled, event, func(string) {})
+			}
+		})
+
+		b.Run(fmt.Sprintf("Indexed/%d", count), func(b *testing.B) {
+			idx := newEventIndex(events)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				idx.match(event, func(string) {})
+			}
+		})
+	}
+}
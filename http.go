@@ -17,18 +17,67 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
 	"github.com/go-kit/kit/metrics"
-	uuid "github.com/satori/go.uuid"
 	"github.com/xmidt-org/webpa-common/logging"
 	"github.com/xmidt-org/wrp-go/v3"
 )
 
+// retryAfterSeconds is the Retry-After header sent along with a 503.
+const retryAfterSeconds = "1"
+
+var errUnsupportedContentType = errors.New("unsupported content type")
+
+// The reasons a message can't be queued for the caduceusHandler.
+var (
+	errQueueFull        = errors.New("queue full")
+	errIngestionStopped = errors.New("shutting down")
+)
+
+// wrpFormats maps the supported request content types to the WRP format used
+// to decode the request body.
+var wrpFormats = map[string]wrp.Format{
+	wrp.MimeTypeMsgpack:       wrp.Msgpack,
+	wrp.MimeTypeWrp:           wrp.Msgpack,
+	"application/wrp+msgpack": wrp.Msgpack,
+	wrp.MimeTypeJson:          wrp.JSON,
+	"application/wrp+json":    wrp.JSON,
+}
+
+// contentTypeFormat determines the WRP format of a request based on its
+// Content-Type header.  Exactly one Content-Type must be specified.
+func contentTypeFormat(header http.Header) (wrp.Format, error) {
+	values := header.Values("Content-Type")
+	if len(values) != 1 {
+		return wrp.Msgpack, errUnsupportedContentType
+	}
+
+	mediaType, _, err := mime.ParseMediaType(values[0])
+	if err != nil {
+		return wrp.Msgpack, errUnsupportedContentType
+	}
+
+	format, ok := wrpFormats[strings.ToLower(mediaType)]
+	if !ok {
+		return wrp.Msgpack, errUnsupportedContentType
+	}
+
+	return format, nil
+}
+
 // Below is the struct that will implement our ServeHTTP method
 type ServerHandler struct {
 	log.Logger
@@ -40,6 +89,32 @@ type ServerHandler struct {
 	modifiedWRPCount         metrics.Counter
 	incomingQueueDepth       int64
 	maxOutstanding           int64
+	maxPayloadSize           int64
+	tooLargeRequests         metrics.Counter
+	deliveryTrackers         *deliveryTrackers
+	maxDeliveryWait          time.Duration
+	validator                *wrpValidator
+	normalizers              *wrpNormalizers
+	dedupe                   *dedupeCache
+	duplicateCount           metrics.Counter
+	ingestQueue              chan *wrp.Message
+	ingestWG                 sync.WaitGroup
+	ingestMutex              sync.RWMutex
+	ingestStopped            bool
+	matcher                  webhookMatcher
+	queueBudget              *queueBudget
+	isolation                PartnerIsolationConfig
+}
+
+// webhookMatcher explains which webhooks a message would be delivered to.
+type webhookMatcher interface {
+	Match(*wrp.Message) []MatchResult
+}
+
+// MatchReport is the response body of the match endpoint.
+type MatchReport struct {
+	TransactionUUID string        `json:"transaction_uuid"`
+	Webhooks        []MatchResult `json:"webhooks"`
 }
 
 func (sh *ServerHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
@@ -49,33 +124,171 @@ func (sh *ServerHandler) ServeHTTP(response http.ResponseWriter, request *http.R
 	}
 	debugLog := level.Debug(logger)
 	infoLog := level.Info(logger)
-	errorLog := level.Error(logger)
 
 	messageKey := logging.MessageKey()
-	errorKey := logging.ErrorKey()
 
 	infoLog.Log(messageKey, "Receiving incoming request...")
 
+	format, payload, release, ok := sh.admit(response, request, logger)
+	if !ok {
+		return
+	}
+	defer release()
+
+	decoder := wrp.NewDecoderBytes(payload, format)
+	msg := new(wrp.Message)
+	if err := decoder.Decode(msg); err != nil {
+		// return a 400
+		sh.invalidCount.With("reason", invalidEncodingReason).Add(1.0)
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write([]byte("Invalid payload format.\n"))
+		debugLog.Log(messageKey, "Invalid payload format.\n")
+		return
+	}
+
+	if status, message, ok := sh.screen(msg, logger); !ok {
+		response.WriteHeader(status)
+		response.Write([]byte(message + "\n"))
+		return
+	}
+
+	msg = sh.normalizeWrp(msg)
+
+	wait, timeout := deliveryWait(request, sh.maxDeliveryWait)
+	var tracker *deliveryTracker
+	if wait && nil != sh.deliveryTrackers {
+		// tracked before it is handled so no delivery is missed
+		tracker = sh.deliveryTrackers.track(msg)
+		defer sh.deliveryTrackers.untrack(msg)
+	}
+
+	if err := sh.handle(msg); nil != err {
+		// return a 503
+		response.Header().Set("Retry-After", retryAfterSeconds)
+		response.WriteHeader(http.StatusServiceUnavailable)
+		response.Write([]byte(fmt.Sprintf("Unavailable: %s.\n", err)))
+		debugLog.Log(messageKey, "Unable to queue the request.", logging.ErrorKey(), err)
+		return
+	}
+
+	if nil != tracker {
+		sh.reportDelivery(response, logger, msg, tracker, timeout)
+		return
+	}
+
+	// return a 202
+	response.WriteHeader(http.StatusAccepted)
+	response.Write([]byte("Request placed on to queue.\n"))
+	debugLog.Log(messageKey, "Request placed on to queue.")
+}
+
+// admit decides whether a notify request is served, checking its content
+// type, the requests outstanding, the queue budget and the size of its body.
+// When it isn't the response is written and false is returned, otherwise
+// release must be called once the request is served.
+func (sh *ServerHandler) admit(response http.ResponseWriter, request *http.Request, logger log.Logger) (format wrp.Format, payload []byte, release func(), ok bool) {
+	debugLog := level.Debug(logger)
+	messageKey := logging.MessageKey()
+
+	format, err := contentTypeFormat(request.Header)
+	if err != nil {
+		response.WriteHeader(http.StatusUnsupportedMediaType)
+		response.Write([]byte("Unsupported Content-Type.\n"))
+		debugLog.Log(messageKey, "Unsupported Content-Type.", "contentType", request.Header.Values("Content-Type"))
+		return format, nil, nil, false
+	}
+
 	outstanding := atomic.AddInt64(&sh.incomingQueueDepth, 1)
-	defer atomic.AddInt64(&sh.incomingQueueDepth, -1)
+	release = func() {
+		atomic.AddInt64(&sh.incomingQueueDepth, -1)
+	}
 
 	if 0 < sh.maxOutstanding && sh.maxOutstanding < outstanding {
+		release()
 		// return a 503
+		response.Header().Set("Retry-After", retryAfterSeconds)
 		response.WriteHeader(http.StatusServiceUnavailable)
 		response.Write([]byte("Request placed on to queue.\n"))
 		debugLog.Log(messageKey, "Request placed on to queue.\n")
-		return
+		return format, nil, nil, false
 	}
 
-	sh.incomingQueueDepthMetric.Add(1.0)
-	defer sh.incomingQueueDepthMetric.Add(-1.0)
+	if sh.queueBudget.reject() {
+		release()
+		// the senders are behind, so let the client back off
+		response.Header().Set("Retry-After", retryAfterSeconds)
+		response.WriteHeader(sh.queueBudget.statusCode)
+		response.Write([]byte("Too many messages queued.\n"))
+		debugLog.Log(messageKey, "Too many messages queued.")
+		return format, nil, nil, false
+	}
+
+	if payload, ok = sh.readPayload(response, request, logger); !ok {
+		release()
+		return format, nil, nil, false
+	}
+
+	return format, payload, release, true
+}
 
-	payload, err := ioutil.ReadAll(request.Body)
+// screen validates a decoded message and checks whether it repeats one
+// already handled.  Unless the message is to be handled, the status and the
+// message reported for it are returned along with false.
+func (sh *ServerHandler) screen(msg *wrp.Message, logger log.Logger) (int, string, bool) {
+	debugLog := level.Debug(logger)
+	messageKey := logging.MessageKey()
+
+	if reason, err := sh.validator.validate(msg, logger); err != nil {
+		sh.invalidCount.With("reason", reason).Add(1.0)
+		debugLog.Log(messageKey, "Invalid WRP message.", "reason", reason, logging.ErrorKey(), err)
+		return http.StatusBadRequest, fmt.Sprintf("Invalid WRP message: %s.", err), false
+	}
+
+	if sh.isDuplicate(msg) {
+		// a 202 since the original message was accepted
+		debugLog.Log(messageKey, "Duplicate message ignored.", "transactionUUID", msg.TransactionUUID)
+		return http.StatusAccepted, "Duplicate message ignored.", false
+	}
+
+	return 0, "", true
+}
+
+// readPayload reads the request body, enforcing the maximum payload size.
+// When the body can't be used the response is written and false is returned.
+func (sh *ServerHandler) readPayload(response http.ResponseWriter, request *http.Request, logger log.Logger) ([]byte, bool) {
+	errorLog := level.Error(logger)
+	messageKey := logging.MessageKey()
+	errorKey := logging.ErrorKey()
+
+	if 0 < sh.maxPayloadSize && sh.maxPayloadSize < request.ContentLength {
+		sh.tooLargeRequests.Add(1.0)
+		errorLog.Log(messageKey, "Payload too large.", "contentLength", request.ContentLength)
+		response.WriteHeader(http.StatusRequestEntityTooLarge)
+		response.Write([]byte("Payload too large.\n"))
+		return nil, false
+	}
+
+	var body io.Reader = request.Body
+	if 0 < sh.maxPayloadSize {
+		// Read one byte more than allowed so bodies without a Content-Length
+		// that exceed the limit can be detected.
+		body = io.LimitReader(request.Body, sh.maxPayloadSize+1)
+	}
+
+	payload, err := ioutil.ReadAll(body)
 	if err != nil {
 		sh.errorRequests.Add(1.0)
 		errorLog.Log(messageKey, "Unable to retrieve the request body.", errorKey, err.Error)
 		response.WriteHeader(http.StatusBadRequest)
-		return
+		return nil, false
+	}
+
+	if 0 < sh.maxPayloadSize && sh.maxPayloadSize < int64(len(payload)) {
+		sh.tooLargeRequests.Add(1.0)
+		errorLog.Log(messageKey, "Payload too large.")
+		response.WriteHeader(http.StatusRequestEntityTooLarge)
+		response.Write([]byte("Payload too large.\n"))
+		return nil, false
 	}
 
 	if len(payload) == 0 {
@@ -83,50 +296,359 @@ func (sh *ServerHandler) ServeHTTP(response http.ResponseWriter, request *http.R
 		errorLog.Log(messageKey, "Empty payload.", errorKey)
 		response.WriteHeader(http.StatusBadRequest)
 		response.Write([]byte("Empty payload.\n"))
+		return nil, false
+	}
+
+	return payload, true
+}
+
+// reportDelivery blocks until every webhook the handled message matched
+// reported the outcome of its delivery, or until the timeout passes.  The
+// outcome for each webhook is returned to the caller.
+func (sh *ServerHandler) reportDelivery(response http.ResponseWriter, logger log.Logger, msg *wrp.Message, tracker *deliveryTracker, timeout time.Duration) {
+	results, timedOut := tracker.wait(timeout)
+	body, err := json.Marshal(DeliveryReport{
+		TransactionUUID: msg.TransactionUUID,
+		TimedOut:        timedOut,
+		Webhooks:        results,
+	})
+	if err != nil {
+		level.Error(logger).Log(logging.MessageKey(), "Unable to marshal the delivery report.", logging.ErrorKey(), err)
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response.Header().Set("Content-Type", wrp.MimeTypeJson)
+	response.WriteHeader(http.StatusOK)
+	response.Write(body)
+	level.Debug(logger).Log(logging.MessageKey(), "Request delivered.", "webhooks", len(results), "timedOut", timedOut)
+}
+
+// ServeMatch reports which webhooks the message in the request would be
+// delivered to, and why, without delivering it.
+func (sh *ServerHandler) ServeMatch(response http.ResponseWriter, request *http.Request) {
+	logger := logging.GetLogger(request.Context())
+	if logger == logging.DefaultLogger() {
+		logger = sh.Logger
+	}
+	debugLog := level.Debug(logger)
+	messageKey := logging.MessageKey()
+
+	format, err := contentTypeFormat(request.Header)
+	if err != nil {
+		response.WriteHeader(http.StatusUnsupportedMediaType)
+		response.Write([]byte("Unsupported Content-Type.\n"))
+		debugLog.Log(messageKey, "Unsupported Content-Type.", "contentType", request.Header.Values("Content-Type"))
+		return
+	}
+
+	payload, ok := sh.readPayload(response, request, logger)
+	if !ok {
 		return
 	}
 
-	decoder := wrp.NewDecoderBytes(payload, wrp.Msgpack)
 	msg := new(wrp.Message)
-	if err := decoder.Decode(msg); err != nil {
-		// return a 400
-		sh.invalidCount.Add(1.0)
+	if err := wrp.NewDecoderBytes(payload, format).Decode(msg); err != nil {
 		response.WriteHeader(http.StatusBadRequest)
 		response.Write([]byte("Invalid payload format.\n"))
-		debugLog.Log(messageKey, "Invalid payload format.\n")
+		debugLog.Log(messageKey, "Invalid payload format.")
 		return
 	}
 
-	sh.caduceusHandler.HandleRequest(0, sh.fixWrp(msg))
+	if _, err := sh.validator.validate(msg, logger); err != nil {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write([]byte(fmt.Sprintf("Invalid WRP message: %s.\n", err)))
+		return
+	}
 
-	// return a 202
-	response.WriteHeader(http.StatusAccepted)
-	response.Write([]byte("Request placed on to queue.\n"))
-	debugLog.Log(messageKey, "Request placed on to queue.")
+	// The message is matched as it would be delivered, but the changes
+	// aren't counted since it isn't.
+	sh.normalizers.normalize(msg)
+
+	report := MatchReport{
+		TransactionUUID: msg.TransactionUUID,
+		Webhooks:        []MatchResult{},
+	}
+	if nil != sh.matcher {
+		report.Webhooks = sh.matcher.Match(msg)
+	}
+
+	// The callers only see their own webhooks and, with partner isolation,
+	// only if allowed every partner of the webhook.
+	var partnerIDs []string
+	if sh.isolation.Enabled {
+		partnerIDs, err = sh.isolation.bindPartnerIDs(request.Context())
+		if nil != err {
+			response.WriteHeader(http.StatusForbidden)
+			response.Write([]byte(fmt.Sprintf("Forbidden: %s.\n", err)))
+			return
+		}
+	}
+
+	owner := registrationOwner(request.Context())
+	visible := []MatchResult{}
+	for _, r := range report.Webhooks {
+		if owner == r.owner && (!sh.isolation.Enabled || partnersCover(partnerIDs, r.partnerIDs)) {
+			visible = append(visible, r)
+		}
+	}
+	report.Webhooks = visible
+
+	body, err := json.Marshal(report)
+	if err != nil {
+		level.Error(logger).Log(messageKey, "Unable to marshal the match report.", logging.ErrorKey(), err)
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	response.Header().Set("Content-Type", wrp.MimeTypeJson)
+	response.WriteHeader(http.StatusOK)
+	response.Write(body)
+}
+
+// BatchResult is the outcome of handling a single message of a batch.
+type BatchResult struct {
+	Index           int    `json:"index"`
+	TransactionUUID string `json:"transaction_uuid,omitempty"`
+	Status          int    `json:"status"`
+	Message         string `json:"message,omitempty"`
+}
+
+// BatchResponse is the summary returned to the caller of the batch notify
+// endpoint.
+type BatchResponse struct {
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Results  []BatchResult `json:"results"`
+}
+
+// ServeBatch handles requests containing many WRP messages, either as an
+// array or as a stream of individually encoded messages.  Each message is
+// handled independently and the result for each is reported in the response.
+func (sh *ServerHandler) ServeBatch(response http.ResponseWriter, request *http.Request) {
+	logger := logging.GetLogger(request.Context())
+	if logger == logging.DefaultLogger() {
+		logger = sh.Logger
+	}
+	debugLog := level.Debug(logger)
+	infoLog := level.Info(logger)
+	errorLog := level.Error(logger)
+
+	messageKey := logging.MessageKey()
+	errorKey := logging.ErrorKey()
+
+	infoLog.Log(messageKey, "Receiving incoming batch request...")
+
+	format, payload, release, ok := sh.admit(response, request, logger)
+	if !ok {
+		return
+	}
+	defer release()
+
+	msgs, decodeErr := decodeBatch(payload, format)
+
+	summary := BatchResponse{
+		Results: make([]BatchResult, 0, len(msgs)+1),
+	}
+	queueFull := false
+	for i, msg := range msgs {
+		result := BatchResult{Index: i}
+		if nil == msg {
+			sh.emptyRequests.Add(1.0)
+			result.Status = http.StatusBadRequest
+			result.Message = "Empty message."
+			summary.Rejected++
+			summary.Results = append(summary.Results, result)
+			continue
+		}
+
+		result.TransactionUUID = msg.TransactionUUID
+		if status, message, ok := sh.screen(msg, logger); !ok {
+			result.Status = status
+			result.Message = message
+			if http.StatusBadRequest == status {
+				summary.Rejected++
+			} else {
+				summary.Accepted++
+			}
+			summary.Results = append(summary.Results, result)
+			continue
+		}
+
+		if err := sh.handle(sh.normalizeWrp(msg)); nil != err {
+			result.Status = http.StatusServiceUnavailable
+			result.Message = fmt.Sprintf("Unavailable: %s.", err)
+			summary.Rejected++
+			summary.Results = append(summary.Results, result)
+			queueFull = true
+			continue
+		}
+		result.Status = http.StatusAccepted
+		summary.Accepted++
+		summary.Results = append(summary.Results, result)
+	}
+
+	if nil != decodeErr {
+		// The rest of the stream can't be trusted once a message fails to
+		// decode, so it is reported as a single invalid entry.
+		sh.invalidCount.With("reason", invalidEncodingReason).Add(1.0)
+		summary.Rejected++
+		summary.Results = append(summary.Results, BatchResult{
+			Index:   len(msgs),
+			Status:  http.StatusBadRequest,
+			Message: "Invalid payload format.",
+		})
+		debugLog.Log(messageKey, "Invalid payload format in batch.", errorKey, decodeErr)
+	}
+
+	body, err := json.Marshal(summary)
+	if err != nil {
+		errorLog.Log(messageKey, "Unable to marshal the batch summary.", errorKey, err)
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	status := http.StatusAccepted
+	switch {
+	case 0 < summary.Accepted:
+	case queueFull:
+		status = http.StatusServiceUnavailable
+		response.Header().Set("Retry-After", retryAfterSeconds)
+	default:
+		status = http.StatusBadRequest
+	}
+
+	response.Header().Set("Content-Type", wrp.MimeTypeJson)
+	response.WriteHeader(status)
+	response.Write(body)
+	debugLog.Log(messageKey, "Batch placed on to queue.", "accepted", summary.Accepted, "rejected", summary.Rejected)
 }
 
-func (sh *ServerHandler) fixWrp(msg *wrp.Message) *wrp.Message {
-	// "Fix" the WRP if needed.
-	var reason string
+// decodeBatch decodes the payload as an array of messages, falling back to a
+// stream of individually encoded messages.  The messages decoded before an
+// error in the stream are returned along with the error.  Empty elements of
+// an array are returned as nil entries.
+func decodeBatch(payload []byte, format wrp.Format) ([]*wrp.Message, error) {
+	var msgs []*wrp.Message
+	if err := wrp.NewDecoderBytes(payload, format).Decode(&msgs); nil == err {
+		return msgs, nil
+	}
 
-	// Default to "application/json" if there is no content type, otherwise
-	// use the one the source specified.
-	if "" == msg.ContentType {
-		msg.ContentType = wrp.MimeTypeJson
-		reason = emptyContentTypeReason
+	msgs = nil
+	decoder := wrp.NewDecoderBytes(payload, format)
+	for {
+		msg := new(wrp.Message)
+		err := decoder.Decode(msg)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if nil != err {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
 	}
 
-	// Ensure there is a transaction id even if we make one up
-	if "" == msg.TransactionUUID {
-		msg.TransactionUUID = uuid.NewV4().String()
-		if reason == "" {
-			reason = emptyUUIDReason
-		} else {
-			reason = bothEmptyReason
+	if 0 == len(msgs) {
+		return nil, errors.New("no messages found in the batch")
+	}
+
+	return msgs, nil
+}
+
+// StartIngestion starts the workers handing the queued messages to the
+// caduceusHandler.  Until it is called messages are handled inline.
+func (sh *ServerHandler) StartIngestion(workers, queueSize int) {
+	if workers <= 0 {
+		return
+	}
+	if queueSize <= 0 {
+		queueSize = workers
+	}
+
+	sh.ingestQueue = make(chan *wrp.Message, queueSize)
+	for i := 0; i < workers; i++ {
+		sh.ingestWG.Add(1)
+		go sh.ingest(i)
+	}
+}
+
+// StopIngestion waits for the queued messages to be handled.  The requests
+// still being served once it is called are rejected.
+func (sh *ServerHandler) StopIngestion() {
+	if nil == sh.ingestQueue {
+		return
+	}
+	sh.ingestMutex.Lock()
+	sh.ingestStopped = true
+	close(sh.ingestQueue)
+	sh.ingestMutex.Unlock()
+	sh.ingestWG.Wait()
+}
+
+func (sh *ServerHandler) ingest(workerID int) {
+	defer sh.ingestWG.Done()
+	for msg := range sh.ingestQueue {
+		sh.incomingQueueDepthMetric.Add(-1.0)
+		sh.dispatch(workerID, msg)
+	}
+}
+
+// dispatch hands the message to the caduceusHandler and then seals the
+// tracker of the request waiting on its delivery, if any, since the fan-out
+// is complete.
+func (sh *ServerHandler) dispatch(workerID int, msg *wrp.Message) {
+	sh.caduceusHandler.HandleRequest(workerID, msg)
+	sh.deliveryTrackers.get(msg).seal()
+}
+
+// handle hands the message to the caduceusHandler, through the ingestion
+// queue when there is one.  An error is returned when the queue is full or
+// the ingestion stopped.
+func (sh *ServerHandler) handle(msg *wrp.Message) error {
+	sh.incomingQueueDepthMetric.Add(1.0)
+
+	if nil == sh.ingestQueue {
+		sh.dispatch(0, msg)
+		sh.incomingQueueDepthMetric.Add(-1.0)
+		return nil
+	}
+
+	sh.ingestMutex.RLock()
+	err := errIngestionStopped
+	if !sh.ingestStopped {
+		select {
+		case sh.ingestQueue <- msg:
+			err = nil
+		default:
+			err = errQueueFull
 		}
 	}
+	sh.ingestMutex.RUnlock()
+
+	if nil != err {
+		sh.incomingQueueDepthMetric.Add(-1.0)
+		// the message was never handled so a retry must not be a duplicate
+		sh.dedupe.forget(msg.TransactionUUID)
+	}
+	return err
+}
+
+// isDuplicate reports if the message repeats one handled within the dedupe
+// window.  It must be called before the message is normalized so that
+// messages whose TransactionUUID gets synthesized are never duplicates.
+func (sh *ServerHandler) isDuplicate(msg *wrp.Message) bool {
+	if "" == msg.TransactionUUID || !sh.dedupe.duplicate(msg.TransactionUUID) {
+		return false
+	}
+
+	sh.duplicateCount.Add(1.0)
+	return true
+}
 
-	if reason != "" {
+// normalizeWrp applies the configured normalizers to the message, counting
+// each modification made.
+func (sh *ServerHandler) normalizeWrp(msg *wrp.Message) *wrp.Message {
+	for _, reason := range sh.normalizers.normalize(msg) {
 		sh.modifiedWRPCount.With("reason", reason).Add(1.0)
 	}
 
@@ -18,6 +18,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -29,7 +30,9 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/webpa-common/secure/handler"
 	"github.com/xmidt-org/wrp-go/v3"
 )
 
@@ -130,8 +133,9 @@ func TestServerHandlerFixWrp(t *testing.T) {
 	fakeIncomingContentTypeCount.On("Add", 1.0).Return()
 
 	fakeModifiedWRPCount := new(mockCounter)
-	fakeModifiedWRPCount.On("With", []string{"reason", bothEmptyReason}).Return(fakeIncomingContentTypeCount).Once()
-	fakeModifiedWRPCount.On("Add", 1.0).Return().Once()
+	fakeModifiedWRPCount.On("With", []string{"reason", emptyContentTypeReason}).Return(fakeModifiedWRPCount).Once()
+	fakeModifiedWRPCount.On("With", []string{"reason", emptyUUIDReason}).Return(fakeModifiedWRPCount).Once()
+	fakeModifiedWRPCount.On("Add", 1.0).Return().Twice()
 
 	serverWrapper := &ServerHandler{
 		Logger:                   logger,
@@ -156,6 +160,7 @@ func TestServerHandlerFixWrp(t *testing.T) {
 			resp.Body.Close()
 		}
 		fakeHandler.AssertExpectations(t)
+		fakeModifiedWRPCount.AssertExpectations(t)
 	})
 }
 
@@ -285,6 +290,51 @@ func TestServerUnableToReadBody(t *testing.T) {
 	})
 }
 
+func TestServerTooLargeBody(t *testing.T) {
+	tests := []struct {
+		description   string
+		contentLength int64
+	}{
+		{description: "Content-Length", contentLength: 0},
+		{description: "Unknown Length", contentLength: -1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			req := exampleRequest()
+			if 0 != tc.contentLength {
+				req.ContentLength = tc.contentLength
+			}
+
+			fakeHandler := new(mockHandler)
+
+			fakeTooLarge := new(mockCounter)
+			fakeTooLarge.On("Add", 1.0).Return().Once()
+			fakeQueueDepth := new(mockGauge)
+			fakeQueueDepth.On("Add", mock.AnythingOfType("float64")).Return().Times(2)
+
+			serverWrapper := &ServerHandler{
+				Logger:                   logging.DefaultLogger(),
+				caduceusHandler:          fakeHandler,
+				tooLargeRequests:         fakeTooLarge,
+				incomingQueueDepthMetric: fakeQueueDepth,
+				maxOutstanding:           1,
+				maxPayloadSize:           8,
+			}
+
+			w := httptest.NewRecorder()
+			serverWrapper.ServeHTTP(w, req)
+			resp := w.Result()
+
+			assert.Equal(http.StatusRequestEntityTooLarge, resp.StatusCode)
+			fakeTooLarge.AssertExpectations(t)
+			fakeHandler.AssertNotCalled(t, "HandleRequest", mock.Anything, mock.Anything)
+		})
+	}
+}
+
 func TestServerInvalidBody(t *testing.T) {
 	fmt.Printf("TestServerInvalidBody")
 
@@ -305,6 +355,7 @@ func TestServerInvalidBody(t *testing.T) {
 	fakeQueueDepth.On("Add", mock.AnythingOfType("float64")).Return().Times(4)
 
 	fakeInvalidCount := new(mockCounter)
+	fakeInvalidCount.On("With", []string{"reason", invalidEncodingReason}).Return(fakeInvalidCount)
 	fakeInvalidCount.On("Add", mock.AnythingOfType("float64")).Return().Once()
 
 	serverWrapper := &ServerHandler{
@@ -329,3 +380,784 @@ func TestServerInvalidBody(t *testing.T) {
 		}
 	})
 }
+
+func TestServerHandlerValidation(t *testing.T) {
+	valid := func() *wrp.Message {
+		return &wrp.Message{
+			Type:            wrp.SimpleEventMessageType,
+			Source:          "mac:112233445566/lmlite",
+			TransactionUUID: "1234",
+			ContentType:     wrp.MimeTypeJson,
+			Destination:     "event:bob/magic/dog",
+			Payload:         []byte("Hello, world."),
+		}
+	}
+	strict := ValidationConfig{
+		MessageType: StrictValidation,
+		Destination: StrictValidation,
+		Source:      StrictValidation,
+	}
+
+	tests := []struct {
+		description    string
+		config         ValidationConfig
+		modify         func(*wrp.Message)
+		expectedStatus int
+		expectedReason string
+	}{
+		{
+			description:    "Valid",
+			config:         strict,
+			modify:         func(*wrp.Message) {},
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			description:    "Invalid Message Type",
+			config:         strict,
+			modify:         func(m *wrp.Message) { m.Type = wrp.SimpleRequestResponseMessageType },
+			expectedStatus: http.StatusBadRequest,
+			expectedReason: invalidMessageTypeReason,
+		},
+		{
+			description:    "Invalid Destination",
+			config:         strict,
+			modify:         func(m *wrp.Message) { m.Destination = "bob/magic/dog" },
+			expectedStatus: http.StatusBadRequest,
+			expectedReason: invalidDestinationReason,
+		},
+		{
+			description:    "Invalid Source",
+			config:         strict,
+			modify:         func(m *wrp.Message) { m.Source = "not a device" },
+			expectedStatus: http.StatusBadRequest,
+			expectedReason: invalidSourceReason,
+		},
+		{
+			description:    "Lenient",
+			config:         ValidationConfig{},
+			modify:         func(m *wrp.Message) { m.Type = wrp.SimpleRequestResponseMessageType; m.Source = "not a device" },
+			expectedStatus: http.StatusAccepted,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			validator, err := tc.config.New()
+			require.Nil(err)
+
+			msg := valid()
+			tc.modify(msg)
+			var buffer bytes.Buffer
+			require.Nil(wrp.NewEncoder(&buffer, wrp.Msgpack).Encode(msg))
+			req := httptest.NewRequest("POST", "localhost:8080", &buffer)
+			req.Header.Set("Content-Type", wrp.MimeTypeMsgpack)
+
+			fakeHandler := new(mockHandler)
+			fakeHandler.On("HandleRequest", mock.AnythingOfType("int"),
+				mock.AnythingOfType("*wrp.Message")).Return()
+
+			fakeQueueDepth := new(mockGauge)
+			fakeQueueDepth.On("Add", mock.AnythingOfType("float64")).Return().Times(2)
+
+			fakeInvalidCount := new(mockCounter)
+			if "" != tc.expectedReason {
+				fakeInvalidCount.On("With", []string{"reason", tc.expectedReason}).Return(fakeInvalidCount).Once()
+				fakeInvalidCount.On("Add", 1.0).Return().Once()
+			}
+
+			serverWrapper := &ServerHandler{
+				Logger:                   logging.DefaultLogger(),
+				caduceusHandler:          fakeHandler,
+				invalidCount:             fakeInvalidCount,
+				incomingQueueDepthMetric: fakeQueueDepth,
+				validator:                validator,
+			}
+
+			w := httptest.NewRecorder()
+			serverWrapper.ServeHTTP(w, req)
+
+			assert.Equal(tc.expectedStatus, w.Code)
+			fakeInvalidCount.AssertExpectations(t)
+			if http.StatusAccepted == tc.expectedStatus {
+				fakeHandler.AssertNumberOfCalls(t, "HandleRequest", 1)
+			} else {
+				fakeHandler.AssertNotCalled(t, "HandleRequest", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestServerHandlerDuplicate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	dedupe, err := DedupeConfig{Window: time.Minute}.New()
+	require.Nil(err)
+
+	fakeHandler := new(mockHandler)
+	fakeHandler.On("HandleRequest", mock.AnythingOfType("int"),
+		mock.AnythingOfType("*wrp.Message")).Return()
+
+	fakeQueueDepth := new(mockGauge)
+	fakeQueueDepth.On("Add", mock.AnythingOfType("float64")).Return()
+
+	fakeDuplicateCount := new(mockCounter)
+	fakeDuplicateCount.On("Add", 1.0).Return().Once()
+
+	fakeModifiedWRPCount := new(mockCounter)
+	fakeModifiedWRPCount.On("With", []string{"reason", emptyUUIDReason}).Return(fakeModifiedWRPCount)
+	fakeModifiedWRPCount.On("Add", 1.0).Return()
+
+	serverWrapper := &ServerHandler{
+		Logger:                   logging.DefaultLogger(),
+		caduceusHandler:          fakeHandler,
+		incomingQueueDepthMetric: fakeQueueDepth,
+		modifiedWRPCount:         fakeModifiedWRPCount,
+		dedupe:                   dedupe,
+		duplicateCount:           fakeDuplicateCount,
+	}
+
+	// the retry of a message is suppressed
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		serverWrapper.ServeHTTP(w, exampleRequest("1234"))
+		assert.Equal(http.StatusAccepted, w.Code)
+	}
+	fakeHandler.AssertNumberOfCalls(t, "HandleRequest", 1)
+	fakeDuplicateCount.AssertExpectations(t)
+
+	// messages whose transaction uuid is synthesized are never duplicates
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		serverWrapper.ServeHTTP(w, exampleRequest(""))
+		assert.Equal(http.StatusAccepted, w.Code)
+	}
+	fakeHandler.AssertNumberOfCalls(t, "HandleRequest", 3)
+	fakeDuplicateCount.AssertExpectations(t)
+}
+
+func TestServerHandlerIngestion(t *testing.T) {
+	assert := assert.New(t)
+
+	started := make(chan struct{}, 3)
+	release := make(chan struct{})
+	fakeHandler := new(mockHandler)
+	fakeHandler.On("HandleRequest", mock.AnythingOfType("int"),
+		mock.AnythingOfType("*wrp.Message")).Return().Run(func(mock.Arguments) {
+		started <- struct{}{}
+		<-release
+	})
+
+	fakeQueueDepth := new(mockGauge)
+	fakeQueueDepth.On("Add", 1.0).Return()
+	fakeQueueDepth.On("Add", -1.0).Return()
+
+	serverWrapper := &ServerHandler{
+		Logger:                   logging.DefaultLogger(),
+		caduceusHandler:          fakeHandler,
+		incomingQueueDepthMetric: fakeQueueDepth,
+	}
+	serverWrapper.StartIngestion(1, 1)
+
+	// the worker is busy with the first message
+	w := httptest.NewRecorder()
+	serverWrapper.ServeHTTP(w, exampleRequest("1"))
+	assert.Equal(http.StatusAccepted, w.Code)
+	<-started
+
+	// the second message waits in the queue
+	w = httptest.NewRecorder()
+	serverWrapper.ServeHTTP(w, exampleRequest("2"))
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	// the queue is full
+	w = httptest.NewRecorder()
+	serverWrapper.ServeHTTP(w, exampleRequest("3"))
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.Equal(retryAfterSeconds, w.Header().Get("Retry-After"))
+
+	close(release)
+	serverWrapper.StopIngestion()
+
+	fakeHandler.AssertNumberOfCalls(t, "HandleRequest", 2)
+	fakeQueueDepth.AssertNumberOfCalls(t, "Add", 6)
+}
+
+// The requests still being served once the ingestion stopped are rejected
+// rather than queued on the closed queue.
+func TestServerHandlerIngestionStopped(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeHandler := new(mockHandler)
+	fakeQueueDepth := new(mockGauge)
+	fakeQueueDepth.On("Add", 1.0).Return()
+	fakeQueueDepth.On("Add", -1.0).Return()
+
+	serverWrapper := &ServerHandler{
+		Logger:                   logging.DefaultLogger(),
+		caduceusHandler:          fakeHandler,
+		incomingQueueDepthMetric: fakeQueueDepth,
+	}
+	serverWrapper.StartIngestion(1, 1)
+	serverWrapper.StopIngestion()
+
+	w := httptest.NewRecorder()
+	serverWrapper.ServeHTTP(w, exampleRequest("1"))
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.Equal(retryAfterSeconds, w.Header().Get("Retry-After"))
+
+	fakeHandler.AssertNotCalled(t, "HandleRequest", mock.Anything, mock.Anything)
+	fakeQueueDepth.AssertNumberOfCalls(t, "Add", 2)
+}
+
+func TestServerHandlerQueueBudget(t *testing.T) {
+	assert := assert.New(t)
+
+	fakeHandler := new(mockHandler)
+	fakeHandler.On("HandleRequest", mock.AnythingOfType("int"),
+		mock.AnythingOfType("*wrp.Message")).Return().Once()
+
+	fakeQueueDepth := new(mockGauge)
+	fakeQueueDepth.On("Add", 1.0).Return()
+	fakeQueueDepth.On("Add", -1.0).Return()
+
+	budget, err := QueueBudgetConfig{MaxMessages: 1}.New(permissiveRegistry())
+	require.Nil(t, err)
+
+	serverWrapper := &ServerHandler{
+		Logger:                   logging.DefaultLogger(),
+		caduceusHandler:          fakeHandler,
+		incomingQueueDepthMetric: fakeQueueDepth,
+		queueBudget:              budget,
+	}
+
+	// the senders are behind
+	budget.queued(10)
+
+	w := httptest.NewRecorder()
+	serverWrapper.ServeHTTP(w, exampleRequest("1"))
+	assert.Equal(http.StatusTooManyRequests, w.Code)
+	assert.Equal(retryAfterSeconds, w.Header().Get("Retry-After"))
+
+	// and caught up
+	budget.dequeued(10)
+
+	w = httptest.NewRecorder()
+	serverWrapper.ServeHTTP(w, exampleRequest("1"))
+	assert.Equal(http.StatusAccepted, w.Code)
+
+	fakeHandler.AssertExpectations(t)
+}
+
+// The notify and batch notify requests are admitted the same way.
+func TestServerHandlerAdmission(t *testing.T) {
+	handlers := map[string]func(*ServerHandler, http.ResponseWriter, *http.Request){
+		"Notify": (*ServerHandler).ServeHTTP,
+		"Batch":  (*ServerHandler).ServeBatch,
+	}
+
+	tests := []struct {
+		description    string
+		outstanding    int64
+		budgetQueued   int
+		contentType    string
+		expectedStatus int
+		retryAfter     bool
+	}{
+		{
+			description:    "Unsupported content type",
+			contentType:    "text/plain",
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			description:    "Too many outstanding",
+			outstanding:    1,
+			expectedStatus: http.StatusServiceUnavailable,
+			retryAfter:     true,
+		},
+		{
+			description:    "Over the queue budget",
+			budgetQueued:   10,
+			expectedStatus: http.StatusTooManyRequests,
+			retryAfter:     true,
+		},
+	}
+
+	for name, serve := range handlers {
+		for _, tc := range tests {
+			t.Run(name+"/"+tc.description, func(t *testing.T) {
+				assert := assert.New(t)
+
+				budget, err := QueueBudgetConfig{MaxMessages: 1}.New(permissiveRegistry())
+				require.Nil(t, err)
+				if 0 < tc.budgetQueued {
+					budget.queued(tc.budgetQueued)
+				}
+
+				fakeHandler := new(mockHandler)
+				serverWrapper := &ServerHandler{
+					Logger:             logging.DefaultLogger(),
+					caduceusHandler:    fakeHandler,
+					maxOutstanding:     1,
+					incomingQueueDepth: tc.outstanding,
+					queueBudget:        budget,
+				}
+
+				req := exampleRequest("1")
+				if "" != tc.contentType {
+					req.Header.Set("Content-Type", tc.contentType)
+				}
+
+				w := httptest.NewRecorder()
+				serve(serverWrapper, w, req)
+				assert.Equal(tc.expectedStatus, w.Code)
+				assert.Equal(tc.retryAfter, "" != w.Header().Get("Retry-After"))
+				assert.Equal(tc.outstanding, serverWrapper.incomingQueueDepth)
+				fakeHandler.AssertNotCalled(t, "HandleRequest", mock.Anything, mock.Anything)
+			})
+		}
+	}
+}
+
+func TestServerHandlerMatch(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	results := []MatchResult{
+		{Webhook: "http://localhost:8888/foo", Events: []string{"bob/.*"}, DeviceID: ".*", Matched: true},
+		{Webhook: "http://localhost:9999/foo", Expired: true},
+	}
+	other := MatchResult{Webhook: webhookID("other", "http://localhost:7777/foo"), owner: "other", Matched: true}
+
+	fakeHandler := new(mockHandler)
+	fakeMatcher := new(mockSenderWrapper)
+	fakeMatcher.On("Match", mock.AnythingOfType("*wrp.Message")).Return(append(results, other)).Once()
+
+	serverWrapper := &ServerHandler{
+		Logger:          logging.DefaultLogger(),
+		caduceusHandler: fakeHandler,
+		matcher:         fakeMatcher,
+	}
+
+	w := httptest.NewRecorder()
+	serverWrapper.ServeMatch(w, exampleRequest("1234"))
+	require.Equal(http.StatusOK, w.Code)
+
+	var report MatchReport
+	require.Nil(json.NewDecoder(w.Body).Decode(&report))
+	assert.Equal("1234", report.TransactionUUID)
+
+	// The webhooks of other owners aren't listed.
+	assert.Equal(results, report.Webhooks)
+
+	fakeMatcher.AssertExpectations(t)
+	fakeHandler.AssertNotCalled(t, "HandleRequest", mock.Anything, mock.Anything)
+
+	w = httptest.NewRecorder()
+	req := exampleRequest()
+	req.Header.Set("Content-Type", "text/plain")
+	serverWrapper.ServeMatch(w, req)
+	assert.Equal(http.StatusUnsupportedMediaType, w.Code)
+}
+
+func TestServerHandlerMatchPartnerIsolation(t *testing.T) {
+	results := []MatchResult{
+		{Webhook: "http://localhost:8888/foo", owner: "client", partnerIDs: []string{"comcast"}},
+		{Webhook: "http://localhost:9999/foo", owner: "client", partnerIDs: []string{"other"}},
+		{Webhook: "http://localhost:6666/foo", owner: "client", partnerIDs: []string{"comcast", "other"}},
+		{Webhook: "http://localhost:5555/foo", owner: "someone", partnerIDs: []string{"comcast"}},
+		{Webhook: "http://localhost:7777/foo", owner: "admin", partnerIDs: []string{"*"}},
+		{Webhook: "http://localhost:4444/foo", owner: "admin", partnerIDs: []string{"comcast"}},
+	}
+
+	tests := []struct {
+		description    string
+		values         *handler.ContextValues
+		expectedStatus int
+		expected       []string
+	}{
+		{
+			description:    "Own Webhooks",
+			values:         &handler.ContextValues{SatClientID: "client", PartnerIDs: []string{"comcast"}},
+			expectedStatus: http.StatusOK,
+			expected:       []string{"http://localhost:8888/foo"},
+		},
+		{
+			description:    "Privileged",
+			values:         &handler.ContextValues{SatClientID: "admin", PartnerIDs: []string{"*"}},
+			expectedStatus: http.StatusOK,
+			expected:       []string{"http://localhost:7777/foo", "http://localhost:4444/foo"},
+		},
+		{
+			description:    "No Token",
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			require := require.New(t)
+
+			fakeMatcher := new(mockSenderWrapper)
+			fakeMatcher.On("Match", mock.AnythingOfType("*wrp.Message")).Return(results).Once()
+
+			serverWrapper := &ServerHandler{
+				Logger:          logging.DefaultLogger(),
+				caduceusHandler: new(mockHandler),
+				matcher:         fakeMatcher,
+				isolation: PartnerIsolationConfig{
+					Enabled:           true,
+					PrivilegedClients: []string{"admin"},
+				},
+			}
+
+			request := exampleRequest("1234")
+			if nil != tc.values {
+				request = request.WithContext(handler.NewContextWithValue(request.Context(), tc.values))
+			}
+
+			w := httptest.NewRecorder()
+			serverWrapper.ServeMatch(w, request)
+			require.Equal(tc.expectedStatus, w.Code)
+			if http.StatusOK != w.Code {
+				return
+			}
+
+			var report MatchReport
+			require.Nil(json.NewDecoder(w.Body).Decode(&report))
+			var webhooks []string
+			for _, r := range report.Webhooks {
+				webhooks = append(webhooks, r.Webhook)
+			}
+			assert.Equal(tc.expected, webhooks)
+		})
+	}
+}
+
+func exampleBatchRequest(asArray bool, msgs ...*wrp.Message) *http.Request {
+	var buffer bytes.Buffer
+
+	encoder := wrp.NewEncoder(&buffer, wrp.Msgpack)
+	if asArray {
+		encoder.Encode(msgs)
+	} else {
+		for _, msg := range msgs {
+			encoder.Encode(msg)
+		}
+	}
+
+	req := httptest.NewRequest("POST", "localhost:8080", bytes.NewReader(buffer.Bytes()))
+	req.Header.Set("Content-Type", wrp.MimeTypeMsgpack)
+
+	return req
+}
+
+func TestServerHandlerBatch(t *testing.T) {
+	msgs := []*wrp.Message{
+		{
+			Source:          "mac:112233445566/lmlite",
+			TransactionUUID: "1234",
+			ContentType:     wrp.MimeTypeJson,
+			Destination:     "event:bob/magic/dog",
+		},
+		{
+			Source:          "mac:112233445566/lmlite",
+			TransactionUUID: "5678",
+			ContentType:     wrp.MimeTypeJson,
+			Destination:     "event:bob/magic/cat",
+		},
+	}
+
+	tests := []struct {
+		description string
+		request     *http.Request
+	}{
+		{
+			description: "Array",
+			request:     exampleBatchRequest(true, msgs...),
+		},
+		{
+			description: "Stream",
+			request:     exampleBatchRequest(false, msgs...),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			fakeHandler := new(mockHandler)
+			fakeHandler.On("HandleRequest", mock.AnythingOfType("int"),
+				mock.AnythingOfType("*wrp.Message")).Return().Times(2)
+
+			fakeQueueDepth := new(mockGauge)
+			fakeQueueDepth.On("Add", mock.AnythingOfType("float64")).Return().Times(4)
+
+			serverWrapper := &ServerHandler{
+				Logger:                   logging.DefaultLogger(),
+				caduceusHandler:          fakeHandler,
+				incomingQueueDepthMetric: fakeQueueDepth,
+			}
+
+			w := httptest.NewRecorder()
+			serverWrapper.ServeBatch(w, tc.request)
+			resp := w.Result()
+
+			assert.Equal(http.StatusAccepted, resp.StatusCode)
+
+			var summary BatchResponse
+			assert.Nil(json.NewDecoder(resp.Body).Decode(&summary))
+			resp.Body.Close()
+
+			assert.Equal(2, summary.Accepted)
+			assert.Equal(0, summary.Rejected)
+			if assert.Len(summary.Results, 2) {
+				assert.Equal("1234", summary.Results[0].TransactionUUID)
+				assert.Equal("5678", summary.Results[1].TransactionUUID)
+			}
+			fakeHandler.AssertExpectations(t)
+		})
+	}
+}
+
+func TestServerHandlerBatchInvalid(t *testing.T) {
+	assert := assert.New(t)
+
+	req := httptest.NewRequest("POST", "localhost:8080", bytes.NewReader([]byte("Invalid payload.")))
+	req.Header.Set("Content-Type", wrp.MimeTypeMsgpack)
+
+	fakeHandler := new(mockHandler)
+
+	fakeQueueDepth := new(mockGauge)
+	fakeQueueDepth.On("Add", mock.AnythingOfType("float64")).Return().Times(2)
+
+	fakeInvalidCount := new(mockCounter)
+	fakeInvalidCount.On("With", []string{"reason", invalidEncodingReason}).Return(fakeInvalidCount)
+	fakeInvalidCount.On("Add", 1.0).Return().Once()
+
+	serverWrapper := &ServerHandler{
+		Logger:                   logging.DefaultLogger(),
+		caduceusHandler:          fakeHandler,
+		invalidCount:             fakeInvalidCount,
+		incomingQueueDepthMetric: fakeQueueDepth,
+	}
+
+	w := httptest.NewRecorder()
+	serverWrapper.ServeBatch(w, req)
+	resp := w.Result()
+
+	assert.Equal(http.StatusBadRequest, resp.StatusCode)
+	if nil != resp.Body {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	fakeHandler.AssertNotCalled(t, "HandleRequest", mock.Anything, mock.Anything)
+	fakeInvalidCount.AssertExpectations(t)
+}
+
+func TestServerHandlerContentType(t *testing.T) {
+	tests := []struct {
+		description    string
+		contentType    []string
+		format         wrp.Format
+		expectedStatus int
+	}{
+		{
+			description:    "Msgpack",
+			contentType:    []string{wrp.MimeTypeMsgpack},
+			format:         wrp.Msgpack,
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			description:    "JSON",
+			contentType:    []string{wrp.MimeTypeJson},
+			format:         wrp.JSON,
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			description:    "JSON with charset",
+			contentType:    []string{"application/json; charset=utf-8"},
+			format:         wrp.JSON,
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			description:    "WRP",
+			contentType:    []string{wrp.MimeTypeWrp},
+			format:         wrp.Msgpack,
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			description:    "WRP JSON",
+			contentType:    []string{"application/wrp+json"},
+			format:         wrp.JSON,
+			expectedStatus: http.StatusAccepted,
+		},
+		{
+			description:    "Unsupported",
+			contentType:    []string{"text/plain"},
+			format:         wrp.Msgpack,
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			description:    "Missing",
+			format:         wrp.Msgpack,
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			description:    "Multiple",
+			contentType:    []string{wrp.MimeTypeMsgpack, wrp.MimeTypeJson},
+			format:         wrp.Msgpack,
+			expectedStatus: http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			var buffer bytes.Buffer
+			wrp.NewEncoder(&buffer, tc.format).Encode(&wrp.Message{
+				Source:          "mac:112233445566/lmlite",
+				TransactionUUID: "1234",
+				ContentType:     wrp.MimeTypeJson,
+				Destination:     "event:bob/magic/dog",
+			})
+
+			req := httptest.NewRequest("POST", "localhost:8080", bytes.NewReader(buffer.Bytes()))
+			for _, ct := range tc.contentType {
+				req.Header.Add("Content-Type", ct)
+			}
+
+			fakeHandler := new(mockHandler)
+			fakeHandler.On("HandleRequest", mock.AnythingOfType("int"),
+				mock.AnythingOfType("*wrp.Message")).Return()
+
+			fakeQueueDepth := new(mockGauge)
+			fakeQueueDepth.On("Add", mock.AnythingOfType("float64")).Return()
+
+			serverWrapper := &ServerHandler{
+				Logger:                   logging.DefaultLogger(),
+				caduceusHandler:          fakeHandler,
+				incomingQueueDepthMetric: fakeQueueDepth,
+			}
+
+			w := httptest.NewRecorder()
+			serverWrapper.ServeHTTP(w, req)
+			resp := w.Result()
+
+			assert.Equal(tc.expectedStatus, resp.StatusCode)
+			if nil != resp.Body {
+				io.Copy(ioutil.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			if http.StatusAccepted == tc.expectedStatus {
+				fakeHandler.AssertNumberOfCalls(t, "HandleRequest", 1)
+			} else {
+				fakeHandler.AssertNotCalled(t, "HandleRequest", mock.Anything, mock.Anything)
+			}
+		})
+	}
+}
+
+func TestServerHandlerWaitForDelivery(t *testing.T) {
+	assert := assert.New(t)
+
+	trackers := new(deliveryTrackers)
+
+	// Act like a single webhook matched and received the message.
+	fakeHandler := new(mockHandler)
+	fakeHandler.On("HandleRequest", mock.AnythingOfType("int"),
+		mock.AnythingOfType("*wrp.Message")).Return().Once().Run(func(args mock.Arguments) {
+		tracker := trackers.get(args.Get(1).(*wrp.Message))
+		tracker.matched("http://localhost:9999/foo")
+		go tracker.delivered("http://localhost:9999/foo", http.StatusOK)
+	})
+
+	fakeQueueDepth := new(mockGauge)
+	fakeQueueDepth.On("Add", mock.AnythingOfType("float64")).Return().Times(2)
+
+	serverWrapper := &ServerHandler{
+		Logger:                   logging.DefaultLogger(),
+		caduceusHandler:          fakeHandler,
+		incomingQueueDepthMetric: fakeQueueDepth,
+		deliveryTrackers:         trackers,
+		maxDeliveryWait:          time.Second,
+	}
+
+	req := exampleRequest()
+	req.Header.Set(waitForDeliveryHeader, "true")
+
+	w := httptest.NewRecorder()
+	serverWrapper.ServeHTTP(w, req)
+	resp := w.Result()
+
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	var report DeliveryReport
+	assert.Nil(json.NewDecoder(resp.Body).Decode(&report))
+	resp.Body.Close()
+
+	assert.Equal("1234", report.TransactionUUID)
+	assert.False(report.TimedOut)
+	assert.Equal([]DeliveryResult{{Webhook: "http://localhost:9999/foo", Status: http.StatusOK}}, report.Webhooks)
+	fakeHandler.AssertExpectations(t)
+}
+
+// Waiting for the delivery goes through the ingestion queue like any other
+// notify request.
+func TestServerHandlerWaitForDeliveryIngestion(t *testing.T) {
+	assert := assert.New(t)
+
+	trackers := new(deliveryTrackers)
+
+	fakeHandler := new(mockHandler)
+	fakeHandler.On("HandleRequest", mock.AnythingOfType("int"),
+		mock.AnythingOfType("*wrp.Message")).Return().Once().Run(func(args mock.Arguments) {
+		tracker := trackers.get(args.Get(1).(*wrp.Message))
+		tracker.matched("http://localhost:9999/foo")
+		go tracker.delivered("http://localhost:9999/foo", http.StatusOK)
+	})
+
+	fakeQueueDepth := new(mockGauge)
+	fakeQueueDepth.On("Add", 1.0).Return()
+	fakeQueueDepth.On("Add", -1.0).Return()
+
+	serverWrapper := &ServerHandler{
+		Logger:                   logging.DefaultLogger(),
+		caduceusHandler:          fakeHandler,
+		incomingQueueDepthMetric: fakeQueueDepth,
+		deliveryTrackers:         trackers,
+		maxDeliveryWait:          time.Second,
+	}
+	serverWrapper.StartIngestion(1, 1)
+
+	req := exampleRequest()
+	req.Header.Set(waitForDeliveryHeader, "true")
+
+	w := httptest.NewRecorder()
+	serverWrapper.ServeHTTP(w, req)
+	assert.Equal(http.StatusOK, w.Code)
+
+	var report DeliveryReport
+	assert.Nil(json.NewDecoder(w.Body).Decode(&report))
+	assert.False(report.TimedOut)
+	assert.Equal([]DeliveryResult{{Webhook: "http://localhost:9999/foo", Status: http.StatusOK}}, report.Webhooks)
+
+	// Once the ingestion stopped the requests waiting for the delivery are
+	// rejected too.
+	serverWrapper.StopIngestion()
+
+	req = exampleRequest("2")
+	req.Header.Set(waitForDeliveryHeader, "true")
+
+	w = httptest.NewRecorder()
+	serverWrapper.ServeHTTP(w, req)
+	assert.Equal(http.StatusServiceUnavailable, w.Code)
+	assert.Equal(retryAfterSeconds, w.Header().Get("Retry-After"))
+
+	fakeHandler.AssertExpectations(t)
+}
@@ -121,16 +121,67 @@ func caduceus(arguments []string) int {
 		otelhttp.WithTracerProvider(tracing.TracerProvider()),
 	)
 
+	trackers := new(deliveryTrackers)
+
+	argusClientTimeout, err := newArgusClientTimeout(v)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to parse argus client timeout config values: %v \n", err)
+		return 1
+	}
+
+	if err = caduceusConfig.PartnerIsolation.validate(caduceusConfig.WebhookOptions); err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid partner isolation config: %v\n", err)
+		return 1
+	}
+
+	optionsStore, stopOptions, err := NewWebhookOptionsStore(caduceusConfig.WebhookOptions, newHTTPClient(argusClientTimeout, tracing), logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to initialize webhook options store: %v\n", err)
+		return 1
+	}
+
+	queueBudget, err := caduceusConfig.QueueBudget.New(metricsRegistry)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to initialize the queue budget: %s\n", err)
+		return 1
+	}
+
+	deadLetters, err := caduceusConfig.DeadLetters.New(metricsRegistry)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to initialize the dead letters: %s\n", err)
+		return 1
+	}
+
+	secretRotation, err := caduceusConfig.SecretRotation.withDefaults()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to initialize the secret rotations: %s\n", err)
+		return 1
+	}
+
 	caduceusSenderWrapper, err := SenderWrapperFactory{
 		NumWorkersPerSender: caduceusConfig.Sender.NumWorkersPerSender,
 		QueueSizePerSender:  caduceusConfig.Sender.QueueSizePerSender,
 		CutOffPeriod:        caduceusConfig.Sender.CutOffPeriod,
 		Linger:              caduceusConfig.Sender.Linger,
+		DrainRemoved:        caduceusConfig.Sender.DrainRemoved,
+		ShutdownTimeout:     caduceusConfig.Sender.ShutdownTimeout,
+		SpillDirectory:      caduceusConfig.Sender.SpillDirectory,
+		DurableQueue:        caduceusConfig.Sender.DurableQueue,
+		Backoff:             caduceusConfig.Sender.Backoff,
+		CircuitBreaker:      caduceusConfig.Sender.CircuitBreaker,
+		Signature:           caduceusConfig.Sender.Signature,
 		DeliveryRetries:     caduceusConfig.Sender.DeliveryRetries,
 		DeliveryInterval:    caduceusConfig.Sender.DeliveryInterval,
 		RetryCodes:          caduceusConfig.Sender.RetryCodes,
 		MetricsRegistry:     metricsRegistry,
 		Logger:              logger,
+		DeliveryTrackers:    trackers,
+		Options:             optionsStore,
+		PartnerIsolation:    caduceusConfig.PartnerIsolation.Enabled,
+		WorkerPool:          caduceusConfig.Sender.WorkerPool,
+		QueueBudget:         queueBudget,
+		DeliveryBounds:      caduceusConfig.Sender.DeliveryBounds,
+		DeadLetters:         deadLetters,
 		Sender: (&http.Client{
 			Transport: tr,
 			Timeout:   caduceusConfig.Sender.ClientTimeout,
@@ -142,6 +193,27 @@ func caduceus(arguments []string) int {
 		return 1
 	}
 
+	validator, err := caduceusConfig.Validation.New()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to initialize WRP validation: %s\n", err)
+		return 1
+	}
+
+	if "" == caduceusConfig.Normalizers.FQDN {
+		caduceusConfig.Normalizers.FQDN = v.GetString("fqdn")
+	}
+	normalizers, err := caduceusConfig.Normalizers.New()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to initialize WRP normalizers: %s\n", err)
+		return 1
+	}
+
+	dedupe, err := caduceusConfig.Dedupe.New()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to initialize duplicate suppression: %s\n", err)
+		return 1
+	}
+
 	serverWrapper := &ServerHandler{
 		Logger: logger,
 		caduceusHandler: &CaduceusHandler{
@@ -150,20 +222,26 @@ func caduceus(arguments []string) int {
 		},
 		errorRequests:            metricsRegistry.NewCounter(ErrorRequestBodyCounter),
 		emptyRequests:            metricsRegistry.NewCounter(EmptyRequestBodyCounter),
+		tooLargeRequests:         metricsRegistry.NewCounter(TooLargeRequestBodyCounter),
 		invalidCount:             metricsRegistry.NewCounter(DropsDueToInvalidPayload),
 		incomingQueueDepthMetric: metricsRegistry.NewGauge(IncomingQueueDepth),
 		modifiedWRPCount:         metricsRegistry.NewCounter(ModifiedWRPCounter),
-		maxOutstanding:           0,
+		maxOutstanding:           caduceusConfig.MaxOutstanding,
+		maxPayloadSize:           caduceusConfig.MaxRequestBodySize,
+		deliveryTrackers:         trackers,
+		maxDeliveryWait:          caduceusConfig.MaxDeliveryWait,
+		validator:                validator,
+		normalizers:              normalizers,
+		dedupe:                   dedupe,
+		duplicateCount:           metricsRegistry.NewCounter(DuplicateMessageCounter),
+		matcher:                  caduceusSenderWrapper,
+		queueBudget:              queueBudget,
+		isolation:                caduceusConfig.PartnerIsolation,
 	}
+	serverWrapper.StartIngestion(caduceusConfig.NumWorkerThreads, caduceusConfig.JobQueueSize)
 
 	caduceusConfig.Webhook.Logger = logger
 	caduceusConfig.Webhook.MetricsProvider = metricsRegistry
-	argusClientTimeout, err := newArgusClientTimeout(v)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to parse argus client timeout config values: %v \n", err)
-		return 1
-	}
-
 	caduceusConfig.Webhook.Argus.HTTPClient = newHTTPClient(argusClientTimeout, tracing)
 	svc, stopWatches, err := ancla.Initialize(caduceusConfig.Webhook, getLogger, caduceusSenderWrapper)
 	if err != nil {
@@ -179,7 +257,22 @@ func caduceus(arguments []string) int {
 	}
 	rootRouter.Use(otelmux.Middleware("primary", otelMuxOptions...), candlelight.EchoFirstTraceNodeInfo(tracing.Propagator()))
 
-	primaryHandler, err := NewPrimaryHandler(logger, v, serverWrapper, svc, metricsRegistry, rootRouter)
+	primaryHandler, err := NewPrimaryHandler(logger, v, serverWrapper, svc, webhookOptionsHandler{
+		store:     optionsStore,
+		isolation: caduceusConfig.PartnerIsolation,
+		bounds:    caduceusConfig.Sender.DeliveryBounds,
+		durable:   caduceusConfig.Sender.DurableQueue.enabled(),
+		byOwner:   "" != caduceusConfig.WebhookOptions.Address,
+	}, deadLetterHandler{
+		store:         deadLetters,
+		senderWrapper: caduceusSenderWrapper,
+		options:       optionsStore,
+		isolation:     caduceusConfig.PartnerIsolation,
+	}, secretRotationHandler{
+		store:     optionsStore,
+		isolation: caduceusConfig.PartnerIsolation,
+		config:    secretRotation,
+	}, metricsRegistry, rootRouter)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Validator error: %v\n", err)
 		return 1
@@ -228,9 +321,13 @@ func caduceus(arguments []string) int {
 	close(shutdown)
 	waitGroup.Wait()
 
+	// hand the queued messages to the sender wrapper before shutting it down
+	serverWrapper.StopIngestion()
+
 	// shutdown the sender wrapper gently so that all queued messages get serviced
 	caduceusSenderWrapper.Shutdown(true)
 	stopWatches()
+	stopOptions()
 	return 0
 }
 
@@ -7,6 +7,9 @@ import (
 const (
 	ErrorRequestBodyCounter         = "error_request_body_count"
 	EmptyRequestBodyCounter         = "empty_request_body_count"
+	TooLargeRequestBodyCounter      = "too_large_request_body_count"
+	DuplicateMessageCounter         = "duplicate_message_count"
+	RemovedWebhookCounter           = "removed_webhook_count"
 	ModifiedWRPCounter              = "modified_wrp_count"
 	DeliveryCounter                 = "delivery_count"
 	DeliveryRetryCounter            = "delivery_retry_count"
@@ -23,12 +26,34 @@ const (
 	ConsumerDropUntilGauge          = "consumer_drop_until"
 	ConsumerDeliveryWorkersGauge    = "consumer_delivery_workers"
 	ConsumerMaxDeliveryWorkersGauge = "consumer_delivery_workers_max"
+	WorkerPoolSizeGauge             = "worker_pool_size"
+	WorkerPoolBusyGauge             = "worker_pool_busy_workers"
+	WorkerPoolWaitingGauge          = "worker_pool_waiting_senders"
+	QueuedMessagesGauge             = "queued_messages"
+	QueuedBytesGauge                = "queued_message_bytes"
+	OverBudgetRequestCounter        = "over_budget_request_count"
+	SpilledMessageCounter           = "spilled_message_count"
+	RestoredMessageCounter          = "restored_message_count"
+	DeadLetterCounter               = "dead_letter_count"
+	DeadLettersGauge                = "dead_letters"
+	CircuitBreakerStateGauge        = "circuit_breaker_state"
+	BatchDeliveryCounter            = "batch_delivery_count"
 )
 
 const (
-	emptyContentTypeReason = "empty_content_type"
-	emptyUUIDReason        = "empty_uuid"
-	bothEmptyReason        = "empty_uuid_and_content_type"
+	emptyContentTypeReason    = "empty_content_type"
+	emptyUUIDReason           = "empty_uuid"
+	addedReceivedAtReason     = "added_received_at"
+	addedFQDNReason           = "added_fqdn"
+	canonicalizedSourceReason = "canonicalized_source"
+	addedPartnerIDsReason     = "added_partner_ids"
+)
+
+const (
+	invalidEncodingReason    = "invalid_encoding"
+	invalidMessageTypeReason = "invalid_message_type"
+	invalidDestinationReason = "invalid_destination"
+	invalidSourceReason      = "invalid_source"
 )
 
 func Metrics() []xmetrics.Metric {
@@ -49,10 +74,21 @@ func Metrics() []xmetrics.Metric {
 			Type: "counter",
 		},
 		{
-			Name: DropsDueToInvalidPayload,
-			Help: "Dropped messages due to invalid payloads.",
+			Name: TooLargeRequestBodyCounter,
+			Help: "Count of the number of times the request body is larger than allowed.",
 			Type: "counter",
 		},
+		{
+			Name: DuplicateMessageCounter,
+			Help: "Count of the messages dropped as duplicates of a recent message.",
+			Type: "counter",
+		},
+		{
+			Name:       DropsDueToInvalidPayload,
+			Help:       "Dropped messages due to invalid payloads.",
+			Type:       "counter",
+			LabelNames: []string{"reason"},
+		},
 		{
 			Name:       ModifiedWRPCounter,
 			Help:       "Number of times a WRP was modified by Caduceus",
@@ -95,6 +131,12 @@ func Metrics() []xmetrics.Metric {
 			Type:       "gauge",
 			LabelNames: []string{"url"},
 		},
+		{
+			Name:       RemovedWebhookCounter,
+			Help:       "Count of the webhooks removed, whose senders were retired.",
+			Type:       "counter",
+			LabelNames: []string{"url"},
+		},
 		{
 			Name:       IncomingEventTypeCounter,
 			Help:       "Incoming count of events by event type",
@@ -137,6 +179,71 @@ func Metrics() []xmetrics.Metric {
 			Type:       "gauge",
 			LabelNames: []string{"url"},
 		},
+		{
+			Name: QueuedMessagesGauge,
+			Help: "The number of messages queued across all the customers.",
+			Type: "gauge",
+		},
+		{
+			Name: QueuedBytesGauge,
+			Help: "The payload bytes of the messages queued across all the customers.",
+			Type: "gauge",
+		},
+		{
+			Name: OverBudgetRequestCounter,
+			Help: "Count of the requests rejected because too many messages are queued.",
+			Type: "counter",
+		},
+		{
+			Name:       SpilledMessageCounter,
+			Help:       "Count of the queued messages written to disk at the shutdown deadline.",
+			Type:       "counter",
+			LabelNames: []string{"url"},
+		},
+		{
+			Name:       RestoredMessageCounter,
+			Help:       "Count of the spilled messages queued again on start.",
+			Type:       "counter",
+			LabelNames: []string{"url"},
+		},
+		{
+			Name:       DeadLetterCounter,
+			Help:       "Count of the events that couldn't be delivered, kept as dead letters.",
+			Type:       "counter",
+			LabelNames: []string{"url"},
+		},
+		{
+			Name: DeadLettersGauge,
+			Help: "The number of dead letters kept across all the customers.",
+			Type: "gauge",
+		},
+		{
+			Name:       BatchDeliveryCounter,
+			Help:       "Count of the batches of events delivered, each also counted by delivery_count.",
+			Type:       "counter",
+			LabelNames: []string{"url", "code"},
+		},
+		{
+			Name:       CircuitBreakerStateGauge,
+			Help:       "The state of the circuit breaker of each URL of the customers: 0 closed, 1 half-open, 2 open.",
+			Type:       "gauge",
+			LabelNames: []string{"url", "endpoint"},
+		},
+		{
+			Name: WorkerPoolSizeGauge,
+			Help: "The number of delivery workers shared by all the customers.",
+			Type: "gauge",
+		},
+		{
+			Name: WorkerPoolBusyGauge,
+			Help: "The number of shared delivery workers delivering.",
+			Type: "gauge",
+		},
+		{
+			Name: WorkerPoolWaitingGauge,
+			Help: "The number of customers waiting for a shared delivery worker.",
+			Type: "gauge",
+		},
 	}
 }
 
@@ -152,6 +259,10 @@ func CreateOutbounderMetrics(m CaduceusMetricsRegistry, c *CaduceusOutboundSende
 	c.droppedCutoffCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.id, "reason", "cut_off")
 	c.droppedInvalidConfig = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.id, "reason", "invalid_config")
 	c.droppedNetworkErrCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.id, "reason", "network_err")
+	c.droppedPayloadTooLarge = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.id, "reason", "payload_too_large")
+	c.droppedShutdownCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.id, "reason", "shutdown")
+	c.droppedDurableQueueFullCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.id, "reason", "durable_queue_full")
+	c.droppedDurableQueueErrCounter = m.NewCounter(SlowConsumerDroppedMsgCounter).With("url", c.id, "reason", "durable_queue_error")
 	c.droppedPanic = m.NewCounter(DropsDueToPanic).With("url", c.id)
 	c.queueDepthGauge = m.NewGauge(OutgoingQueueDepth).With("url", c.id)
 	c.renewalTimeGauge = m.NewGauge(ConsumerRenewalTimeGauge).With("url", c.id)
@@ -159,4 +270,8 @@ func CreateOutbounderMetrics(m CaduceusMetricsRegistry, c *CaduceusOutboundSende
 	c.dropUntilGauge = m.NewGauge(ConsumerDropUntilGauge).With("url", c.id)
 	c.currentWorkersGauge = m.NewGauge(ConsumerDeliveryWorkersGauge).With("url", c.id)
 	c.maxWorkersGauge = m.NewGauge(ConsumerMaxDeliveryWorkersGauge).With("url", c.id)
+	c.spilledCounter = m.NewCounter(SpilledMessageCounter).With("url", c.id)
+	c.restoredCounter = m.NewCounter(RestoredMessageCounter).With("url", c.id)
+	c.breakerStateGauge = m.NewGauge(CircuitBreakerStateGauge).With("url", c.id)
+	c.batchDeliveryCounter = m.NewCounter(BatchDeliveryCounter)
 }
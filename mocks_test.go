@@ -47,6 +47,16 @@ func (m *mockSenderWrapper) Queue(msg *wrp.Message) {
 	m.Called(msg)
 }
 
+func (m *mockSenderWrapper) Match(msg *wrp.Message) []MatchResult {
+	arguments := m.Called(msg)
+	return arguments.Get(0).([]MatchResult)
+}
+
+func (m *mockSenderWrapper) Redeliver(webhook string, msg *wrp.Message) bool {
+	arguments := m.Called(webhook, msg)
+	return arguments.Bool(0)
+}
+
 func (m *mockSenderWrapper) Shutdown(gentle bool) {
 	m.Called(gentle)
 }
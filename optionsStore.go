@@ -0,0 +1,399 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+const defaultOptionsPullInterval = 5 * time.Second
+
+// WebhookOptionsConfig configures where the webhook options are stored.
+type WebhookOptionsConfig struct {
+	// Address is Argus' network location.  When empty, the options are only
+	// kept in memory by the instance that received the registration.
+	Address string
+
+	// Bucket is the partition name where the options are stored.
+	Bucket string
+
+	// Basic is the basic authentication header used with Argus.
+	// Must be of form: 'Basic xyz=='
+	Basic string
+
+	// PullInterval is how often the stored options are refreshed.
+	PullInterval time.Duration
+
+	// TTL is how long the options are stored after each registration.
+	// (Optional) defaults to the Argus default.
+	TTL time.Duration
+}
+
+// WebhookOptionsStore keeps the options of each webhook by its id.
+type WebhookOptionsStore interface {
+	// Get returns the options of the webhook, or the zero value if there are
+	// none.
+	Get(id string) WebhookOptions
+
+	// Put stores the options of the webhook.
+	Put(ctx context.Context, id string, options WebhookOptions) error
+
+	// Update applies the change to the options of the webhook as they are
+	// stored, not to a copy that may be stale, and stores the result.  The
+	// change may be applied again if the options were written meanwhile,
+	// and errOptionsChanged is returned if they kept being.  The error of
+	// the change is returned as is, and nothing is stored then.
+	Update(ctx context.Context, id string, change func(*WebhookOptions) error) error
+
+	// Registrations returns the ids of the webhooks whose registration is
+	// stored, in order.
+	Registrations() []string
+}
+
+// errOptionsChanged is returned when the options of a webhook changed while
+// being updated.
+var errOptionsChanged = errors.New("the webhook options changed meanwhile")
+
+// getWebhookOptions is a helper that tolerates a nil store.
+func getWebhookOptions(store WebhookOptionsStore, id string) WebhookOptions {
+	if nil == store {
+		return WebhookOptions{}
+	}
+	return store.Get(id)
+}
+
+type memoryOptionsStore struct {
+	mutex   sync.RWMutex
+	options map[string]WebhookOptions
+}
+
+func newMemoryOptionsStore() *memoryOptionsStore {
+	return &memoryOptionsStore{
+		options: make(map[string]WebhookOptions),
+	}
+}
+
+func (s *memoryOptionsStore) Get(id string) WebhookOptions {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.options[id]
+}
+
+func (s *memoryOptionsStore) Put(_ context.Context, id string, options WebhookOptions) error {
+	s.mutex.Lock()
+	s.options[id] = options
+	s.mutex.Unlock()
+	return nil
+}
+
+func (s *memoryOptionsStore) Update(_ context.Context, id string, change func(*WebhookOptions) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	options := s.options[id]
+	if err := change(&options); nil != err {
+		return err
+	}
+	s.options[id] = options
+	return nil
+}
+
+func (s *memoryOptionsStore) Registrations() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	var ids []string
+	for id, o := range s.options {
+		if nil != o.Registration {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (s *memoryOptionsStore) replace(options map[string]WebhookOptions) {
+	s.mutex.Lock()
+	s.options = options
+	s.mutex.Unlock()
+}
+
+// optionsItem is how the options of a webhook are stored in Argus.
+type optionsItem struct {
+	ID   string `json:"id"`
+	Data struct {
+		Webhook string         `json:"webhook"`
+		Options WebhookOptions `json:"options"`
+	} `json:"data"`
+	TTL *int64 `json:"ttl,omitempty"`
+}
+
+// argusOptionsStore stores the options in Argus so that every caduceus
+// instance sees them, and keeps a periodically refreshed copy in memory.
+type argusOptionsStore struct {
+	*memoryOptionsStore
+	client   *http.Client
+	itemsURL string
+	basic    string
+	ttl      time.Duration
+	logger   log.Logger
+	shutdown chan struct{}
+	wg       sync.WaitGroup
+
+	// updates serializes the updates made by this instance.
+	updates sync.Mutex
+}
+
+// NewWebhookOptionsStore creates the store described by the configuration.
+// The returned function stops any background activity of the store.
+func NewWebhookOptionsStore(c WebhookOptionsConfig, client *http.Client, logger log.Logger) (WebhookOptionsStore, func(), error) {
+	if "" == c.Address {
+		// Every instance only knows the options of the registrations it
+		// received, so the instances disagree as soon as there are several.
+		level.Warn(logger).Log(logging.MessageKey(), "Webhook options are only kept in memory, "+
+			"configure webhookOptions.address to share them when running more than one instance")
+		return newMemoryOptionsStore(), func() {}, nil
+	}
+
+	if "" == c.Bucket {
+		return nil, nil, errors.New("a bucket is required to store webhook options in Argus")
+	}
+
+	if nil == client {
+		client = http.DefaultClient
+	}
+
+	if c.PullInterval <= 0 {
+		c.PullInterval = defaultOptionsPullInterval
+	}
+
+	s := &argusOptionsStore{
+		memoryOptionsStore: newMemoryOptionsStore(),
+		client:             client,
+		itemsURL:           fmt.Sprintf("%s/api/v1/store/%s", strings.TrimSuffix(c.Address, "/"), c.Bucket),
+		basic:              c.Basic,
+		ttl:                c.TTL,
+		logger:             logger,
+		shutdown:           make(chan struct{}),
+	}
+
+	if err := s.refresh(); nil != err {
+		s.logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "Unable to load webhook options",
+			logging.ErrorKey(), err)
+	}
+
+	s.wg.Add(1)
+	go s.watch(c.PullInterval)
+
+	stop := func() {
+		close(s.shutdown)
+		s.wg.Wait()
+	}
+
+	return s, stop, nil
+}
+
+func (s *argusOptionsStore) Put(ctx context.Context, id string, options WebhookOptions) error {
+	var item optionsItem
+	item.ID = itemID(id)
+	item.Data.Webhook = id
+	item.Data.Options = options
+	if 0 < s.ttl {
+		ttl := int64(s.ttl.Seconds())
+		item.TTL = &ttl
+	}
+
+	body, err := json.Marshal(item)
+	if nil != err {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, s.itemsURL+"/"+item.ID, bytes.NewReader(body))
+	if nil != err {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	if "" != s.basic {
+		req.Header.Set("Authorization", s.basic)
+	}
+
+	resp, err := s.client.Do(req)
+	if nil != err {
+		return err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || 299 < resp.StatusCode {
+		return fmt.Errorf("unable to store webhook options, status code: %d", resp.StatusCode)
+	}
+
+	return s.memoryOptionsStore.Put(ctx, id, options)
+}
+
+// updateAttempts is how many times an update is applied to the options
+// stored in Argus before giving up on the other writers.
+const updateAttempts = 3
+
+// Update changes the options as stored in Argus rather than the copy in
+// memory, which is as old as the last refresh.  The updates of this instance
+// are serialized, but Argus has no conditional writes, so those of other
+// instances can't be excluded: the options are read back once stored, and the
+// change applied again to the options found if another instance wrote them
+// meanwhile.  A write of another instance landing between the read and the
+// write of an update is still lost, without either noticing.
+func (s *argusOptionsStore) Update(ctx context.Context, id string, change func(*WebhookOptions) error) error {
+	s.updates.Lock()
+	defer s.updates.Unlock()
+
+	options, err := s.fetch(ctx, id)
+	if nil != err {
+		return err
+	}
+	for i := 0; i < updateAttempts; i++ {
+		if err = change(&options); nil != err {
+			return err
+		}
+		if err = s.Put(ctx, id, options); nil != err {
+			return err
+		}
+
+		stored, err := s.fetch(ctx, id)
+		if nil != err {
+			return err
+		}
+		expected, _ := json.Marshal(options)
+		actual, _ := json.Marshal(stored)
+		if bytes.Equal(expected, actual) {
+			return nil
+		}
+		s.memoryOptionsStore.Put(ctx, id, stored)
+		options = stored
+	}
+	return errOptionsChanged
+}
+
+// fetch returns the options of the webhook stored in Argus, or the zero value
+// if there are none.
+func (s *argusOptionsStore) fetch(ctx context.Context, id string) (WebhookOptions, error) {
+	req, err := http.NewRequest(http.MethodGet, s.itemsURL+"/"+itemID(id), nil)
+	if nil != err {
+		return WebhookOptions{}, err
+	}
+	req = req.WithContext(ctx)
+	if "" != s.basic {
+		req.Header.Set("Authorization", s.basic)
+	}
+
+	resp, err := s.client.Do(req)
+	if nil != err {
+		return WebhookOptions{}, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		io.Copy(ioutil.Discard, resp.Body)
+		return WebhookOptions{}, nil
+	default:
+		io.Copy(ioutil.Discard, resp.Body)
+		return WebhookOptions{}, fmt.Errorf("unable to fetch webhook options, status code: %d", resp.StatusCode)
+	}
+
+	var item optionsItem
+	if err = json.NewDecoder(resp.Body).Decode(&item); nil != err {
+		return WebhookOptions{}, err
+	}
+	return item.Data.Options, nil
+}
+
+// refresh replaces the options in memory with the ones stored in Argus.
+func (s *argusOptionsStore) refresh() error {
+	req, err := http.NewRequest(http.MethodGet, s.itemsURL, nil)
+	if nil != err {
+		return err
+	}
+	if "" != s.basic {
+		req.Header.Set("Authorization", s.basic)
+	}
+
+	resp, err := s.client.Do(req)
+	if nil != err {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if http.StatusOK != resp.StatusCode {
+		io.Copy(ioutil.Discard, resp.Body)
+		return fmt.Errorf("unable to fetch webhook options, status code: %d", resp.StatusCode)
+	}
+
+	var items []optionsItem
+	if err = json.NewDecoder(resp.Body).Decode(&items); nil != err {
+		return err
+	}
+
+	options := make(map[string]WebhookOptions, len(items))
+	for _, item := range items {
+		options[item.Data.Webhook] = item.Data.Options
+	}
+	s.replace(options)
+
+	return nil
+}
+
+func (s *argusOptionsStore) watch(interval time.Duration) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.refresh(); nil != err {
+				s.logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "Unable to refresh webhook options",
+					logging.ErrorKey(), err)
+			}
+		case <-s.shutdown:
+			return
+		}
+	}
+}
+
+// itemID turns a webhook id into a valid Argus item id.
+func itemID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,341 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/ancla"
+)
+
+func TestMemoryOptionsStore(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newMemoryOptionsStore()
+	assert.Equal(WebhookOptions{}, store.Get("http://localhost/foo"))
+
+	assert.Nil(store.Put(context.Background(), "http://localhost/foo", WebhookOptions{MaxPayloadSize: 10}))
+	assert.Equal(WebhookOptions{MaxPayloadSize: 10}, store.Get("http://localhost/foo"))
+	assert.Equal(WebhookOptions{}, getWebhookOptions(nil, "http://localhost/foo"))
+
+	// The registrations of every owner are found.
+	r := &ancla.Webhook{Config: ancla.DeliveryConfig{URL: "http://localhost/foo"}}
+	store.Put(context.Background(), webhookID("b", r.Config.URL), WebhookOptions{Registration: r})
+	store.Put(context.Background(), webhookID("a", r.Config.URL), WebhookOptions{Registration: r})
+	store.Put(context.Background(), webhookID("a", "http://localhost/bar"), WebhookOptions{
+		Registration: &ancla.Webhook{Config: ancla.DeliveryConfig{URL: "http://localhost/bar"}},
+	})
+	assert.Equal([]string{
+		webhookID("a", "http://localhost/bar"),
+		webhookID("a", r.Config.URL),
+		webhookID("b", r.Config.URL),
+	}, store.Registrations())
+
+	// An update applies to the stored options, unless the change fails.
+	change := func(o *WebhookOptions) error {
+		o.MaxPayloadSize++
+		return nil
+	}
+	assert.Nil(store.Update(context.Background(), "http://localhost/foo", change))
+	assert.Equal(11, store.Get("http://localhost/foo").MaxPayloadSize)
+	assert.Equal(errOptionsChanged, store.Update(context.Background(), "http://localhost/foo", func(o *WebhookOptions) error {
+		o.MaxPayloadSize = 0
+		return errOptionsChanged
+	}))
+	assert.Equal(11, store.Get("http://localhost/foo").MaxPayloadSize)
+}
+
+func TestNewWebhookOptionsStore(t *testing.T) {
+	assert := assert.New(t)
+
+	store, stop, err := NewWebhookOptionsStore(WebhookOptionsConfig{}, nil, log.NewNopLogger())
+	assert.Nil(err)
+	assert.IsType(&memoryOptionsStore{}, store)
+	stop()
+
+	_, _, err = NewWebhookOptionsStore(WebhookOptionsConfig{Address: "http://localhost:6600"}, nil, log.NewNopLogger())
+	assert.NotNil(err)
+}
+
+// fakeArgus is an Argus bucket the options stores are tested against.
+type fakeArgus struct {
+	*httptest.Server
+	mutex sync.Mutex
+	items map[string]optionsItem
+	fail  bool
+
+	// onPut is called with the items once one is stored, as another instance
+	// writing right after.
+	onPut func(map[string]optionsItem)
+}
+
+func newFakeArgus() *fakeArgus {
+	a := &fakeArgus{items: map[string]optionsItem{}}
+	a.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.mutex.Lock()
+		defer a.mutex.Unlock()
+
+		if a.fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if "Basic xyz==" != r.Header.Get("Authorization") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPut:
+			var item optionsItem
+			body, _ := ioutil.ReadAll(r.Body)
+			if err := json.Unmarshal(body, &item); nil != err || !strings.HasSuffix(r.URL.Path, "/"+item.ID) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			a.items[item.ID] = item
+			if nil != a.onPut {
+				a.onPut(a.items)
+			}
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodGet:
+			if !strings.HasSuffix(r.URL.Path, "/webhook-options") {
+				item, ok := a.items[r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]]
+				if !ok {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				}
+				json.NewEncoder(w).Encode(item)
+				return
+			}
+			list := []optionsItem{}
+			for _, item := range a.items {
+				list = append(list, item)
+			}
+			json.NewEncoder(w).Encode(list)
+		}
+	}))
+	return a
+}
+
+func (a *fakeArgus) setFail(fail bool) {
+	a.mutex.Lock()
+	a.fail = fail
+	a.mutex.Unlock()
+}
+
+func (a *fakeArgus) config() WebhookOptionsConfig {
+	return WebhookOptionsConfig{
+		Address:      a.URL,
+		Bucket:       "webhook-options",
+		Basic:        "Basic xyz==",
+		PullInterval: 10 * time.Millisecond,
+		TTL:          time.Minute,
+	}
+}
+
+func TestArgusOptionsStore(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	argus := newFakeArgus()
+	defer argus.Close()
+	config := argus.config()
+
+	writer, stopWriter, err := NewWebhookOptionsStore(config, argus.Client(), log.NewNopLogger())
+	require.Nil(err)
+	defer stopWriter()
+
+	reader, stopReader, err := NewWebhookOptionsStore(config, argus.Client(), log.NewNopLogger())
+	require.Nil(err)
+	defer stopReader()
+
+	require.Nil(writer.Put(context.Background(), "http://localhost/foo", WebhookOptions{MaxPayloadSize: 10}))
+	assert.Equal(WebhookOptions{MaxPayloadSize: 10}, writer.Get("http://localhost/foo"))
+
+	argus.mutex.Lock()
+	stored := argus.items[itemID("http://localhost/foo")]
+	argus.mutex.Unlock()
+	require.NotNil(stored.TTL)
+	assert.Equal(int64(60), *stored.TTL)
+
+	// the other instance sees the options once it refreshes
+	assert.Eventually(func() bool {
+		return 10 == reader.Get("http://localhost/foo").MaxPayloadSize
+	}, time.Second, 10*time.Millisecond)
+
+	config.Basic = "Basic wrong=="
+	unauthorized, stop, err := NewWebhookOptionsStore(config, argus.Client(), log.NewNopLogger())
+	require.Nil(err)
+	defer stop()
+	assert.NotNil(unauthorized.Put(context.Background(), "http://localhost/foo", WebhookOptions{}))
+}
+
+// The options that couldn't be stored in Argus aren't kept, and the options
+// last refreshed are kept while Argus fails.
+func TestArgusOptionsStoreFailures(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	argus := newFakeArgus()
+	defer argus.Close()
+
+	store, stop, err := NewWebhookOptionsStore(argus.config(), argus.Client(), log.NewNopLogger())
+	require.Nil(err)
+	defer stop()
+
+	require.Nil(store.Put(context.Background(), "http://localhost/foo", WebhookOptions{MaxPayloadSize: 10}))
+
+	argus.setFail(true)
+	assert.NotNil(store.Put(context.Background(), "http://localhost/foo", WebhookOptions{MaxPayloadSize: 20}))
+	assert.NotNil(store.Put(context.Background(), "http://localhost/bar", WebhookOptions{MaxPayloadSize: 20}))
+
+	// Several refreshes fail meanwhile.
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(10, store.Get("http://localhost/foo").MaxPayloadSize)
+	assert.Equal(WebhookOptions{}, store.Get("http://localhost/bar"))
+
+	// An instance starting while Argus fails starts empty and catches up.
+	late, stopLate, err := NewWebhookOptionsStore(argus.config(), argus.Client(), log.NewNopLogger())
+	require.Nil(err)
+	defer stopLate()
+	assert.Equal(WebhookOptions{}, late.Get("http://localhost/foo"))
+
+	argus.setFail(false)
+	assert.Eventually(func() bool {
+		return 10 == late.Get("http://localhost/foo").MaxPayloadSize
+	}, time.Second, 10*time.Millisecond)
+}
+
+// The options in memory are as stale as the last refresh: the changes made by
+// other instances, removals included, only show once it happens.
+func TestArgusOptionsStoreStaleness(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	argus := newFakeArgus()
+	defer argus.Close()
+
+	config := argus.config()
+	config.PullInterval = time.Hour
+	store, stop, err := NewWebhookOptionsStore(config, argus.Client(), log.NewNopLogger())
+	require.Nil(err)
+	defer stop()
+	s := store.(*argusOptionsStore)
+
+	require.Nil(store.Put(context.Background(), "http://localhost/foo", WebhookOptions{MaxPayloadSize: 10}))
+
+	// Another instance changes the options of one webhook and the other
+	// expires.
+	argus.mutex.Lock()
+	item := argus.items[itemID("http://localhost/foo")]
+	item.Data.Options.MaxPayloadSize = 20
+	argus.items[item.ID] = item
+	var other optionsItem
+	other.ID = itemID("http://localhost/bar")
+	other.Data.Webhook = "http://localhost/bar"
+	other.Data.Options.MaxPayloadSize = 30
+	argus.items[other.ID] = other
+	argus.mutex.Unlock()
+
+	assert.Equal(10, store.Get("http://localhost/foo").MaxPayloadSize)
+	assert.Equal(WebhookOptions{}, store.Get("http://localhost/bar"))
+
+	require.Nil(s.refresh())
+	assert.Equal(20, store.Get("http://localhost/foo").MaxPayloadSize)
+	assert.Equal(30, store.Get("http://localhost/bar").MaxPayloadSize)
+
+	argus.mutex.Lock()
+	delete(argus.items, itemID("http://localhost/foo"))
+	argus.mutex.Unlock()
+
+	require.Nil(s.refresh())
+	assert.Equal(WebhookOptions{}, store.Get("http://localhost/foo"))
+}
+
+// An update changes the options as stored in Argus, and is applied again when
+// another instance wrote them meanwhile.
+func TestArgusOptionsStoreUpdate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	argus := newFakeArgus()
+	defer argus.Close()
+
+	config := argus.config()
+	config.PullInterval = time.Hour
+	store, stop, err := NewWebhookOptionsStore(config, argus.Client(), log.NewNopLogger())
+	require.Nil(err)
+	defer stop()
+
+	change := func(o *WebhookOptions) error {
+		o.MaxPayloadSize++
+		return nil
+	}
+	require.Nil(store.Update(context.Background(), "http://localhost/foo", change))
+	assert.Equal(1, store.Get("http://localhost/foo").MaxPayloadSize)
+
+	// The change applies to the options another instance stored, even
+	// before they are refreshed.
+	argus.mutex.Lock()
+	item := argus.items[itemID("http://localhost/foo")]
+	item.Data.Options.MaxPayloadSize = 10
+	argus.items[item.ID] = item
+	argus.mutex.Unlock()
+
+	require.Nil(store.Update(context.Background(), "http://localhost/foo", change))
+	assert.Equal(11, store.Get("http://localhost/foo").MaxPayloadSize)
+
+	// The change is applied again to the options another instance wrote
+	// meanwhile.
+	argus.mutex.Lock()
+	argus.onPut = func(items map[string]optionsItem) {
+		item := items[itemID("http://localhost/foo")]
+		item.Data.Options.MaxPayloadSize = 20
+		items[item.ID] = item
+		argus.onPut = nil
+	}
+	argus.mutex.Unlock()
+
+	require.Nil(store.Update(context.Background(), "http://localhost/foo", change))
+	assert.Equal(21, store.Get("http://localhost/foo").MaxPayloadSize)
+
+	// It gives up on another instance that keeps writing.
+	argus.mutex.Lock()
+	argus.onPut = func(items map[string]optionsItem) {
+		item := items[itemID("http://localhost/foo")]
+		item.Data.Options.MaxPayloadSize = 20
+		items[item.ID] = item
+	}
+	argus.mutex.Unlock()
+
+	assert.Equal(errOptionsChanged, store.Update(context.Background(), "http://localhost/foo", change))
+	assert.Equal(20, store.Get("http://localhost/foo").MaxPayloadSize)
+
+	argus.setFail(true)
+	assert.NotNil(store.Update(context.Background(), "http://localhost/foo", change))
+}
@@ -19,17 +19,18 @@ package main
 import (
 	"bytes"
 	"container/ring"
-	"crypto/hmac"
-	"crypto/sha1"
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"math/rand"
 	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -43,8 +44,6 @@ import (
 	"github.com/xmidt-org/ancla"
 	"github.com/xmidt-org/webpa-common/device"
 	"github.com/xmidt-org/webpa-common/logging"
-	"github.com/xmidt-org/webpa-common/semaphore"
-	"github.com/xmidt-org/webpa-common/xhttp"
 	"github.com/xmidt-org/wrp-go/v3"
 	"github.com/xmidt-org/wrp-go/v3/wrphttp"
 )
@@ -71,6 +70,11 @@ type OutboundSenderFactory struct {
 	// The WebHookListener to service
 	Listener ancla.Webhook
 
+	// The id of the webhook, keying its options and metrics.
+	// (Optional) defaults to the id of the webhook registered without an
+	// owner.
+	ID string
+
 	// The http client Do() function to use for outbound requests.
 	Sender func(*http.Request) (*http.Response, error)
 
@@ -99,19 +103,98 @@ type OutboundSenderFactory struct {
 
 	// The logger to use.
 	Logger log.Logger
+
+	// The trackers of messages waiting for their delivery.
+	DeliveryTrackers *deliveryTrackers
+
+	// The options of the webhooks that aren't part of the registration.
+	Options WebhookOptionsStore
+
+	// Whether only the events of the partners the webhook is bound to are
+	// delivered.
+	PartnerIsolation bool
+
+	// The pool of workers shared by all senders.  When nil, NumWorkers
+	// workers are created for this sender alone.
+	WorkerPool *workerPool
+
+	// The budget of the messages queued across all senders.
+	QueueBudget *queueBudget
+
+	// The bounds the webhook may set its own delivery settings within.
+	DeliveryBounds DeliveryBounds
+
+	// The directory the messages still queued at the shutdown deadline are
+	// written to, and queued again from by the next sender of the webhook.
+	// Empty disables spilling.
+	SpillDirectory string
+
+	// The durable queues of the webhooks opting in to them.  The config
+	// must have its defaults.
+	DurableQueue DurableQueueConfig
+
+	// The backoff between the delivery attempts of an event.
+	Backoff BackoffConfig
+
+	// The store of the events that couldn't be delivered.  When nil, they
+	// are only counted as dropped.
+	DeadLetters *deadLetterStore
+
+	// The circuit breakers of the URLs of the webhook.
+	CircuitBreaker CircuitBreakerConfig
+
+	// How the deliveries are signed, unless the webhook chose otherwise.
+	Signature SignatureConfig
 }
 
 type OutboundSender interface {
 	Update(ancla.Webhook) error
 	Shutdown(bool)
+	Spill()
+	Redeliver(*wrp.Message) bool
 	RetiredSince() time.Time
 	Queue(*wrp.Message)
+	Match(*wrp.Message) MatchResult
+}
+
+// MatchResult explains if and why a message would be delivered to a webhook.
+type MatchResult struct {
+	// Webhook is the id of the webhook.
+	Webhook string `json:"webhook"`
+
+	// Matched is true when the message would be queued for delivery.
+	Matched bool `json:"matched"`
+
+	// Events are the event regular expressions matching the destination.
+	Events []string `json:"events,omitempty"`
+
+	// DeviceID is the device id regular expression matching the source.
+	DeviceID string `json:"device_id,omitempty"`
+
+	// CutOff is true while the webhook is cut off for being too slow.
+	CutOff bool `json:"cut_off"`
+
+	// Expired is true when the registration of the webhook expired.
+	Expired bool `json:"expired"`
+
+	// PayloadTooLarge is true when the payload is larger than the webhook
+	// accepts.
+	PayloadTooLarge bool `json:"payload_too_large"`
+
+	// PartnerMismatch is true when the webhook isn't bound to any of the
+	// partners of the message.
+	PartnerMismatch bool `json:"partner_mismatch"`
+
+	// owner and partnerIDs are the owner of the webhook and the partners it
+	// is bound to, which decide who may see the result.
+	owner      string
+	partnerIDs []string
 }
 
 // CaduceusOutboundSender is the outbound sender object.
 type CaduceusOutboundSender struct {
 	id                               string
-	urls                             *ring.Ring
+	urls                             urlSelector
 	listener                         ancla.Webhook
 	deliverUntil                     time.Time
 	dropUntil                        time.Time
@@ -125,12 +208,16 @@ type CaduceusOutboundSender struct {
 	deliveryCounter                  metrics.Counter
 	deliveryRetryCounter             metrics.Counter
 	droppedQueueFullCounter          metrics.Counter
+	droppedDurableQueueFullCounter   metrics.Counter
+	droppedDurableQueueErrCounter    metrics.Counter
 	droppedCutoffCounter             metrics.Counter
 	droppedExpiredCounter            metrics.Counter
 	droppedExpiredBeforeQueueCounter metrics.Counter
 	droppedNetworkErrCounter         metrics.Counter
 	droppedInvalidConfig             metrics.Counter
 	droppedPanic                     metrics.Counter
+	droppedPayloadTooLarge           metrics.Counter
+	droppedShutdownCounter           metrics.Counter
 	cutOffCounter                    metrics.Counter
 	queueDepthGauge                  metrics.Gauge
 	renewalTimeGauge                 metrics.Gauge
@@ -141,12 +228,46 @@ type CaduceusOutboundSender struct {
 	deliveryRetryMaxGauge            metrics.Gauge
 	wg                               sync.WaitGroup
 	cutOffPeriod                     time.Duration
-	workers                          semaphore.Interface
+	workers                          deliveryWorkers
 	maxWorkers                       int
 	failureMsg                       FailureMessage
 	logger                           log.Logger
 	mutex                            sync.RWMutex
 	queue                            atomic.Value
+	deliveryTrackers                 *deliveryTrackers
+	options                          WebhookOptionsStore
+	maxPayloadSize                   int
+	partnerIsolation                 bool
+	partnerIDs                       []string
+	owner                            string
+	queueBudget                      *queueBudget
+	clientTimeout                    time.Duration
+	defaults                         deliverySettings
+	deliveryBounds                   DeliveryBounds
+	spillDirectory                   string
+	durableQueue                     DurableQueueConfig
+	backoff                          BackoffConfig
+	maxInterval                      time.Duration
+	log                              messageLog
+	deadLetters                      *deadLetterStore
+	breakers                         *urlBreakers
+	breakerStateGauge                metrics.Gauge
+	batchDeliveryCounter             metrics.Counter
+	signature                        SignatureConfig
+	signer                           signer
+	batchSize                        int
+	batchBytes                       int
+	batchLinger                      time.Duration
+	spilledCounter                   metrics.Counter
+	restoredCounter                  metrics.Counter
+
+	// abort interrupts the deliveries in flight when the sender runs out of
+	// time to shut down.  Their messages are kept in interrupted until they
+	// are spilled.
+	abortCtx         context.Context
+	abort            context.CancelFunc
+	interruptedMutex sync.Mutex
+	interrupted      []*wrp.Message
 }
 
 // New creates a new OutboundSender object from the factory, or returns an error.
@@ -171,7 +292,7 @@ func (osf OutboundSenderFactory) New() (obs OutboundSender, err error) {
 	}
 
 	caduceusOutboundSender := &CaduceusOutboundSender{
-		id:               osf.Listener.Config.URL,
+		id:               osf.ID,
 		listener:         osf.Listener,
 		sender:           osf.Sender,
 		queueSize:        osf.QueueSize,
@@ -182,6 +303,14 @@ func (osf OutboundSenderFactory) New() (obs OutboundSender, err error) {
 		deliveryInterval: osf.DeliveryInterval,
 		retryCodes:       osf.RetryCodes,
 		maxWorkers:       osf.NumWorkers,
+		deliveryTrackers: osf.DeliveryTrackers,
+		options:          osf.Options,
+		partnerIsolation: osf.PartnerIsolation,
+		queueBudget:      osf.QueueBudget,
+		deliveryBounds:   osf.DeliveryBounds,
+		spillDirectory:   osf.SpillDirectory,
+		durableQueue:     osf.DurableQueue,
+		deadLetters:      osf.DeadLetters,
 		failureMsg: FailureMessage{
 			Original:     osf.Listener,
 			Text:         failureText,
@@ -194,19 +323,65 @@ func (osf OutboundSenderFactory) New() (obs OutboundSender, err error) {
 	// Don't share the secret with others when there is an error.
 	caduceusOutboundSender.failureMsg.Original.Config.Secret = "XxxxxX"
 
+	if "" == caduceusOutboundSender.id {
+		caduceusOutboundSender.id = webhookID("", osf.Listener.Config.URL)
+	}
+	caduceusOutboundSender.abortCtx, caduceusOutboundSender.abort = context.WithCancel(context.Background())
+
+	if nil != osf.WorkerPool {
+		caduceusOutboundSender.maxWorkers = osf.WorkerPool.maxPerSender
+		caduceusOutboundSender.failureMsg.Workers = osf.WorkerPool.maxPerSender
+
+		// No sender gets more workers than the pool allows.
+		if osf.WorkerPool.maxPerSender < caduceusOutboundSender.deliveryBounds.MaxWorkers {
+			caduceusOutboundSender.deliveryBounds.MaxWorkers = osf.WorkerPool.maxPerSender
+		}
+	}
+
+	if caduceusOutboundSender.backoff, err = osf.Backoff.withDefaults(); nil != err {
+		return
+	}
+
+	if caduceusOutboundSender.signature, err = osf.Signature.withDefaults(); nil != err {
+		return
+	}
+
+	// The settings used unless the webhook has its own.
+	caduceusOutboundSender.defaults = deliverySettings{
+		retries:      osf.DeliveryRetries,
+		interval:     osf.DeliveryInterval,
+		queueSize:    osf.QueueSize,
+		maxWorkers:   caduceusOutboundSender.maxWorkers,
+		cutOffPeriod: osf.CutOffPeriod,
+		maxInterval:  caduceusOutboundSender.backoff.MaxInterval,
+	}
+
 	CreateOutbounderMetrics(osf.MetricsRegistry, caduceusOutboundSender)
 
+	breaker, err := osf.CircuitBreaker.withDefaults()
+	if nil != err {
+		return
+	}
+	caduceusOutboundSender.breakers = newURLBreakers(caduceusOutboundSender.id, breaker,
+		caduceusOutboundSender.breakerStateGauge, osf.Logger)
+
 	// update queue depth and current workers gauge to make sure they start at 0
 	caduceusOutboundSender.queueDepthGauge.Set(0)
 	caduceusOutboundSender.currentWorkersGauge.Set(0)
 
 	caduceusOutboundSender.queue.Store(make(chan *wrp.Message, osf.QueueSize))
 
+	if nil != osf.WorkerPool {
+		// The share of the webhook is set by its options in Update.
+		caduceusOutboundSender.workers = osf.WorkerPool.workers(1)
+	} else {
+		caduceusOutboundSender.workers = newSemaphoreWorkers(caduceusOutboundSender.maxWorkers)
+	}
+
 	if err = caduceusOutboundSender.Update(osf.Listener); nil != err {
 		return
 	}
-
-	caduceusOutboundSender.workers = semaphore.New(caduceusOutboundSender.maxWorkers)
+	caduceusOutboundSender.restore()
 	caduceusOutboundSender.wg.Add(1)
 	go caduceusOutboundSender.dispatcher()
 
@@ -269,6 +444,9 @@ func (obs *CaduceusOutboundSender) Update(wh ancla.Webhook) (err error) {
 		}
 	}
 
+	options := getWebhookOptions(obs.options, obs.id)
+	settings := obs.deliveryBounds.apply(obs.defaults, options)
+
 	obs.renewalTimeGauge.Set(float64(time.Now().Unix()))
 
 	// write/update obs
@@ -284,7 +462,51 @@ func (obs *CaduceusOutboundSender) Update(wh ancla.Webhook) (err error) {
 	obs.deliverUntil = wh.Until
 	obs.deliverUntilGauge.Set(float64(obs.deliverUntil.Unix()))
 
+	obs.signer = signer{
+		secret:    wh.Config.Secret,
+		algorithm: obs.signature.Algorithm,
+		rotation:  options.SecretRotation,
+		legacy:    !obs.signature.DisableLegacy,
+	}
+	if nil != options.LegacySignature {
+		obs.signer.legacy = *options.LegacySignature
+	}
+	if "" != options.SignatureAlgorithm && nil == validateSignatureAlgorithm(options.SignatureAlgorithm) {
+		obs.signer.algorithm = options.SignatureAlgorithm
+	}
+
 	obs.events = events
+	obs.maxPayloadSize = options.MaxPayloadSize
+	obs.partnerIDs = options.PartnerIDs
+	obs.owner = options.Owner
+
+	obs.deliveryRetries = settings.retries
+	obs.deliveryInterval = settings.interval
+	obs.cutOffPeriod = settings.cutOffPeriod
+	obs.clientTimeout = settings.clientTimeout
+	obs.maxInterval = settings.maxInterval
+	obs.batchSize = settings.batchSize
+	obs.batchBytes = settings.batchBytes
+	obs.batchLinger = settings.batchLinger
+	obs.failureMsg.CutOffPeriod = settings.cutOffPeriod.String()
+
+	if settings.queueSize != obs.queueSize {
+		obs.resizeQueue(settings.queueSize)
+	}
+	obs.failureMsg.QueueSize = settings.queueSize
+
+	if options.DurableQueue && obs.durableQueue.enabled() && nil == obs.log {
+		obs.openLog()
+	} else if !options.DurableQueue && nil != obs.log {
+		// The messages already queued are still delivered, just no longer
+		// durably.
+		obs.log.Remove()
+		obs.log = nil
+	}
+
+	obs.maxWorkers = settings.maxWorkers
+	obs.workers.resize(settings.minWorkers, settings.maxWorkers, settings.weight)
+	obs.failureMsg.Workers = settings.maxWorkers
 
 	obs.deliveryRetryMaxGauge.Set(float64(obs.deliveryRetries))
 
@@ -294,25 +516,12 @@ func (obs *CaduceusOutboundSender) Update(wh ancla.Webhook) (err error) {
 		obs.matcher = matcher
 	}
 
+	urls := wh.Config.AlternativeURLs
 	if 0 == urlCount {
-		obs.urls = ring.New(1)
-		obs.urls.Value = obs.id
-	} else {
-		r := ring.New(urlCount)
-		for i := 0; i < urlCount; i++ {
-			r.Value = wh.Config.AlternativeURLs[i]
-			r = r.Next()
-		}
-		obs.urls = r
-	}
-
-	// Randomize where we start so all the instances don't synchronize
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	offset := r.Intn(obs.urls.Len())
-	for 0 < offset {
-		obs.urls = obs.urls.Next()
-		offset--
+		urls = []string{wh.Config.URL}
 	}
+	obs.breakers.update(urls)
+	obs.urls = newURLSelector(options.URLStrategy, options.URLWeights, urls)
 
 	// Update this here in case we make this configurable later
 	obs.maxWorkersGauge.Set(float64(obs.maxWorkers))
@@ -336,12 +545,169 @@ func (obs *CaduceusOutboundSender) Shutdown(gentle bool) {
 	obs.wg.Wait()
 
 	obs.mutex.Lock()
+	if nil != obs.log {
+		obs.log.Close()
+		obs.log = nil
+	}
 	obs.deliverUntil = time.Time{}
 	obs.deliverUntilGauge.Set(float64(obs.deliverUntil.Unix()))
 	obs.queueDepthGauge.Set(0) //just in case
 	obs.mutex.Unlock()
 }
 
+// webhookFileName is the name of the files of the webhook.  The id is hashed
+// since it isn't a valid file name.
+func webhookFileName(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// spillFile is the file the messages of the webhook are spilled to.
+func spillFile(dir, id string) string {
+	return filepath.Join(dir, webhookFileName(id)+".spill")
+}
+
+// Spill writes the messages not yet delivered to the spill directory, so the
+// next sender of the webhook delivers them instead of them being lost when
+// caduceus exits.  It is meant for senders shutting down that ran out of
+// time: the deliveries in flight are interrupted and their messages are
+// spilled along with the queued ones.  Spill returns once the sender stopped.
+func (obs *CaduceusOutboundSender) Spill() {
+	obs.abort()
+
+	// The queue is being closed by Shutdown, so the dispatcher isn't woken
+	// up the way drainQueue does.
+	var msgs []*wrp.Message
+	queue := obs.queue.Load().(chan *wrp.Message)
+Drain:
+	for {
+		select {
+		case msg, ok := <-queue:
+			if !ok {
+				break Drain
+			}
+			if nil != msg {
+				obs.queueDepthGauge.Add(-1.0)
+				obs.queueBudget.dequeued(len(msg.Payload))
+				msgs = append(msgs, msg)
+			}
+		default:
+			break Drain
+		}
+	}
+
+	// The workers see the abort, so they don't keep the sender for long.
+	obs.wg.Wait()
+	obs.interruptedMutex.Lock()
+	msgs = append(msgs, obs.interrupted...)
+	obs.interrupted = nil
+	obs.interruptedMutex.Unlock()
+
+	obs.mutex.RLock()
+	durable := nil != obs.log
+	obs.mutex.RUnlock()
+
+	// The messages of a durable queue are on disk already, since the
+	// interrupted ones were never acknowledged.
+	if 0 == len(msgs) || durable {
+		return
+	}
+
+	reason := "spilled"
+	err := errors.New("no spill directory")
+	if "" != obs.spillDirectory {
+		err = writeSpillFile(spillFile(obs.spillDirectory, obs.id), msgs)
+	}
+	if nil != err {
+		reason = "shutdown"
+		obs.droppedShutdownCounter.Add(float64(len(msgs)))
+		level.Error(obs.logger).Log(logging.MessageKey(), "Failed to spill the undelivered messages, dropping them.",
+			"url", obs.id, "count", len(msgs), logging.ErrorKey(), err)
+	} else {
+		obs.spilledCounter.Add(float64(len(msgs)))
+		level.Info(obs.logger).Log(logging.MessageKey(), "Spilled the undelivered messages.",
+			"url", obs.id, "count", len(msgs))
+	}
+	for _, msg := range msgs {
+		obs.deliveryTrackers.get(msg).dropped(obs.id, reason)
+	}
+}
+
+// writeSpillFile writes the messages to a temporary file first, so a partly
+// written file is never restored.
+func writeSpillFile(name string, msgs []*wrp.Message) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".*")
+	if nil != err {
+		return err
+	}
+
+	encoder := wrp.NewEncoder(f, wrp.Msgpack)
+	for _, msg := range msgs {
+		if err = encoder.Encode(msg); nil != err {
+			break
+		}
+	}
+	if closeErr := f.Close(); nil == err {
+		err = closeErr
+	}
+	if nil == err {
+		err = os.Rename(f.Name(), name)
+	}
+	if nil != err {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// restore queues the messages spilled by the previous sender of the webhook
+// again.  The messages that no longer fit are dropped.
+func (obs *CaduceusOutboundSender) restore() {
+	if "" == obs.spillDirectory {
+		return
+	}
+
+	name := spillFile(obs.spillDirectory, obs.id)
+	f, err := os.Open(name)
+	if nil != err {
+		if !os.IsNotExist(err) {
+			level.Error(obs.logger).Log(logging.MessageKey(), "Failed to open the spilled messages.",
+				"url", obs.id, logging.ErrorKey(), err)
+		}
+		return
+	}
+	defer func() {
+		f.Close()
+		os.Remove(name)
+	}()
+
+	queue := obs.queue.Load().(chan *wrp.Message)
+	decoder := wrp.NewDecoder(f, wrp.Msgpack)
+	restored := 0
+	for {
+		msg := new(wrp.Message)
+		if err = decoder.Decode(msg); nil != err {
+			break
+		}
+
+		select {
+		case queue <- msg:
+			obs.queueDepthGauge.Add(1.0)
+			obs.queueBudget.queued(len(msg.Payload))
+			restored++
+		default:
+			obs.droppedQueueFullCounter.Add(1.0)
+		}
+	}
+	if io.EOF != err {
+		level.Error(obs.logger).Log(logging.MessageKey(), "Failed to read the spilled messages.",
+			"url", obs.id, logging.ErrorKey(), err)
+	}
+
+	obs.restoredCounter.Add(float64(restored))
+	level.Info(obs.logger).Log(logging.MessageKey(), "Restored the spilled messages.",
+		"url", obs.id, "count", restored)
+}
+
 // RetiredSince returns the time the CaduceusOutboundSender retired (which could be in
 // the future).
 func (obs *CaduceusOutboundSender) RetiredSince() time.Time {
@@ -360,8 +726,15 @@ func (obs *CaduceusOutboundSender) Queue(msg *wrp.Message) {
 	dropUntil := obs.dropUntil
 	events := obs.events
 	matcher := obs.matcher
+	maxPayloadSize := obs.maxPayloadSize
+	partnerIDs := obs.partnerIDs
 	obs.mutex.RUnlock()
 
+	// Events of other partners are none of the webhook's business.
+	if obs.partnerIsolation && !partnersIntersect(partnerIDs, msg.PartnerIDs) {
+		return
+	}
+
 	now := time.Now()
 
 	if !obs.isValidTimeWindow(now, dropUntil, deliverUntil) {
@@ -406,25 +779,79 @@ func (obs *CaduceusOutboundSender) Queue(msg *wrp.Message) {
 			 }
 		*/
 		if matchDevice {
-			select {
-			case obs.queue.Load().(chan *wrp.Message) <- msg:
-				obs.queueDepthGauge.Add(1.0)
-			default:
+			tracker := obs.deliveryTrackers.get(msg)
+			tracker.matched(obs.id)
+			if 0 < maxPayloadSize && maxPayloadSize < len(msg.Payload) {
+				obs.droppedPayloadTooLarge.Add(1.0)
+				tracker.dropped(obs.id, "payload_too_large")
+			} else if err := obs.enqueue(msg); errQueueFull == err {
 				obs.queueOverflow()
 				obs.droppedQueueFullCounter.Add(1.0)
+				tracker.dropped(obs.id, "queue_full")
+			} else if errLogFull == err {
+				// The disk cap of the durable queue was reached, which
+				// doesn't make the webhook a slow consumer to cut off.
+				obs.droppedDurableQueueFullCounter.Add(1.0)
+				tracker.dropped(obs.id, "durable_queue_full")
+			} else if nil != err {
+				level.Error(obs.logger).Log(logging.MessageKey(), "Failed to write to the durable queue.",
+					"url", obs.id, logging.ErrorKey(), err)
+				obs.droppedDurableQueueErrCounter.Add(1.0)
+				tracker.dropped(obs.id, "durable_queue_error")
 			}
 		}
 	}
 }
 
+// enqueue puts the message on the queue.  Unless the message is queued, the
+// error of the durable queue or errQueueFull is returned.
+func (obs *CaduceusOutboundSender) enqueue(msg *wrp.Message) error {
+	// The queue isn't replaced while a message is put on it, so the message
+	// can't be left behind in a replaced queue.
+	var err error
+	obs.mutex.RLock()
+	if nil != obs.log {
+		err = obs.log.Append(msg)
+	}
+	if nil == err {
+		select {
+		case obs.queue.Load().(chan *wrp.Message) <- msg:
+		default:
+			obs.ack(msg)
+			err = errQueueFull
+		}
+	}
+	obs.mutex.RUnlock()
+
+	if nil == err {
+		obs.queueDepthGauge.Add(1.0)
+		obs.queueBudget.queued(len(msg.Payload))
+	}
+	return err
+}
+
+// Redeliver queues a message that couldn't be delivered before again,
+// reporting if it was queued.  The message isn't matched again.
+func (obs *CaduceusOutboundSender) Redeliver(msg *wrp.Message) bool {
+	obs.mutex.RLock()
+	deliverUntil := obs.deliverUntil
+	obs.mutex.RUnlock()
+
+	if time.Now().After(deliverUntil) {
+		return false
+	}
+	return nil == obs.enqueue(msg)
+}
+
 func (obs *CaduceusOutboundSender) isValidTimeWindow(now, dropUntil, deliverUntil time.Time) bool {
-	if !now.After(dropUntil) {
+	cutOff, expired := timeWindowState(now, dropUntil, deliverUntil)
+	if cutOff {
 		// client was cut off
 		obs.droppedCutoffCounter.Add(1.0)
 		return false
 	}
 
-	if !now.Before(deliverUntil) {
+	if expired {
 		// outside delivery window
 		obs.droppedExpiredBeforeQueueCounter.Add(1.0)
 		return false
@@ -433,24 +860,174 @@ func (obs *CaduceusOutboundSender) isValidTimeWindow(now, dropUntil, deliverUnti
 	return true
 }
 
+// timeWindowState reports if the sender is cut off or past its delivery
+// window at the given time.
+func timeWindowState(now, dropUntil, deliverUntil time.Time) (cutOff bool, expired bool) {
+	if !now.After(dropUntil) {
+		return true, false
+	}
+
+	return false, !now.Before(deliverUntil)
+}
+
+// Match explains if and why the message would be queued, without queueing it
+// or counting anything.
+func (obs *CaduceusOutboundSender) Match(msg *wrp.Message) MatchResult {
+	obs.mutex.RLock()
+	deliverUntil := obs.deliverUntil
+	dropUntil := obs.dropUntil
+	events := obs.events
+	matcher := obs.matcher
+	maxPayloadSize := obs.maxPayloadSize
+	partnerIDs := obs.partnerIDs
+	owner := obs.owner
+	obs.mutex.RUnlock()
+
+	result := MatchResult{Webhook: obs.id, owner: owner, partnerIDs: partnerIDs}
+	result.CutOff, result.Expired = timeWindowState(time.Now(), dropUntil, deliverUntil)
+	result.PayloadTooLarge = 0 < maxPayloadSize && maxPayloadSize < len(msg.Payload)
+	result.PartnerMismatch = obs.partnerIsolation && !partnersIntersect(partnerIDs, msg.PartnerIDs)
+
+	for _, eventRegex := range events {
+		if eventRegex.MatchString(strings.TrimPrefix(msg.Destination, "event:")) {
+			result.Events = append(result.Events, eventRegex.String())
+		}
+	}
+
+	if nil == matcher {
+		result.DeviceID = ".*"
+	}
+	for _, deviceRegex := range matcher {
+		if deviceRegex.MatchString(msg.Source) {
+			result.DeviceID = deviceRegex.String()
+			break
+		}
+	}
+
+	result.Matched = 0 < len(result.Events) && "" != result.DeviceID &&
+		!result.CutOff && !result.Expired && !result.PayloadTooLarge && !result.PartnerMismatch
+
+	return result
+}
+
 // Empty is called on cutoff or shutdown and swaps out the current queue for
 // a fresh one, counting any current messages in the queue as dropped.
 // It should never close a queue, as a queue not referenced anywhere will be
 // cleaned up by the garbage collector without needing to be closed.
 func (obs *CaduceusOutboundSender) Empty(droppedCounter metrics.Counter) {
+	obs.mutex.Lock()
 	droppedMsgs := obs.queue.Load().(chan *wrp.Message)
 	obs.queue.Store(make(chan *wrp.Message, obs.queueSize))
-	droppedCounter.Add(float64(len(droppedMsgs)))
+	obs.mutex.Unlock()
+
+	// The dropped messages are taken out so the budget they use is given
+	// back.  The dispatcher may still take some of them first.
+	dropped := drainQueue(droppedMsgs)
+	obs.mutex.RLock()
+	for _, msg := range dropped {
+		obs.queueBudget.dequeued(len(msg.Payload))
+		obs.ack(msg)
+	}
+	obs.mutex.RUnlock()
+	droppedCounter.Add(float64(len(dropped)))
 	obs.queueDepthGauge.Set(0.0)
 }
 
+// resizeQueue replaces the queue with one of the size holding the messages
+// of the old one, dropping those that don't fit.  The mutex must be held.
+func (obs *CaduceusOutboundSender) resizeQueue(size int) {
+	old := obs.queue.Load().(chan *wrp.Message)
+	queue := make(chan *wrp.Message, size)
+	obs.queue.Store(queue)
+	obs.queueSize = size
+
+	for _, msg := range drainQueue(old) {
+		select {
+		case queue <- msg:
+		default:
+			obs.queueDepthGauge.Add(-1.0)
+			obs.queueBudget.dequeued(len(msg.Payload))
+			obs.ack(msg)
+			obs.droppedQueueFullCounter.Add(1.0)
+			obs.deliveryTrackers.get(msg).dropped(obs.id, "queue_full")
+		}
+	}
+}
+
+// openLog opens the durable queue of the webhook, queueing the messages
+// pending in it again.  Those that no longer fit are dropped.  The mutex must
+// be held.
+func (obs *CaduceusOutboundSender) openLog() {
+	dir := filepath.Join(obs.durableQueue.Directory, webhookFileName(obs.id))
+	l, msgs, err := openSegmentLog(dir, obs.durableQueue)
+	if nil != err {
+		level.Error(obs.logger).Log(logging.MessageKey(), "Failed to open the durable queue.",
+			"url", obs.id, logging.ErrorKey(), err)
+		return
+	}
+	obs.log = l
+
+	queue := obs.queue.Load().(chan *wrp.Message)
+	recovered := 0
+	for _, msg := range msgs {
+		select {
+		case queue <- msg:
+			obs.queueDepthGauge.Add(1.0)
+			obs.queueBudget.queued(len(msg.Payload))
+			recovered++
+		default:
+			obs.ack(msg)
+			obs.droppedQueueFullCounter.Add(1.0)
+		}
+	}
+	obs.restoredCounter.Add(float64(recovered))
+	if 0 < recovered {
+		level.Info(obs.logger).Log(logging.MessageKey(), "Recovered the messages of the durable queue.",
+			"url", obs.id, "count", recovered)
+	}
+}
+
+// ack acknowledges the message is done with to the durable queue, if any.
+// The mutex must be held, at least for reading.
+func (obs *CaduceusOutboundSender) ack(msg *wrp.Message) {
+	if nil != obs.log {
+		obs.log.Ack(msg)
+	}
+}
+
+// drainQueue takes the messages out of a queue that was replaced.  The
+// dispatcher may be waiting on the replaced queue, so it is woken up to pick
+// up the new one.
+func drainQueue(queue chan *wrp.Message) []*wrp.Message {
+	var msgs []*wrp.Message
+	for {
+		select {
+		case msg, ok := <-queue:
+			if !ok {
+				return msgs
+			}
+			if nil != msg {
+				msgs = append(msgs, msg)
+			}
+		default:
+			// The queue isn't closed, so the wake up can be sent.
+			select {
+			case queue <- nil:
+			default:
+			}
+			return msgs
+		}
+	}
+}
+
 func (obs *CaduceusOutboundSender) dispatcher() {
 	defer obs.wg.Done()
 	var (
-		msg            *wrp.Message
-		urls           *ring.Ring
-		secret, accept string
-		ok             bool
+		msg      *wrp.Message
+		selector urlSelector
+		sign     signer
+		accept   string
+		ok       bool
 	)
 
 Loop:
@@ -483,61 +1060,199 @@ Loop:
 			if !ok {
 				break Loop
 			}
-			obs.queueDepthGauge.Add(-1.0)
-			obs.mutex.RLock()
-			urls = obs.urls
-			// Move to the next URL to try 1st the next time.
-			// This is okay because we run a single dispatcher and it's the
-			// only one updating this field.
-			obs.urls = obs.urls.Next()
-			deliverUntil := obs.deliverUntil
-			dropUntil := obs.dropUntil
-			secret = obs.listener.Config.Secret
-			accept = obs.listener.Config.ContentType
-			obs.mutex.RUnlock()
-
-			now := time.Now()
-
-			if now.Before(dropUntil) {
-				obs.droppedCutoffCounter.Add(1.0)
-				continue
-			}
-			if now.After(deliverUntil) {
-				obs.Empty(obs.droppedExpiredCounter)
+			// The queue was replaced, so take the new one.
+			if nil == msg || !obs.take(msg) {
 				continue
 			}
-			obs.workers.Acquire()
-			obs.currentWorkersGauge.Add(1.0)
 
-			go obs.send(urls, secret, accept, msg)
+			closed := false
+			for nil != msg {
+				obs.mutex.RLock()
+				selector = obs.urls
+				sign = obs.signer
+				accept = obs.listener.Config.ContentType
+				settings := deliverySettings{
+					retries:       obs.deliveryRetries,
+					interval:      obs.deliveryInterval,
+					clientTimeout: obs.clientTimeout,
+					maxInterval:   obs.maxInterval,
+					batchSize:     obs.batchSize,
+					batchBytes:    obs.batchBytes,
+					batchLinger:   obs.batchLinger,
+				}
+				obs.mutex.RUnlock()
+
+				// The message that didn't fit in the batch starts the next
+				// one.
+				batch := []*wrp.Message{msg}
+				msg = nil
+				if 1 < settings.batchSize {
+					batch, msg, closed = obs.fillBatch(msgQueue, batch, settings)
+				}
+
+				// Pick the URL to try 1st for each message, skipping the URLs
+				// known to be unhealthy, and deliver the messages going to
+				// the same URL together.  This is okay because we run a
+				// single dispatcher and it's the only one picking URLs.
+				for _, group := range groupByURL(selector, batch) {
+					urls := obs.breakers.pick(group.urls, time.Now())
+
+					obs.workers.Acquire()
+					obs.currentWorkersGauge.Add(1.0)
+
+					go obs.send(urls, sign, accept, settings, group.msgs)
+				}
+			}
+			if closed {
+				break Loop
+			}
 		}
 	}
-	for i := 0; i < obs.maxWorkers; i++ {
-		obs.workers.Acquire()
+	obs.workers.Wait()
+}
+
+// take accounts for the message leaving the queue, reporting if it is
+// delivered.  The messages of webhooks cut off or expired are dropped.
+func (obs *CaduceusOutboundSender) take(msg *wrp.Message) bool {
+	obs.queueDepthGauge.Add(-1.0)
+	obs.queueBudget.dequeued(len(msg.Payload))
+
+	obs.mutex.RLock()
+	deliverUntil := obs.deliverUntil
+	dropUntil := obs.dropUntil
+	obs.mutex.RUnlock()
+
+	now := time.Now()
+
+	if now.Before(dropUntil) || now.After(deliverUntil) {
+		// The message is dropped, so it isn't kept for later.
+		obs.mutex.RLock()
+		obs.ack(msg)
+		obs.mutex.RUnlock()
 	}
+
+	if now.Before(dropUntil) {
+		obs.droppedCutoffCounter.Add(1.0)
+		obs.deliveryTrackers.get(msg).dropped(obs.id, "cut_off")
+		return false
+	}
+	if now.After(deliverUntil) {
+		obs.Empty(obs.droppedExpiredCounter)
+		obs.deliveryTrackers.get(msg).dropped(obs.id, "expired")
+		return false
+	}
+	return true
+}
+
+// fillBatch adds the messages queued to the batch until it is full, its
+// linger time is over or the queue is closed, which is reported.  The message
+// that would make the batch too large is returned to start the next one.
+func (obs *CaduceusOutboundSender) fillBatch(queue chan *wrp.Message, batch []*wrp.Message, settings deliverySettings) ([]*wrp.Message, *wrp.Message, bool) {
+	size := 0
+	for _, msg := range batch {
+		size += len(msg.Payload)
+	}
+
+	// Without a linger time, only the messages already queued are added.
+	var linger <-chan time.Time
+	if 0 < settings.batchLinger {
+		timer := time.NewTimer(settings.batchLinger)
+		defer timer.Stop()
+		linger = timer.C
+	}
+
+	for len(batch) < settings.batchSize {
+		var (
+			msg *wrp.Message
+			ok  bool
+		)
+		if nil == linger {
+			select {
+			case msg, ok = <-queue:
+			default:
+				return batch, nil, false
+			}
+		} else {
+			select {
+			case msg, ok = <-queue:
+			case <-linger:
+				return batch, nil, false
+			}
+		}
+
+		if !ok {
+			return batch, nil, true
+		}
+		// The queue was replaced, the dispatcher takes the new one.
+		if nil == msg {
+			return batch, nil, false
+		}
+		if !obs.take(msg) {
+			continue
+		}
+		if 0 < settings.batchBytes && settings.batchBytes < size+len(msg.Payload) {
+			return batch, msg, false
+		}
+		batch = append(batch, msg)
+		size += len(msg.Payload)
+	}
+	return batch, nil, false
 }
 
 // worker is the routine that actually takes the queued messages and delivers
-// them to the listeners outside webpa
-func (obs *CaduceusOutboundSender) send(urls *ring.Ring, secret, acceptType string, msg *wrp.Message) {
+// them to the listeners outside webpa.  The messages of a webhook batching
+// its deliveries are delivered together, as an array.
+func (obs *CaduceusOutboundSender) send(urls *ring.Ring, sign signer, acceptType string, settings deliverySettings, msgs []*wrp.Message) {
+	// Report the outcome of the delivery to anyone waiting on it.
+	trackers := make([]*deliveryTracker, len(msgs))
+	for i, msg := range msgs {
+		trackers[i] = obs.deliveryTrackers.get(msg)
+	}
+	status, dropReason := 0, "panic"
+	interrupted := false
+
 	defer func() {
 		if r := recover(); nil != r {
-			obs.droppedPanic.Add(1.0)
+			obs.droppedPanic.Add(float64(len(msgs)))
 			obs.logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "goroutine send() panicked",
 				"id", obs.id, "panic", r)
 		}
+		if interrupted {
+			// Spill reports the messages and keeps them for later.
+			obs.workers.Release()
+			obs.currentWorkersGauge.Add(-1.0)
+			return
+		}
+		for _, tracker := range trackers {
+			if 0 != status {
+				tracker.delivered(obs.id, status)
+			} else {
+				tracker.dropped(obs.id, dropReason)
+			}
+		}
+		obs.mutex.RLock()
+		for _, msg := range msgs {
+			obs.ack(msg)
+		}
+		obs.mutex.RUnlock()
 		obs.workers.Release()
 		obs.currentWorkersGauge.Add(-1.0)
 	}()
 
+	batched := 1 < settings.batchSize
+	msg := msgs[0]
 	payload := msg.Payload
 	body := payload
 	var payloadReader *bytes.Reader
 
 	// Use the internal content type unless the accept type is wrp
 	contentType := msg.ContentType
-	switch acceptType {
-	case "wrp", wrp.MimeTypeMsgpack, wrp.MimeTypeWrp:
+	switch {
+	case batched:
+		// A batch is an array of WRP messages, in msgpack if the webhook
+		// accepts wrp and otherwise in JSON.
+		contentType, body = encodeBatch(acceptType, msgs)
+	case "wrp" == acceptType, wrp.MimeTypeMsgpack == acceptType, wrp.MimeTypeWrp == acceptType:
 		// WTS - We should pass the original, raw WRP event instead of
 		// re-encoding it.
 		contentType = wrp.MimeTypeMsgpack
@@ -551,46 +1266,53 @@ func (obs *CaduceusOutboundSender) send(urls *ring.Ring, secret, acceptType stri
 	req, err := http.NewRequest("POST", urls.Value.(string), payloadReader)
 	if nil != err {
 		// Report drop
-		obs.droppedInvalidConfig.Add(1.0)
+		obs.droppedInvalidConfig.Add(float64(len(msgs)))
 		obs.logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "Invalid URL",
 			"url", urls.Value.(string), "id", obs.id, logging.ErrorKey(), err)
+		dropReason = "invalid_config"
+		for _, msg := range msgs {
+			obs.deadLetter(msg, dropReason, 0, err, nil)
+		}
 		return
 	}
 
+	req = req.WithContext(obs.abortCtx)
 	req.Header.Set("Content-Type", contentType)
 
-	// Add x-Midt-* headers
-	wrphttp.AddMessageHeaders(req.Header, msg)
-
-	// Provide the old headers for now
-	req.Header.Set("X-Webpa-Event", strings.TrimPrefix(msg.Destination, "event:"))
-	req.Header.Set("X-Webpa-Transaction-Id", msg.TransactionUUID)
+	// find the event "short name"
+	event := msg.FindEventStringSubMatch()
 
-	// Add the device id without the trailing service
-	id, _ := device.ParseID(msg.Source)
-	req.Header.Set("X-Webpa-Device-Id", string(id))
-	req.Header.Set("X-Webpa-Device-Name", string(id))
+	if batched {
+		// The headers of the events are in their messages.
+		req.Header.Set("X-Caduceus-Batch-Size", strconv.Itoa(len(msgs)))
+		event = "batch"
+	} else {
+		// Add x-Midt-* headers
+		wrphttp.AddMessageHeaders(req.Header, msg)
 
-	// Apply the secret
+		// Provide the old headers for now
+		req.Header.Set("X-Webpa-Event", strings.TrimPrefix(msg.Destination, "event:"))
+		req.Header.Set("X-Webpa-Transaction-Id", msg.TransactionUUID)
 
-	if "" != secret {
-		s := hmac.New(sha1.New, []byte(secret))
-		s.Write(body)
-		sig := fmt.Sprintf("sha1=%s", hex.EncodeToString(s.Sum(nil)))
-		req.Header.Set("X-Webpa-Signature", sig)
+		// Add the device id without the trailing service
+		id, _ := device.ParseID(msg.Source)
+		req.Header.Set("X-Webpa-Device-Id", string(id))
+		req.Header.Set("X-Webpa-Device-Name", string(id))
 	}
 
-	// find the event "short name"
-	event := msg.FindEventStringSubMatch()
-
-	retryOptions := xhttp.RetryOptions{
-		Logger:   obs.logger,
-		Retries:  obs.deliveryRetries,
-		Interval: obs.deliveryInterval,
-		Counter:  obs.deliveryRetryCounter.With("url", obs.id, "event", event),
-		// Always retry on failures up to the max count.
-		ShouldRetry: func(error) bool { return true },
-		ShouldRetryStatus: func(code int) bool {
+	// Apply the secret
+	sign.sign(req.Header, body, time.Now())
+
+	var attempts []DeliveryAttempt
+	current := urls.Value.(string)
+	policy := retryPolicy{
+		retries:     settings.retries,
+		interval:    settings.interval,
+		maxInterval: settings.maxInterval,
+		backoff:     obs.backoff,
+		logger:      obs.logger,
+		counter:     obs.deliveryRetryCounter.With("url", obs.id, "event", event),
+		shouldRetryStatus: func(code int) bool {
 			for _, c := range obs.retryCodes {
 				if code == c {
 					return true
@@ -599,10 +1321,18 @@ func (obs *CaduceusOutboundSender) send(urls *ring.Ring, secret, acceptType stri
 			return false
 		},
 	}
+	policy.record = func(a DeliveryAttempt) {
+		obs.breakers.record(current, "" != a.Error || 500 <= a.Status, a.Time)
+		if nil != obs.deadLetters {
+			attempts = append(attempts, a)
+		}
+	}
 
 	// update subsequent requests with the next url in the list upon failure
-	retryOptions.UpdateRequest = func(request *http.Request) {
-		urls = urls.Next()
+	policy.updateRequest = func(request *http.Request) {
+		sign.sign(request.Header, body, time.Now())
+		urls = obs.breakers.pick(urls.Next(), time.Now())
+		current = urls.Value.(string)
 		tmp, err := url.Parse(urls.Value.(string))
 		if err != nil {
 			obs.logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "failed to update url",
@@ -612,15 +1342,35 @@ func (obs *CaduceusOutboundSender) send(urls *ring.Ring, secret, acceptType stri
 		request.URL = tmp
 	}
 
+	// The webhook's own timeout bounds each attempt, like the timeout of the
+	// http client.
+	sender := obs.sender
+	if 0 < settings.clientTimeout {
+		sender = attemptTimeout(settings.clientTimeout, sender)
+	}
+
 	// Send it
-	resp, err := xhttp.RetryTransactor(retryOptions, obs.sender)(req)
+	resp, err := policy.do(req, body, sender)
 	code := "failure"
-	if nil != err {
+	if nil != err && nil != obs.abortCtx.Err() {
+		// The sender ran out of time to shut down, so the messages are
+		// spilled rather than counted as undeliverable.
+		interrupted = true
+		obs.interruptedMutex.Lock()
+		obs.interrupted = append(obs.interrupted, msgs...)
+		obs.interruptedMutex.Unlock()
+		return
+	} else if nil != err {
 		// Report failure
-		obs.droppedNetworkErrCounter.Add(1.0)
+		obs.droppedNetworkErrCounter.Add(float64(len(msgs)))
+		dropReason = "network_err"
+		for _, msg := range msgs {
+			obs.deadLetter(msg, dropReason, 0, err, attempts)
+		}
 	} else {
 		// Report Result
 		code = strconv.Itoa(resp.StatusCode)
+		status = resp.StatusCode
 
 		// read until the response is complete before closing to allow
 		// connection reuse
@@ -628,8 +1378,63 @@ func (obs *CaduceusOutboundSender) send(urls *ring.Ring, secret, acceptType stri
 			io.Copy(ioutil.Discard, resp.Body)
 			resp.Body.Close()
 		}
+
+		if status < 200 || 300 <= status {
+			for _, msg := range msgs {
+				obs.deadLetter(msg, "status", status, nil, attempts)
+			}
+		}
 	}
-	obs.deliveryCounter.With("url", obs.id, "code", code, "event", event).Add(1.0)
+
+	// The events are counted one by one, whether they were batched or not.
+	if batched {
+		obs.batchDeliveryCounter.With("url", obs.id, "code", code).Add(1.0)
+		for _, msg := range msgs {
+			obs.deliveryCounter.With("url", obs.id, "code", code, "event", msg.FindEventStringSubMatch()).Add(1.0)
+		}
+	} else {
+		obs.deliveryCounter.With("url", obs.id, "code", code, "event", event).Add(1.0)
+	}
+}
+
+// encodeBatch encodes the messages as an array, returning its content type.
+func encodeBatch(acceptType string, msgs []*wrp.Message) (string, []byte) {
+	contentType, format := wrp.MimeTypeJson, wrp.JSON
+	switch acceptType {
+	case "wrp", wrp.MimeTypeMsgpack, wrp.MimeTypeWrp:
+		contentType, format = wrp.MimeTypeMsgpack, wrp.Msgpack
+	}
+
+	buffer := bytes.NewBuffer([]byte{})
+	wrp.NewEncoder(buffer, format).Encode(msgs)
+	return contentType, buffer.Bytes()
+}
+
+// deadLetter keeps the message that couldn't be delivered, with the final
+// status or error and the outcome of every attempt.
+func (obs *CaduceusOutboundSender) deadLetter(msg *wrp.Message, reason string, status int, err error, attempts []DeliveryAttempt) {
+	if nil == obs.deadLetters {
+		return
+	}
+	// The message is copied, since the queue tells its messages apart by
+	// pointer and the dead letter may be queued again before this delivery
+	// is done with.
+	copied := *msg
+	l := &DeadLetter{
+		Webhook:  obs.id,
+		Time:     time.Now(),
+		Reason:   reason,
+		Status:   status,
+		Attempts: attempts,
+		Message:  &copied,
+	}
+	if nil != err {
+		l.Error = err.Error()
+	}
+	if nil == l.Attempts {
+		l.Attempts = []DeliveryAttempt{}
+	}
+	obs.deadLetters.add(l)
 }
 
 // queueOverflow handles the logic of what to do when a queue overflows:
@@ -643,7 +1448,7 @@ func (obs *CaduceusOutboundSender) queueOverflow() {
 	}
 	obs.dropUntil = time.Now().Add(obs.cutOffPeriod)
 	obs.dropUntilGauge.Set(float64(obs.dropUntil.Unix()))
-	secret := obs.listener.Config.Secret
+	sign := obs.signer
 	failureMsg := obs.failureMsg
 	failureURL := obs.listener.FailureURL
 	obs.mutex.Unlock()
@@ -681,12 +1486,7 @@ func (obs *CaduceusOutboundSender) queueOverflow() {
 	}
 	req.Header.Set("Content-Type", wrp.MimeTypeJson)
 
-	if "" != secret {
-		h := hmac.New(sha1.New, []byte(secret))
-		h.Write(msg)
-		sig := fmt.Sprintf("sha1=%s", hex.EncodeToString(h.Sum(nil)))
-		req.Header.Set("X-Webpa-Signature", sig)
-	}
+	sign.sign(req.Header, msg, time.Now())
 
 	resp, err := obs.sender(req)
 	if nil != err {
@@ -18,6 +18,11 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 
 	"github.com/davecgh/go-spew/spew"
@@ -32,6 +37,11 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -98,6 +108,7 @@ func simpleFactorySetup(trans *transport, cutOffPeriod time.Duration, matcher []
 		On("With", []string{"url", w.Config.URL, "code", "failure", "event", "iot"}).Return(fakeDC).
 		On("With", []string{"url", w.Config.URL, "event", "test"}).Return(fakeDC).
 		On("With", []string{"url", w.Config.URL, "event", "iot"}).Return(fakeDC).
+		On("With", []string{"url", w.Config.URL, "event", "batch"}).Return(fakeDC).
 		On("With", []string{"url", w.Config.URL, "event", "unknown"}).Return(fakeDC).
 		On("With", []string{"url", w.Config.URL, "code", "201"}).Return(fakeDC).
 		On("With", []string{"url", w.Config.URL, "code", "202"}).Return(fakeDC).
@@ -120,8 +131,27 @@ func simpleFactorySetup(trans *transport, cutOffPeriod time.Duration, matcher []
 	fakeDroppedSlow.On("With", []string{"url", w.Config.URL, "reason", "expired_before_queueing"}).Return(fakeDroppedSlow)
 	fakeDroppedSlow.On("With", []string{"url", w.Config.URL, "reason", "invalid_config"}).Return(fakeDroppedSlow)
 	fakeDroppedSlow.On("With", []string{"url", w.Config.URL, "reason", "network_err"}).Return(fakeDroppedSlow)
+	fakeDroppedSlow.On("With", []string{"url", w.Config.URL, "reason", "payload_too_large"}).Return(fakeDroppedSlow)
+	fakeDroppedSlow.On("With", []string{"url", w.Config.URL, "reason", "shutdown"}).Return(fakeDroppedSlow)
+	fakeDroppedSlow.On("With", []string{"url", w.Config.URL, "reason", "durable_queue_full"}).Return(fakeDroppedSlow)
+	fakeDroppedSlow.On("With", []string{"url", w.Config.URL, "reason", "durable_queue_error"}).Return(fakeDroppedSlow)
 	fakeDroppedSlow.On("Add", mock.Anything).Return()
 
+	// spilled and restored metrics
+	fakeSpill := new(mockCounter)
+	fakeSpill.On("With", []string{"url", w.Config.URL}).Return(fakeSpill)
+	fakeSpill.On("Add", mock.Anything).Return()
+
+	// circuit breaker metrics
+	fakeBreaker := new(mockGauge)
+	fakeBreaker.On("With", mock.Anything).Return(fakeBreaker)
+	fakeBreaker.On("Set", mock.Anything).Return()
+
+	// batch metrics
+	fakeBatch := new(mockCounter)
+	fakeBatch.On("With", mock.Anything).Return(fakeBatch)
+	fakeBatch.On("Add", mock.Anything).Return()
+
 	// IncomingContentType cases
 	fakeContentType := new(mockCounter)
 	fakeContentType.On("With", []string{"content_type", "msgpack"}).Return(fakeContentType)
@@ -151,6 +181,8 @@ func simpleFactorySetup(trans *transport, cutOffPeriod time.Duration, matcher []
 	fakeRegistry.On("NewCounter", SlowConsumerCounter).Return(fakeSlow)
 	fakeRegistry.On("NewCounter", SlowConsumerDroppedMsgCounter).Return(fakeDroppedSlow)
 	fakeRegistry.On("NewCounter", DropsDueToPanic).Return(fakePanicDrop)
+	fakeRegistry.On("NewCounter", SpilledMessageCounter).Return(fakeSpill)
+	fakeRegistry.On("NewCounter", RestoredMessageCounter).Return(fakeSpill)
 	fakeRegistry.On("NewGauge", OutgoingQueueDepth).Return(fakeQdepth)
 	fakeRegistry.On("NewGauge", DeliveryRetryMaxGauge).Return(fakeQdepth)
 	fakeRegistry.On("NewGauge", ConsumerRenewalTimeGauge).Return(fakeQdepth)
@@ -158,6 +190,8 @@ func simpleFactorySetup(trans *transport, cutOffPeriod time.Duration, matcher []
 	fakeRegistry.On("NewGauge", ConsumerDropUntilGauge).Return(fakeQdepth)
 	fakeRegistry.On("NewGauge", ConsumerDeliveryWorkersGauge).Return(fakeQdepth)
 	fakeRegistry.On("NewGauge", ConsumerMaxDeliveryWorkersGauge).Return(fakeQdepth)
+	fakeRegistry.On("NewGauge", CircuitBreakerStateGauge).Return(fakeBreaker)
+	fakeRegistry.On("NewCounter", BatchDeliveryCounter).Return(fakeBatch)
 
 	return &OutboundSenderFactory{
 		Listener:        w,
@@ -233,6 +267,628 @@ func TestSimpleWrp(t *testing.T) {
 	assert.Equal(int32(2), trans.i)
 }
 
+// Events larger than the webhook's max payload size are not delivered
+func TestPayloadTooLarge(t *testing.T) {
+	assert := assert.New(t)
+
+	trans := &transport{}
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	options := newMemoryOptionsStore()
+	options.Put(context.Background(), obsf.Listener.Config.URL, WebhookOptions{MaxPayloadSize: 5})
+	obsf.Options = options
+
+	obs, err := obsf.New()
+	assert.Nil(err)
+
+	req := simpleRequest()
+	req.Destination = "event:iot"
+	obs.Queue(req)
+
+	req = simpleRequest()
+	req.Destination = "event:iot"
+	req.Payload = []byte("Hi")
+	obs.Queue(req)
+
+	obs.Shutdown(true)
+
+	assert.Equal(int32(1), trans.i)
+}
+
+// Only the events of the partners the webhook is bound to are delivered
+func TestPartnerIsolation(t *testing.T) {
+	assert := assert.New(t)
+
+	trans := &transport{}
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	options := newMemoryOptionsStore()
+	options.Put(context.Background(), obsf.Listener.Config.URL, WebhookOptions{PartnerIDs: []string{"comcast"}})
+	obsf.Options = options
+	obsf.PartnerIsolation = true
+
+	obs, err := obsf.New()
+	assert.Nil(err)
+
+	req := simpleRequest()
+	req.Destination = "event:iot"
+	req.PartnerIDs = []string{"sky"}
+	obs.Queue(req)
+
+	req = simpleRequest()
+	req.Destination = "event:iot"
+	obs.Queue(req)
+
+	req = simpleRequest()
+	req.Destination = "event:iot"
+	req.PartnerIDs = []string{"sky", "comcast"}
+	obs.Queue(req)
+
+	assert.True(obs.Match(req).Matched)
+	req.PartnerIDs = nil
+	assert.True(obs.Match(req).PartnerMismatch)
+
+	obs.Shutdown(true)
+
+	assert.Equal(int32(1), trans.i)
+}
+
+// Senders may borrow their workers from a shared pool
+func TestSharedWorkerPool(t *testing.T) {
+	assert := assert.New(t)
+
+	pool, err := WorkerPoolConfig{Size: 2}.New(permissiveRegistry())
+	assert.Nil(err)
+
+	trans := &transport{}
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.WorkerPool = pool
+
+	obs, err := obsf.New()
+	assert.Nil(err)
+
+	for i := 0; i < 5; i++ {
+		req := simpleRequest()
+		req.Destination = "event:iot"
+		obs.Queue(req)
+	}
+
+	obs.Shutdown(true)
+
+	assert.Equal(int32(5), trans.i)
+	assert.Equal(0, pool.busy)
+}
+
+// The webhook options set the share of the sender in the shared pool.
+func TestSharedWorkerPoolShare(t *testing.T) {
+	assert := assert.New(t)
+
+	pool, err := WorkerPoolConfig{Size: 10, MaxPerSender: 8}.New(permissiveRegistry())
+	assert.Nil(err)
+
+	obsf := simpleFactorySetup(&transport{}, time.Second, nil)
+	obsf.WorkerPool = pool
+	obsf.DeliveryBounds = DeliveryBounds{
+		MinWorkers: 1,
+		MaxWorkers: 20,
+		MinWeight:  1,
+		MaxWeight:  10,
+	}
+	options := newMemoryOptionsStore()
+	options.Put(context.Background(), obsf.Listener.Config.URL, WebhookOptions{
+		Workers:    6,
+		MinWorkers: 3,
+		Weight:     4,
+	})
+	obsf.Options = options
+
+	obs, err := obsf.New()
+	assert.Nil(err)
+
+	workers := obs.(*CaduceusOutboundSender).workers.(*poolWorkers)
+	pool.mutex.Lock()
+	assert.Equal(3, workers.min)
+	assert.Equal(6, workers.max)
+	assert.Equal(4.0, workers.weight)
+	pool.mutex.Unlock()
+
+	obs.Shutdown(true)
+}
+
+// The queued messages are given back to the budget once delivered or dropped
+func TestQueueBudgetReleased(t *testing.T) {
+	for _, gentle := range []bool{true, false} {
+		t.Run(fmt.Sprintf("gentle=%t", gentle), func(t *testing.T) {
+			assert := assert.New(t)
+
+			budget, err := QueueBudgetConfig{MaxMessages: 100}.New(permissiveRegistry())
+			assert.Nil(err)
+
+			trans := &transport{}
+			obsf := simpleFactorySetup(trans, time.Second, nil)
+			obsf.QueueBudget = budget
+
+			obs, err := obsf.New()
+			assert.Nil(err)
+
+			for i := 0; i < 5; i++ {
+				req := simpleRequest()
+				req.Destination = "event:iot"
+				obs.Queue(req)
+			}
+
+			obs.Shutdown(gentle)
+
+			assert.Equal(int64(0), budget.messages)
+			assert.Equal(int64(0), budget.bytes)
+		})
+	}
+}
+
+func TestDeliverySettings(t *testing.T) {
+	assert := assert.New(t)
+
+	trans := &transport{}
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.DeliveryBounds = DeliveryBounds{
+		MaxDeliveryRetries: 5,
+		MinQueueSize:       1,
+		MaxQueueSize:       100,
+		MaxWorkers:         4,
+		MaxClientTimeout:   time.Minute,
+	}
+	options := newMemoryOptionsStore()
+	obsf.Options = options
+
+	obs, err := obsf.New()
+	assert.Nil(err)
+	cos := obs.(*CaduceusOutboundSender)
+	assert.Equal(obsf.DeliveryRetries, cos.deliveryRetries)
+	assert.Equal(obsf.QueueSize, cos.queueSize)
+	assert.Equal(obsf.NumWorkers, cos.maxWorkers)
+
+	options.Put(context.Background(), obsf.Listener.Config.URL, WebhookOptions{
+		DeliveryRetries: intPtr(0),
+		QueueSize:       2,
+		Workers:         50,
+		ClientTimeout:   jsonDuration(5 * time.Second),
+	})
+	assert.Nil(obs.Update(obsf.Listener))
+	assert.Equal(0, cos.deliveryRetries)
+	assert.Equal(2, cos.queueSize)
+	assert.Equal(2, cap(cos.queue.Load().(chan *wrp.Message)))
+	assert.Equal(4, cos.maxWorkers)
+	assert.Equal(5*time.Second, cos.clientTimeout)
+
+	// The webhook's settings are dropped with its options.
+	options.Put(context.Background(), obsf.Listener.Config.URL, WebhookOptions{})
+	assert.Nil(obs.Update(obsf.Listener))
+	assert.Equal(obsf.DeliveryRetries, cos.deliveryRetries)
+	assert.Equal(obsf.QueueSize, cos.queueSize)
+	assert.Equal(time.Duration(0), cos.clientTimeout)
+
+	obs.Shutdown(true)
+}
+
+// The events of a webhook batching its deliveries are delivered together,
+// signed as a whole.
+func TestBatchedDelivery(t *testing.T) {
+	tests := []struct {
+		description   string
+		batchBytes    int
+		expectedSizes []int
+	}{
+		{
+			description:   "Batch Size",
+			expectedSizes: []int{3, 3, 1},
+		},
+		{
+			description:   "Batch Bytes",
+			batchBytes:    30,
+			expectedSizes: []int{2, 2, 2, 1},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			var sizes []int
+			trans := &transport{}
+			trans.fn = func(req *http.Request, count int) (*http.Response, error) {
+				body, _ := ioutil.ReadAll(req.Body)
+				var msgs []wrp.Message
+				assert.Nil(json.Unmarshal(body, &msgs))
+				assert.Equal(wrp.MimeTypeJson, req.Header.Get("Content-Type"))
+				assert.Equal(strconv.Itoa(len(msgs)), req.Header.Get("X-Caduceus-Batch-Size"))
+
+				mac := hmac.New(sha256.New, []byte("123456"))
+				mac.Write([]byte(req.Header.Get("X-Caduceus-Timestamp") + "."))
+				mac.Write(body)
+				assert.Equal("sha256="+hex.EncodeToString(mac.Sum(nil)), req.Header.Get("X-Caduceus-Signature"))
+
+				sizes = append(sizes, len(msgs))
+				return &http.Response{StatusCode: 200}, nil
+			}
+
+			obsf := simpleFactorySetup(trans, time.Second, nil)
+			obsf.NumWorkers = 1
+			obsf.DeliveryBounds = DeliveryBounds{
+				MaxBatchSize:   10,
+				MaxBatchBytes:  1000,
+				MaxBatchLinger: time.Second,
+			}
+			options := newMemoryOptionsStore()
+			options.Put(context.Background(), obsf.Listener.Config.URL, WebhookOptions{
+				BatchSize:   3,
+				BatchBytes:  tc.batchBytes,
+				BatchLinger: jsonDuration(100 * time.Millisecond),
+			})
+			obsf.Options = options
+
+			obs, err := obsf.New()
+			assert.Nil(err)
+
+			for i := 0; i < 7; i++ {
+				req := simpleRequest()
+				req.Destination = "event:iot"
+				obs.Queue(req)
+			}
+			obs.Shutdown(true)
+
+			assert.Equal(tc.expectedSizes, sizes)
+		})
+	}
+}
+
+// The batches are split by the URL picked for each of their events, so the
+// events of a device stick to their URL.
+func TestBatchedDeliverySticky(t *testing.T) {
+	assert := assert.New(t)
+
+	delivered := map[string]map[string]bool{}
+	trans := &transport{}
+	trans.fn = func(req *http.Request, count int) (*http.Response, error) {
+		body, _ := ioutil.ReadAll(req.Body)
+		var msgs []wrp.Message
+		assert.Nil(json.Unmarshal(body, &msgs))
+		for _, msg := range msgs {
+			if nil == delivered[msg.Source] {
+				delivered[msg.Source] = map[string]bool{}
+			}
+			delivered[msg.Source][req.URL.Path] = true
+		}
+		return &http.Response{StatusCode: 200}, nil
+	}
+
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.NumWorkers = 1
+	obsf.QueueSize = 100
+	obsf.Listener.Config.AlternativeURLs = []string{
+		"http://localhost:9999/foo",
+		"http://localhost:9999/bar",
+		"http://localhost:9999/baz",
+	}
+	obsf.DeliveryBounds = DeliveryBounds{
+		MaxBatchSize:   100,
+		MaxBatchLinger: time.Second,
+	}
+	options := newMemoryOptionsStore()
+	options.Put(context.Background(), obsf.Listener.Config.URL, WebhookOptions{
+		BatchSize:   100,
+		BatchLinger: jsonDuration(100 * time.Millisecond),
+		URLStrategy: stickyStrategy,
+	})
+	obsf.Options = options
+
+	obs, err := obsf.New()
+	assert.Nil(err)
+
+	selector := newURLSelector(stickyStrategy, nil, obsf.Listener.Config.AlternativeURLs)
+	expected := map[string]map[string]bool{}
+	for i := 0; i < 20; i++ {
+		req := simpleRequest()
+		req.Source = fmt.Sprintf("mac:1122334455%02d", i%10)
+		req.Destination = "event:iot"
+		obs.Queue(req)
+
+		u, _ := url.Parse(selector.first(req).Value.(string))
+		expected[req.Source] = map[string]bool{u.Path: true}
+	}
+	obs.Shutdown(true)
+
+	assert.Equal(expected, delivered)
+}
+
+// The webhook chooses how its deliveries are signed.  The legacy signature
+// is sent unless it is turned off.
+func TestSignatureOptions(t *testing.T) {
+	yes, no := true, false
+	tests := []struct {
+		description    string
+		disableLegacy  bool
+		legacy         *bool
+		expectedLegacy bool
+	}{
+		{
+			description:    "Default",
+			expectedLegacy: true,
+		},
+		{
+			description: "Webhook Opted Out",
+			legacy:      &no,
+		},
+		{
+			description:   "Disabled",
+			disableLegacy: true,
+		},
+		{
+			description:    "Disabled But Webhook Opted In",
+			disableLegacy:  true,
+			legacy:         &yes,
+			expectedLegacy: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			trans := &transport{}
+			trans.fn = func(req *http.Request, count int) (*http.Response, error) {
+				assert.True(strings.HasPrefix(req.Header.Get("X-Caduceus-Signature"), "sha512="))
+				assert.NotEmpty(req.Header.Get("X-Caduceus-Timestamp"))
+				assert.Equal(tc.expectedLegacy, strings.HasPrefix(req.Header.Get("X-Webpa-Signature"), "sha1="))
+				return &http.Response{StatusCode: 200}, nil
+			}
+
+			obsf := simpleFactorySetup(trans, time.Second, nil)
+			obsf.Signature.DisableLegacy = tc.disableLegacy
+			options := newMemoryOptionsStore()
+			options.Put(context.Background(), obsf.Listener.Config.URL, WebhookOptions{
+				SignatureAlgorithm: sha512Signature,
+				LegacySignature:    tc.legacy,
+			})
+			obsf.Options = options
+
+			obs, err := obsf.New()
+			assert.Nil(err)
+
+			req := simpleRequest()
+			req.Destination = "event:iot"
+			obs.Queue(req)
+			obs.Shutdown(true)
+
+			assert.Equal(int32(1), trans.i)
+		})
+	}
+}
+
+// While a secret rotation overlaps, the deliveries carry a signature for
+// both secrets.
+func TestSecretRotationSignatures(t *testing.T) {
+	assert := assert.New(t)
+
+	trans := &transport{}
+	trans.fn = func(req *http.Request, count int) (*http.Response, error) {
+		signatures := strings.Split(req.Header.Get("X-Caduceus-Signature"), ",")
+		assert.Equal(2, len(signatures))
+		return &http.Response{StatusCode: 200}, nil
+	}
+
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	options := newMemoryOptionsStore()
+	options.Put(context.Background(), obsf.Listener.Config.URL, WebhookOptions{
+		SecretRotation: &SecretRotation{Secret: "654321", Started: time.Now(), Until: time.Now().Add(time.Hour)},
+	})
+	obsf.Options = options
+
+	obs, err := obsf.New()
+	assert.Nil(err)
+
+	req := simpleRequest()
+	req.Destination = "event:iot"
+	obs.Queue(req)
+	obs.Shutdown(true)
+
+	assert.Equal(int32(1), trans.i)
+}
+
+// The messages spilled by a sender are queued again by the next sender of the
+// webhook.
+func TestSpillAndRestore(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "spill")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// The first sender never gets its deliveries through.
+	var delivered int32
+	blocked := true
+	trans := &transport{
+		fn: func(req *http.Request, count int) (*http.Response, error) {
+			if blocked {
+				<-req.Context().Done()
+				return nil, req.Context().Err()
+			}
+			atomic.AddInt32(&delivered, 1)
+			return &http.Response{Status: "200 OK", StatusCode: 200}, nil
+		},
+	}
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.NumWorkers = 1
+	obsf.SpillDirectory = dir
+
+	obs, err := obsf.New()
+	assert.Nil(err)
+
+	for i := 0; i < 5; i++ {
+		req := simpleRequest()
+		req.Destination = "event:iot"
+		obs.Queue(req)
+	}
+
+	// The sender runs out of time to shut down, so the delivery in flight
+	// is interrupted and spilled along with the queued messages.
+	stopped := make(chan struct{})
+	go func() {
+		obs.Shutdown(true)
+		close(stopped)
+	}()
+	obs.Spill()
+	<-stopped
+
+	f, err := os.Open(spillFile(dir, obs.(*CaduceusOutboundSender).id))
+	assert.Nil(err)
+	spilled := 0
+	decoder := wrp.NewDecoder(f, wrp.Msgpack)
+	for nil == decoder.Decode(new(wrp.Message)) {
+		spilled++
+	}
+	f.Close()
+	assert.Equal(5, spilled)
+
+	blocked = false
+	next, err := obsf.New()
+	assert.Nil(err)
+	next.Shutdown(true)
+
+	// Every message is delivered once it is restored.
+	assert.Equal(int32(5), atomic.LoadInt32(&delivered))
+
+	_, err = os.Stat(spillFile(dir, obs.(*CaduceusOutboundSender).id))
+	assert.True(os.IsNotExist(err))
+}
+
+// The messages of a durable queue not yet delivered when the sender goes away
+// are delivered by the next sender of the webhook.
+func TestDurableQueue(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "durable")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	release := make(chan struct{})
+	trans := &transport{
+		fn: func(req *http.Request, count int) (*http.Response, error) {
+			<-release
+			return &http.Response{Status: "200 OK", StatusCode: 200}, nil
+		},
+	}
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.DurableQueue, err = DurableQueueConfig{Directory: dir}.withDefaults()
+	assert.Nil(err)
+	options := newMemoryOptionsStore()
+	options.Put(context.Background(), obsf.Listener.Config.URL, WebhookOptions{DurableQueue: true})
+	obsf.Options = options
+
+	crashed, err := obsf.New()
+	assert.Nil(err)
+	for i := 0; i < 3; i++ {
+		req := simpleRequest()
+		req.Destination = "event:iot"
+		crashed.Queue(req)
+	}
+
+	// Nothing was delivered, so the next sender gets everything again.
+	obs, err := obsf.New()
+	assert.Nil(err)
+
+	close(release)
+	obs.Shutdown(true)
+	crashed.Shutdown(true)
+
+	assert.Equal(int32(6), atomic.LoadInt32(&trans.i))
+
+	// Everything was acknowledged, so the queue is gone.
+	_, err = os.Stat(filepath.Join(dir, webhookFileName(obs.(*CaduceusOutboundSender).id)))
+	assert.True(os.IsNotExist(err))
+}
+
+// An event matching several of the webhook's regexes is queued for each, and
+// every one of its entries in the durable queue is acknowledged.
+func TestDurableQueueOverlappingEvents(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "durable")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	trans := &transport{
+		fn: func(req *http.Request, count int) (*http.Response, error) {
+			return &http.Response{Status: "200 OK", StatusCode: 200}, nil
+		},
+	}
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.Listener.Events = []string{"iot", "io.*"}
+	obsf.DurableQueue, err = DurableQueueConfig{Directory: dir}.withDefaults()
+	assert.Nil(err)
+	options := newMemoryOptionsStore()
+	options.Put(context.Background(), obsf.Listener.Config.URL, WebhookOptions{DurableQueue: true})
+	obsf.Options = options
+
+	obs, err := obsf.New()
+	assert.Nil(err)
+	req := simpleRequest()
+	req.Destination = "event:iot"
+	obs.Queue(req)
+	obs.Shutdown(true)
+
+	assert.Equal(int32(2), atomic.LoadInt32(&trans.i))
+
+	// Both entries were acknowledged, so the queue is gone.
+	_, err = os.Stat(filepath.Join(dir, webhookFileName(obs.(*CaduceusOutboundSender).id)))
+	assert.True(os.IsNotExist(err))
+}
+
+func TestMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	trans := &transport{}
+	obsf := simpleFactorySetup(trans, time.Second, []string{"mac:112233445566"})
+	options := newMemoryOptionsStore()
+	options.Put(context.Background(), obsf.Listener.Config.URL, WebhookOptions{MaxPayloadSize: 20})
+	obsf.Options = options
+	obs, err := obsf.New()
+	assert.Nil(err)
+
+	req := simpleRequest()
+	req.Destination = "event:iot"
+	assert.Equal(MatchResult{
+		Webhook:  "http://localhost:9999/foo",
+		Matched:  true,
+		Events:   []string{"iot"},
+		DeviceID: "mac:112233445566",
+	}, obs.Match(req))
+
+	req.Source = "mac:665544332211"
+	result := obs.Match(req)
+	assert.False(result.Matched)
+	assert.Empty(result.DeviceID)
+
+	req = simpleRequest()
+	req.Destination = "event:no-match"
+	result = obs.Match(req)
+	assert.False(result.Matched)
+	assert.Empty(result.Events)
+
+	req.Destination = "event:test"
+	req.Payload = make([]byte, 21)
+	result = obs.Match(req)
+	assert.False(result.Matched)
+	assert.True(result.PayloadTooLarge)
+
+	obs.(*CaduceusOutboundSender).dropUntil = time.Now().Add(time.Minute)
+	req.Payload = nil
+	result = obs.Match(req)
+	assert.False(result.Matched)
+	assert.True(result.CutOff)
+
+	// nothing was queued
+	obs.Shutdown(true)
+	assert.Equal(int32(0), trans.i)
+}
+
 // Simple test that covers the normal retry case
 func TestSimpleRetry(t *testing.T) {
 
@@ -283,6 +939,37 @@ func Test429Retry(t *testing.T) {
 	assert.Equal(int32(2), trans.i)
 }
 
+// The events that couldn't be delivered are kept with every attempt.
+func TestDeadLetters(t *testing.T) {
+	assert := assert.New(t)
+
+	store, err := DeadLetterConfig{MaxPerWebhook: 10}.New(permissiveRegistry())
+	assert.Nil(err)
+
+	trans := &transport{}
+	trans.fn = func(req *http.Request, count int) (*http.Response, error) {
+		return &http.Response{StatusCode: 429}, nil
+	}
+
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.DeadLetters = store
+	obs, err := obsf.New()
+	assert.Nil(err)
+
+	req := simpleRequest()
+	req.Destination = "event:iot"
+	obs.Queue(req)
+	obs.Shutdown(true)
+
+	letters := store.list("http://localhost:9999/foo")
+	if assert.Equal(1, len(letters)) {
+		assert.Equal("status", letters[0].Reason)
+		assert.Equal(429, letters[0].Status)
+		assert.Equal(2, len(letters[0].Attempts))
+		assert.Equal(req.TransactionUUID, letters[0].Message.TransactionUUID)
+	}
+}
+
 func TestAltURL(t *testing.T) {
 	assert := assert.New(t)
 
@@ -327,6 +1014,51 @@ func TestAltURL(t *testing.T) {
 	}
 }
 
+// The unhealthy alternative URLs are skipped once their breakers open.
+func TestAltURLCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+
+	var bad int32
+	w := ancla.Webhook{
+		Until:  time.Now().Add(60 * time.Second),
+		Events: []string{".*"},
+	}
+	w.Config.URL = "http://localhost:9999/foo"
+	w.Config.ContentType = wrp.MimeTypeJson
+	w.Config.AlternativeURLs = []string{
+		"http://localhost:9999/foo",
+		"http://localhost:9999/bar",
+	}
+
+	trans := &transport{}
+	trans.fn = func(req *http.Request, count int) (*http.Response, error) {
+		if "/bar" == req.URL.Path {
+			atomic.AddInt32(&bad, 1)
+			return &http.Response{StatusCode: 503}, nil
+		}
+		return &http.Response{StatusCode: 200}, nil
+	}
+
+	obsf := simpleFactorySetup(trans, time.Second, nil)
+	obsf.NumWorkers = 1
+	obsf.DeliveryRetries = 0
+	obsf.CircuitBreaker = CircuitBreakerConfig{ConsecutiveFailures: 1, OpenPeriod: time.Hour}
+	obs, err := obsf.New()
+	assert.Nil(err)
+	assert.Nil(obs.Update(w))
+
+	for i := 0; i < 6; i++ {
+		req := simpleRequest()
+		req.Destination = "event:iot"
+		obs.Queue(req)
+	}
+
+	obs.Shutdown(true)
+
+	assert.Equal(int32(6), trans.i)
+	assert.True(atomic.LoadInt32(&bad) <= 1)
+}
+
 // Simple test that covers the normal successful case with extra matchers
 func TestSimpleWrpWithMatchers(t *testing.T) {
 
@@ -779,7 +1511,8 @@ func TestOverflowValidFailureURLWithSecret(t *testing.T) {
 		assert.Equal("POST", req.Method)
 		assert.Equal([]string{wrp.MimeTypeJson}, req.Header["Content-Type"])
 		// There is a timestamp in the body, so it's not worth trying to do a string comparison
-		assert.NotNil(req.Header["X-Webpa-Signature"])
+		assert.NotNil(req.Header["X-Caduceus-Signature"])
+		assert.NotNil(req.Header["X-Caduceus-Timestamp"])
 		payload, _ := ioutil.ReadAll(req.Body)
 		assert.NotNil(payload)
 
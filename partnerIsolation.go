@@ -0,0 +1,138 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"errors"
+
+	"github.com/xmidt-org/webpa-common/secure/handler"
+)
+
+// wildcardPartnerID is the partner id of webhooks given the events of every
+// partner.
+const wildcardPartnerID = "*"
+
+var (
+	errNoPartnerIDs  = errors.New("the registration is not allowed any partner ids")
+	errOtherPartners = errors.New("the webhook belongs to other partners")
+)
+
+// PartnerIsolationConfig configures the isolation of the partners from each
+// other's events.
+type PartnerIsolationConfig struct {
+	// Enabled binds every webhook to the partner ids allowed by the JWT of
+	// its registration, and only delivers the events with one of them.
+	// Webhooks registered without partner ids are given no events.
+	Enabled bool
+
+	// PrivilegedClients are the JWT subjects allowed to register webhooks
+	// for the events of every partner, with the "*" partner id.
+	PrivilegedClients []string
+}
+
+// validate checks the partner ids the webhooks are bound to reach every
+// instance, which takes the options to be stored in Argus.
+func (c PartnerIsolationConfig) validate(options WebhookOptionsConfig) error {
+	if c.Enabled && "" == options.Address {
+		return errors.New("partner isolation requires the webhook options to be stored in Argus")
+	}
+	return nil
+}
+
+// bindPartnerIDs returns the partner ids to bind the webhook registered in
+// the context to, or an error if the registration may not be bound to any.
+func (c PartnerIsolationConfig) bindPartnerIDs(ctx context.Context) ([]string, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+
+	values, ok := handler.FromContext(ctx)
+	if !ok {
+		return nil, errNoPartnerIDs
+	}
+
+	privileged := false
+	for _, client := range c.PrivilegedClients {
+		if client == values.SatClientID {
+			privileged = true
+			break
+		}
+	}
+
+	var partnerIDs []string
+	for _, id := range values.PartnerIDs {
+		if wildcardPartnerID == id {
+			if !privileged {
+				continue
+			}
+			return []string{wildcardPartnerID}, nil
+		}
+		if "" != id {
+			partnerIDs = append(partnerIDs, id)
+		}
+	}
+
+	if 0 == len(partnerIDs) {
+		return nil, errNoPartnerIDs
+	}
+	return partnerIDs, nil
+}
+
+// authorize checks the request in the context is allowed every partner of a
+// webhook bound to the partner ids, so it may act on the webhook.
+func (c PartnerIsolationConfig) authorize(ctx context.Context, partnerIDs []string) error {
+	if !c.Enabled {
+		return nil
+	}
+
+	allowed, err := c.bindPartnerIDs(ctx)
+	if nil != err {
+		return err
+	}
+	if !partnersCover(allowed, partnerIDs) {
+		return errOtherPartners
+	}
+	return nil
+}
+
+// partnersIntersect determines if an event with the partner ids may be
+// delivered to a webhook bound to the allowed partner ids.
+func partnersIntersect(allowed, partnerIDs []string) bool {
+	for _, a := range allowed {
+		if wildcardPartnerID == a {
+			return true
+		}
+		for _, p := range partnerIDs {
+			if a == p {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// partnersCover determines if the partner ids allowed by a request cover
+// every partner a webhook is bound to, so the request may act on the webhook.
+func partnersCover(allowed, partnerIDs []string) bool {
+	for _, p := range partnerIDs {
+		if !partnersIntersect(allowed, []string{p}) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/secure/handler"
+)
+
+func TestBindPartnerIDs(t *testing.T) {
+	tests := []struct {
+		description string
+		disabled    bool
+		values      *handler.ContextValues
+		expected    []string
+		expectedErr error
+	}{
+		{
+			description: "Disabled",
+			disabled:    true,
+			values:      &handler.ContextValues{PartnerIDs: []string{"comcast"}},
+		},
+		{
+			description: "Partner IDs",
+			values:      &handler.ContextValues{SatClientID: "client", PartnerIDs: []string{"comcast", "", "sky"}},
+			expected:    []string{"comcast", "sky"},
+		},
+		{
+			description: "Privileged Wildcard",
+			values:      &handler.ContextValues{SatClientID: "admin", PartnerIDs: []string{"comcast", "*"}},
+			expected:    []string{"*"},
+		},
+		{
+			description: "Unprivileged Wildcard",
+			values:      &handler.ContextValues{SatClientID: "client", PartnerIDs: []string{"comcast", "*"}},
+			expected:    []string{"comcast"},
+		},
+		{
+			description: "Only Unprivileged Wildcard",
+			values:      &handler.ContextValues{SatClientID: "client", PartnerIDs: []string{"*"}},
+			expectedErr: errNoPartnerIDs,
+		},
+		{
+			description: "No Partner IDs",
+			values:      &handler.ContextValues{SatClientID: "admin"},
+			expectedErr: errNoPartnerIDs,
+		},
+		{
+			description: "No Context Values",
+			expectedErr: errNoPartnerIDs,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			c := PartnerIsolationConfig{
+				Enabled:           !tc.disabled,
+				PrivilegedClients: []string{"admin"},
+			}
+
+			ctx := context.Background()
+			if nil != tc.values {
+				ctx = handler.NewContextWithValue(ctx, tc.values)
+			}
+
+			partnerIDs, err := c.bindPartnerIDs(ctx)
+			assert.Equal(tc.expected, partnerIDs)
+			assert.Equal(tc.expectedErr, err)
+		})
+	}
+}
+
+func TestPartnersIntersect(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(partnersIntersect([]string{"comcast", "sky"}, []string{"sky"}))
+	assert.True(partnersIntersect([]string{"*"}, nil))
+	assert.False(partnersIntersect([]string{"comcast"}, []string{"sky"}))
+	assert.False(partnersIntersect([]string{"comcast"}, nil))
+	assert.False(partnersIntersect(nil, []string{"comcast"}))
+}
+
+func TestPartnerIsolationValidate(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(PartnerIsolationConfig{}.validate(WebhookOptionsConfig{}))
+	assert.Nil(PartnerIsolationConfig{Enabled: true}.validate(WebhookOptionsConfig{Address: "http://localhost:6600"}))
+	assert.NotNil(PartnerIsolationConfig{Enabled: true}.validate(WebhookOptionsConfig{}))
+}
+
+func TestPartnersCover(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.True(partnersCover([]string{"comcast"}, nil))
+	assert.True(partnersCover([]string{"comcast", "sky"}, []string{"sky", "comcast"}))
+	assert.True(partnersCover([]string{"*"}, []string{"comcast", "*"}))
+	assert.False(partnersCover([]string{"comcast"}, []string{"comcast", "sky"}))
+	assert.False(partnersCover([]string{"comcast"}, []string{"*"}))
+}
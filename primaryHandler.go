@@ -30,7 +30,7 @@ type JWTValidator struct {
 	Custom secure.JWTValidatorFactory
 }
 
-func NewPrimaryHandler(l log.Logger, v *viper.Viper, sw *ServerHandler, webhookSvc ancla.Service, metricsRegistry provider.Provider, router *mux.Router) (*mux.Router, error) {
+func NewPrimaryHandler(l log.Logger, v *viper.Viper, sw *ServerHandler, webhookSvc ancla.Service, hookOptions webhookOptionsHandler, deadLetters deadLetterHandler, rotation secretRotationHandler, metricsRegistry provider.Provider, router *mux.Router) (*mux.Router, error) {
 
 	validator, err := getValidator(v)
 	if err != nil {
@@ -46,22 +46,46 @@ func NewPrimaryHandler(l log.Logger, v *viper.Viper, sw *ServerHandler, webhookS
 
 	authorizationDecorator := alice.New(setLogger(l), authHandler.Decorate)
 
-	return configServerRouter(router, authorizationDecorator, sw, webhookSvc, metricsRegistry), nil
+	return configServerRouter(router, authorizationDecorator, sw, webhookSvc, hookOptions, deadLetters, rotation, metricsRegistry), nil
 }
 
-func configServerRouter(router *mux.Router, primaryHandler alice.Chain, serverWrapper *ServerHandler, webhookSvc ancla.Service, metricsRegistry provider.Provider) *mux.Router {
-	var singleContentType = func(r *http.Request, _ *mux.RouteMatch) bool {
-		return len(r.Header["Content-Type"]) == 1 // require single specification for Content-Type Header
-	}
-
-	router.Handle("/"+fmt.Sprintf("%s/%s", baseURI, version)+"/notify", primaryHandler.Then(serverWrapper)).Methods("POST").HeadersRegexp("Content-Type", "application/msgpack").MatcherFunc(singleContentType)
+func configServerRouter(router *mux.Router, primaryHandler alice.Chain, serverWrapper *ServerHandler, webhookSvc ancla.Service, hookOptions webhookOptionsHandler, deadLetters deadLetterHandler, rotation secretRotationHandler, metricsRegistry provider.Provider) *mux.Router {
+	// The notify handlers negotiate the WRP format from the Content-Type
+	// header themselves so unsupported types get a 415 rather than a 404.
+	router.Handle("/"+fmt.Sprintf("%s/%s", baseURI, version)+"/notify", primaryHandler.Then(serverWrapper)).Methods("POST")
+	router.Handle("/"+fmt.Sprintf("%s/%s", baseURI, version)+"/notify/batch", primaryHandler.Then(http.HandlerFunc(serverWrapper.ServeBatch))).Methods("POST")
+	router.Handle("/"+fmt.Sprintf("%s/%s", baseURI, version)+"/match", primaryHandler.Then(http.HandlerFunc(serverWrapper.ServeMatch))).Methods("POST")
 
-	addWebhookHandler := ancla.NewAddWebhookHandler(webhookSvc, ancla.HandlerConfig{
+	var addWebhookHandler http.Handler = ancla.NewAddWebhookHandler(webhookSvc, ancla.HandlerConfig{
 		MetricsProvider: metricsRegistry,
 	})
+	if nil != hookOptions.store {
+		// store the caduceus specific options of the registration
+		hookOptions.next = addWebhookHandler
+		addWebhookHandler = hookOptions
+	}
 	// register webhook end points
 	router.Handle("/hook", primaryHandler.Then(addWebhookHandler)).Methods("POST")
 
+	if nil != deadLetters.store {
+		// inspect and redeliver the events that couldn't be delivered
+		deadLettersURI := "/" + fmt.Sprintf("%s/%s", baseURI, version) + "/deadletters"
+		router.Handle(deadLettersURI, primaryHandler.Then(http.HandlerFunc(deadLetters.ServeList))).Methods("GET")
+		router.Handle(deadLettersURI, primaryHandler.Then(http.HandlerFunc(deadLetters.ServePurge))).Methods("DELETE")
+		router.Handle(deadLettersURI+"/redeliver", primaryHandler.Then(http.HandlerFunc(deadLetters.ServeRedeliverAll))).Methods("POST")
+		router.Handle(deadLettersURI+"/{id}", primaryHandler.Then(http.HandlerFunc(deadLetters.ServeGet))).Methods("GET")
+		router.Handle(deadLettersURI+"/{id}", primaryHandler.Then(http.HandlerFunc(deadLetters.ServeDelete))).Methods("DELETE")
+		router.Handle(deadLettersURI+"/{id}/redeliver", primaryHandler.Then(http.HandlerFunc(deadLetters.ServeRedeliver))).Methods("POST")
+	}
+
+	if nil != rotation.store {
+		// rotate the secrets of the webhooks
+		rotationURI := "/" + fmt.Sprintf("%s/%s", baseURI, version) + "/hook/rotation"
+		router.Handle(rotationURI, primaryHandler.Then(http.HandlerFunc(rotation.ServeGet))).Methods("GET")
+		router.Handle(rotationURI, primaryHandler.Then(http.HandlerFunc(rotation.ServeStart))).Methods("POST")
+		router.Handle(rotationURI+"/complete", primaryHandler.Then(http.HandlerFunc(rotation.ServeComplete))).Methods("POST")
+	}
+
 	return router
 }
 
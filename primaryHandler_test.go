@@ -27,7 +27,7 @@ func TestNewPrimaryHandler(t *testing.T) {
 	)
 
 	viper.Set("authHeader", expectedAuthHeader)
-	if _, err := NewPrimaryHandler(l, viper, sw, nil, provider.NewDiscardProvider(), mux.NewRouter()); err != nil {
+	if _, err := NewPrimaryHandler(l, viper, sw, nil, webhookOptionsHandler{}, deadLetterHandler{}, secretRotationHandler{}, provider.NewDiscardProvider(), mux.NewRouter()); err != nil {
 		t.Fatalf("NewPrimaryHandler failed: %v", err)
 	}
 
@@ -93,7 +93,7 @@ func TestMuxServerConfig(t *testing.T) {
 	authHandler := handler.AuthorizationHandler{Validator: nil}
 	caduceusHandler := alice.New(authHandler.Decorate)
 
-	router := configServerRouter(mux.NewRouter(), caduceusHandler, serverWrapper, nil, provider.NewDiscardProvider())
+	router := configServerRouter(mux.NewRouter(), caduceusHandler, serverWrapper, nil, webhookOptionsHandler{}, deadLetterHandler{}, secretRotationHandler{}, provider.NewDiscardProvider())
 
 	t.Run("TestMuxResponseCorrectMSP", func(t *testing.T) {
 		req := exampleRequest("1234", "application/msgpack", "/api/v3/notify")
@@ -109,4 +109,19 @@ func TestMuxServerConfig(t *testing.T) {
 		}
 		assert.Equal(http.StatusAccepted, resp.StatusCode)
 	})
+
+	t.Run("TestMuxResponseUnsupportedContentType", func(t *testing.T) {
+		req := exampleRequest("1234", "application/msgpack", "/api/v3/notify")
+
+		req.Header.Set("Content-Type", "text/plain")
+		w := httptest.NewRecorder()
+
+		router.ServeHTTP(w, req)
+		resp := w.Result()
+		if nil != resp.Body {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		assert.Equal(http.StatusUnsupportedMediaType, resp.StatusCode)
+	})
 }
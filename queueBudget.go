@@ -0,0 +1,124 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// QueueBudgetConfig limits the messages queued across all the senders.  Once
+// the budget is exceeded, incoming requests are rejected until the senders
+// catch up, so the clients back off instead of caduceus running out of
+// memory.
+type QueueBudgetConfig struct {
+	// MaxMessages is the most messages queued across all the senders.  A
+	// message queued for several webhooks counts once for each.
+	// 0 means there is no limit.
+	MaxMessages int64
+
+	// MaxBytes is the most payload bytes queued across all the senders,
+	// counted like MaxMessages.
+	// 0 means there is no limit.
+	MaxBytes int64
+
+	// RejectStatusCode is the status code of the requests rejected while
+	// the budget is exceeded, either 429 or 503.
+	// (Optional) defaults to 429.
+	RejectStatusCode int
+}
+
+// queueBudget keeps track of the messages queued across all the senders.  A
+// nil *queueBudget is never exceeded.
+type queueBudget struct {
+	messages    int64
+	bytes       int64
+	maxMessages int64
+	maxBytes    int64
+	statusCode  int
+
+	messagesGauge metrics.Gauge
+	bytesGauge    metrics.Gauge
+	rejected      metrics.Counter
+}
+
+// New creates the budget, or nil when there are no limits.
+func (c QueueBudgetConfig) New(m CaduceusMetricsRegistry) (*queueBudget, error) {
+	if c.MaxMessages < 0 || c.MaxBytes < 0 {
+		return nil, errors.New("the queue budget must not be negative")
+	}
+	if 0 == c.MaxMessages && 0 == c.MaxBytes {
+		return nil, nil
+	}
+
+	switch c.RejectStatusCode {
+	case 0:
+		c.RejectStatusCode = http.StatusTooManyRequests
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+	default:
+		return nil, errors.New("the queue budget reject status code must be 429 or 503")
+	}
+
+	return &queueBudget{
+		maxMessages:   c.MaxMessages,
+		maxBytes:      c.MaxBytes,
+		statusCode:    c.RejectStatusCode,
+		messagesGauge: m.NewGauge(QueuedMessagesGauge),
+		bytesGauge:    m.NewGauge(QueuedBytesGauge),
+		rejected:      m.NewCounter(OverBudgetRequestCounter),
+	}, nil
+}
+
+// queued records a message of size bytes was queued.
+func (b *queueBudget) queued(size int) {
+	if nil == b {
+		return
+	}
+	atomic.AddInt64(&b.messages, 1)
+	atomic.AddInt64(&b.bytes, int64(size))
+	b.messagesGauge.Add(1.0)
+	b.bytesGauge.Add(float64(size))
+}
+
+// dequeued records a message of size bytes left its queue, either delivered
+// or dropped.
+func (b *queueBudget) dequeued(size int) {
+	if nil == b {
+		return
+	}
+	atomic.AddInt64(&b.messages, -1)
+	atomic.AddInt64(&b.bytes, -int64(size))
+	b.messagesGauge.Add(-1.0)
+	b.bytesGauge.Add(-float64(size))
+}
+
+// reject determines if requests must be rejected because the budget is
+// exceeded, counting the rejection.
+func (b *queueBudget) reject() bool {
+	if nil == b {
+		return false
+	}
+	if (0 < b.maxMessages && b.maxMessages <= atomic.LoadInt64(&b.messages)) ||
+		(0 < b.maxBytes && b.maxBytes <= atomic.LoadInt64(&b.bytes)) {
+		b.rejected.Add(1.0)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueueBudgetConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	b, err := QueueBudgetConfig{}.New(permissiveRegistry())
+	assert.Nil(b)
+	assert.Nil(err)
+	assert.False(b.reject())
+
+	_, err = QueueBudgetConfig{MaxBytes: -1}.New(permissiveRegistry())
+	assert.NotNil(err)
+
+	_, err = QueueBudgetConfig{MaxMessages: 1, RejectStatusCode: http.StatusBadRequest}.New(permissiveRegistry())
+	assert.NotNil(err)
+
+	b, err = QueueBudgetConfig{MaxMessages: 1}.New(permissiveRegistry())
+	assert.Nil(err)
+	assert.Equal(http.StatusTooManyRequests, b.statusCode)
+
+	b, err = QueueBudgetConfig{MaxMessages: 1, RejectStatusCode: http.StatusServiceUnavailable}.New(permissiveRegistry())
+	assert.Nil(err)
+	assert.Equal(http.StatusServiceUnavailable, b.statusCode)
+}
+
+func TestQueueBudget(t *testing.T) {
+	tests := []struct {
+		description string
+		config      QueueBudgetConfig
+	}{
+		{"Messages", QueueBudgetConfig{MaxMessages: 2}},
+		{"Bytes", QueueBudgetConfig{MaxBytes: 20}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			b, err := tc.config.New(permissiveRegistry())
+			require.Nil(t, err)
+
+			b.queued(10)
+			assert.False(b.reject())
+
+			b.queued(10)
+			assert.True(b.reject())
+
+			b.dequeued(10)
+			assert.False(b.reject())
+		})
+	}
+}
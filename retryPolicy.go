@@ -0,0 +1,256 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+const (
+	defaultBackoffMultiplier = 2.0
+	defaultMaxInterval       = 30 * time.Second
+	defaultMaxRetryAfter     = 30 * time.Second
+)
+
+// BackoffConfig configures the waits between the delivery attempts of an
+// event.  The wait before the nth retry is a random duration up to
+// deliveryInterval * multiplier^(n-1), capped at maxInterval, unless the
+// webhook asked for a specific wait with a Retry-After header.
+type BackoffConfig struct {
+	// Multiplier is how much the wait grows after every attempt.  1 keeps
+	// the wait the same.
+	// (Optional) defaults to 2.
+	Multiplier float64
+
+	// MaxInterval is the longest wait between attempts.
+	// (Optional) defaults to 30s.
+	MaxInterval time.Duration
+
+	// DisableJitter waits the full interval instead of a random duration up
+	// to it.  The jitter keeps the retries of many events from arriving all
+	// at once.
+	DisableJitter bool
+
+	// MaxRetryAfter is the longest Retry-After honored.  Deliveries asked to
+	// wait longer give up instead.
+	// (Optional) defaults to 30s.
+	MaxRetryAfter time.Duration
+}
+
+// withDefaults validates the configuration, filling in the defaults.
+func (c BackoffConfig) withDefaults() (BackoffConfig, error) {
+	if c.Multiplier < 0 || c.MaxInterval < 0 || c.MaxRetryAfter < 0 {
+		return c, errors.New("the backoff must not be negative")
+	}
+	if 0 == c.Multiplier {
+		c.Multiplier = defaultBackoffMultiplier
+	}
+	if c.Multiplier < 1 {
+		return c, errors.New("the backoff multiplier must not be less than 1")
+	}
+	if 0 == c.MaxInterval {
+		c.MaxInterval = defaultMaxInterval
+	}
+	if 0 == c.MaxRetryAfter {
+		c.MaxRetryAfter = defaultMaxRetryAfter
+	}
+	return c, nil
+}
+
+// retryPolicy retries the delivery of an event.
+type retryPolicy struct {
+	retries     int
+	interval    time.Duration
+	maxInterval time.Duration
+	backoff     BackoffConfig
+
+	// shouldRetryStatus determines if a response with the status code is
+	// retried.  Failed requests are always retried, as are the 429 and 503
+	// responses with a Retry-After.
+	shouldRetryStatus func(int) bool
+
+	// updateRequest prepares the request for the next attempt.
+	updateRequest func(*http.Request)
+
+	// record is told the outcome of every attempt, if set.
+	record func(DeliveryAttempt)
+
+	logger  log.Logger
+	counter metrics.Counter
+
+	// sleep waits between attempts, giving up when the context is done.
+	sleep func(context.Context, time.Duration) error
+}
+
+// wait returns how long to wait before the attempt following the failed one.
+// attempt counts from 0.  The response is nil when the request failed.
+func (p retryPolicy) wait(attempt int, response *http.Response, now time.Time) (time.Duration, bool) {
+	if d, ok := retryAfter(response, now); ok {
+		return d, d <= p.backoff.MaxRetryAfter
+	}
+
+	d := float64(p.interval) * math.Pow(p.backoff.Multiplier, float64(attempt))
+	if 0 < p.maxInterval && float64(p.maxInterval) < d {
+		d = float64(p.maxInterval)
+	}
+	if !p.backoff.DisableJitter {
+		d = rand.Float64() * d
+	}
+	return time.Duration(d), true
+}
+
+// retryAfter returns the wait asked for by the Retry-After header of the
+// response, either in seconds or as an HTTP-date.
+func retryAfter(response *http.Response, now time.Time) (time.Duration, bool) {
+	if nil == response {
+		return 0, false
+	}
+	value := strings.TrimSpace(response.Header.Get("Retry-After"))
+	if "" == value {
+		return 0, false
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); nil == err {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); nil == err {
+		if d := date.Sub(now); 0 < d {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// asksToRetry determines if the response is a 429 or 503 saying when to try
+// again, which is retried whether or not its status is a retry code.
+func asksToRetry(response *http.Response) bool {
+	if http.StatusTooManyRequests != response.StatusCode && http.StatusServiceUnavailable != response.StatusCode {
+		return false
+	}
+	_, ok := retryAfter(response, time.Now())
+	return ok
+}
+
+// sleepContext waits for the duration unless the context is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// do sends the request with the body until it succeeds, isn't retryable or
+// runs out of retries.
+func (p retryPolicy) do(request *http.Request, body []byte, next func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	sleep := p.sleep
+	if nil == sleep {
+		sleep = sleepContext
+	}
+
+	for attempt := 0; ; attempt++ {
+		request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		response, err := next(request)
+		if nil != p.record {
+			a := DeliveryAttempt{Time: time.Now(), URL: request.URL.String()}
+			if nil != err {
+				a.Error = err.Error()
+			} else {
+				a.Status = response.StatusCode
+			}
+			p.record(a)
+		}
+
+		retry := nil != err || p.shouldRetryStatus(response.StatusCode) || asksToRetry(response)
+		if !retry || p.retries <= attempt {
+			return response, err
+		}
+
+		wait, ok := p.wait(attempt, response, time.Now())
+		if !ok {
+			// The webhook wants a break longer than we are willing to
+			// wait, so the delivery fails now.
+			return response, err
+		}
+
+		// The retried response is done with, so the connection can be
+		// reused.
+		if nil != response && nil != response.Body {
+			io.Copy(ioutil.Discard, response.Body)
+			response.Body.Close()
+		}
+
+		p.counter.Add(1.0)
+		level.Debug(p.logger).Log(logging.MessageKey(), "Retrying the delivery.",
+			"attempt", attempt+1, "wait", wait, logging.ErrorKey(), err)
+		if err := sleep(request.Context(), wait); nil != err {
+			return nil, err
+		}
+		p.updateRequest(request)
+	}
+}
+
+// attemptTimeout bounds each attempt sent by next with the timeout, the way
+// the timeout of the http client does, so a retry gets the full timeout
+// again.  The attempt is done with once its response body is closed.
+func attemptTimeout(timeout time.Duration, next func(*http.Request) (*http.Response, error)) func(*http.Request) (*http.Response, error) {
+	return func(request *http.Request) (*http.Response, error) {
+		ctx, cancel := context.WithTimeout(request.Context(), timeout)
+		response, err := next(request.WithContext(ctx))
+		if nil != err || nil == response.Body {
+			cancel()
+			return response, err
+		}
+		response.Body = &cancelOnClose{ReadCloser: response.Body, cancel: cancel}
+		return response, nil
+	}
+}
+
+// cancelOnClose releases the context of an attempt along with its response
+// body.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
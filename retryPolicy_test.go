@@ -0,0 +1,365 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackoffConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := BackoffConfig{}.withDefaults()
+	assert.Nil(err)
+	assert.Equal(BackoffConfig{
+		Multiplier:    defaultBackoffMultiplier,
+		MaxInterval:   defaultMaxInterval,
+		MaxRetryAfter: defaultMaxRetryAfter,
+	}, c)
+
+	_, err = BackoffConfig{Multiplier: 0.5}.withDefaults()
+	assert.NotNil(err)
+
+	_, err = BackoffConfig{MaxInterval: -time.Second}.withDefaults()
+	assert.NotNil(err)
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2021, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		description string
+		value       string
+		expected    time.Duration
+		expectedOK  bool
+	}{
+		{description: "None"},
+		{description: "Seconds", value: "120", expected: 2 * time.Minute, expectedOK: true},
+		{description: "Negative Seconds", value: "-1"},
+		{description: "Date", value: "Mon, 01 Mar 2021 12:00:30 GMT", expected: 30 * time.Second, expectedOK: true},
+		{description: "Past Date", value: "Mon, 01 Mar 2021 11:00:00 GMT", expectedOK: true},
+		{description: "Invalid", value: "soon"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			response := &http.Response{Header: http.Header{}}
+			if "" != tc.value {
+				response.Header.Set("Retry-After", tc.value)
+			}
+			d, ok := retryAfter(response, now)
+			assert.Equal(t, tc.expected, d)
+			assert.Equal(t, tc.expectedOK, ok)
+		})
+	}
+
+	_, ok := retryAfter(nil, now)
+	assert.False(t, ok)
+}
+
+func TestRetryPolicyWait(t *testing.T) {
+	assert := assert.New(t)
+
+	backoff, err := BackoffConfig{DisableJitter: true}.withDefaults()
+	require.Nil(t, err)
+	p := retryPolicy{
+		interval:    100 * time.Millisecond,
+		maxInterval: 300 * time.Millisecond,
+		backoff:     backoff,
+	}
+
+	for attempt, expected := range []time.Duration{100, 200, 300, 300} {
+		d, ok := p.wait(attempt, nil, time.Now())
+		assert.True(ok)
+		assert.Equal(expected*time.Millisecond, d)
+	}
+
+	// Full jitter waits anywhere up to the interval.
+	p.backoff.DisableJitter = false
+	for i := 0; i < 100; i++ {
+		d, _ := p.wait(3, nil, time.Now())
+		assert.True(0 <= d && d < 300*time.Millisecond)
+	}
+
+	// Retry-After wins over the backoff, as long as it isn't too long.
+	response := &http.Response{Header: http.Header{"Retry-After": {"10"}}}
+	d, ok := p.wait(0, response, time.Now())
+	assert.True(ok)
+	assert.Equal(10*time.Second, d)
+
+	response.Header.Set("Retry-After", "3600")
+	_, ok = p.wait(0, response, time.Now())
+	assert.False(ok)
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	backoff, err := BackoffConfig{DisableJitter: true}.withDefaults()
+	require.Nil(t, err)
+
+	tests := []struct {
+		description   string
+		responses     []*http.Response
+		errs          []error
+		expectedCode  int
+		expectedWaits []time.Duration
+	}{
+		{
+			description:  "Success",
+			responses:    []*http.Response{{StatusCode: 200}},
+			expectedCode: 200,
+		},
+		{
+			description: "Retry After",
+			responses: []*http.Response{
+				{StatusCode: 429, Header: http.Header{"Retry-After": {"2"}}},
+				{StatusCode: 200},
+			},
+			expectedCode:  200,
+			expectedWaits: []time.Duration{2 * time.Second},
+		},
+		{
+			description: "Retry After Too Long",
+			responses: []*http.Response{
+				{StatusCode: 429, Header: http.Header{"Retry-After": {"3600"}}},
+			},
+			expectedCode: 429,
+		},
+		{
+			description:   "Backoff",
+			responses:     []*http.Response{nil, nil, {StatusCode: 200}},
+			errs:          []error{errors.New("refused"), errors.New("refused"), nil},
+			expectedCode:  200,
+			expectedWaits: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond},
+		},
+		{
+			description:   "Out Of Retries",
+			responses:     []*http.Response{{StatusCode: 429}, {StatusCode: 429}, {StatusCode: 429}, {StatusCode: 429}},
+			expectedCode:  429,
+			expectedWaits: []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			var waits []time.Duration
+			var bodies []string
+			var attempts []DeliveryAttempt
+			updates := 0
+			p := retryPolicy{
+				retries:           3,
+				interval:          10 * time.Millisecond,
+				backoff:           backoff,
+				shouldRetryStatus: func(code int) bool { return 429 == code || 503 == code },
+				updateRequest:     func(*http.Request) { updates++ },
+				record:            func(a DeliveryAttempt) { attempts = append(attempts, a) },
+				logger:            log.NewNopLogger(),
+				counter:           permissiveRegistry().NewCounter(DeliveryRetryCounter),
+				sleep: func(_ context.Context, d time.Duration) error {
+					waits = append(waits, d)
+					return nil
+				},
+			}
+
+			attempt := 0
+			next := func(request *http.Request) (*http.Response, error) {
+				body, _ := ioutil.ReadAll(request.Body)
+				bodies = append(bodies, string(body))
+				response := tc.responses[attempt]
+				var err error
+				if attempt < len(tc.errs) {
+					err = tc.errs[attempt]
+				}
+				attempt++
+				return response, err
+			}
+
+			request, _ := http.NewRequest("POST", "http://localhost/foo", nil)
+			response, err := p.do(request, []byte("payload"), next)
+			assert.Nil(err)
+			require.NotNil(t, response)
+			assert.Equal(tc.expectedCode, response.StatusCode)
+			assert.Equal(tc.expectedWaits, waits)
+			assert.Equal(len(waits), updates)
+			assert.Equal(len(bodies), len(attempts))
+
+			// Every attempt sends the whole body.
+			assert.Equal(strings.Repeat("payload", len(bodies)), strings.Join(bodies, ""))
+		})
+	}
+}
+
+// The 429 and 503 responses saying when to try again are retried even when
+// their status isn't a retry code.
+func TestRetryPolicyRetryAfterStatus(t *testing.T) {
+	backoff, err := BackoffConfig{DisableJitter: true}.withDefaults()
+	require.Nil(t, err)
+
+	tests := []struct {
+		description  string
+		response     *http.Response
+		expectedCode int
+		retried      bool
+	}{
+		{
+			description: "503 With HTTP-date",
+			response: &http.Response{StatusCode: 503, Header: http.Header{
+				"Retry-After": {time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat)},
+			}},
+			expectedCode: 200,
+			retried:      true,
+		},
+		{
+			description:  "429 With Seconds",
+			response:     &http.Response{StatusCode: 429, Header: http.Header{"Retry-After": {"1"}}},
+			expectedCode: 200,
+			retried:      true,
+		},
+		{
+			description:  "503 Without Retry-After",
+			response:     &http.Response{StatusCode: 503},
+			expectedCode: 503,
+		},
+		{
+			description:  "500 With Retry-After",
+			response:     &http.Response{StatusCode: 500, Header: http.Header{"Retry-After": {"1"}}},
+			expectedCode: 500,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			var waits []time.Duration
+			p := retryPolicy{
+				retries:           3,
+				interval:          10 * time.Millisecond,
+				backoff:           backoff,
+				shouldRetryStatus: func(int) bool { return false },
+				updateRequest:     func(*http.Request) {},
+				logger:            log.NewNopLogger(),
+				counter:           permissiveRegistry().NewCounter(DeliveryRetryCounter),
+				sleep: func(_ context.Context, d time.Duration) error {
+					waits = append(waits, d)
+					return nil
+				},
+			}
+
+			responses := []*http.Response{tc.response, {StatusCode: 200}}
+			request, _ := http.NewRequest("POST", "http://localhost/foo", nil)
+			response, err := p.do(request, nil, func(*http.Request) (*http.Response, error) {
+				response := responses[0]
+				responses = responses[1:]
+				return response, nil
+			})
+			assert.Nil(err)
+			require.NotNil(t, response)
+			assert.Equal(tc.expectedCode, response.StatusCode)
+			if !tc.retried {
+				assert.Empty(waits)
+				return
+			}
+			require.Len(t, waits, 1)
+			assert.True(0 <= waits[0] && waits[0] <= 2*time.Second)
+		})
+	}
+}
+
+// A delivery out of time gives up waiting for the next attempt.
+func TestRetryPolicyCanceled(t *testing.T) {
+	assert := assert.New(t)
+
+	backoff, err := BackoffConfig{}.withDefaults()
+	require.Nil(t, err)
+	p := retryPolicy{
+		retries:           3,
+		interval:          time.Minute,
+		maxInterval:       time.Minute,
+		backoff:           backoff,
+		shouldRetryStatus: func(int) bool { return true },
+		updateRequest:     func(*http.Request) {},
+		logger:            log.NewNopLogger(),
+		counter:           permissiveRegistry().NewCounter(DeliveryRetryCounter),
+	}
+	p.backoff.DisableJitter = true
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	request, _ := http.NewRequest("POST", "http://localhost/foo", nil)
+	request = request.WithContext(ctx)
+
+	start := time.Now()
+	response, err := p.do(request, nil, func(*http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: 429}, nil
+	})
+	assert.Nil(response)
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.True(time.Since(start) < time.Second)
+}
+
+// The timeout bounds every attempt on its own, so the retries of a timed out
+// attempt get the full timeout again.
+func TestRetryPolicyAttemptTimeout(t *testing.T) {
+	assert := assert.New(t)
+
+	backoff, err := BackoffConfig{}.withDefaults()
+	require.Nil(t, err)
+	p := retryPolicy{
+		retries:           2,
+		interval:          time.Millisecond,
+		maxInterval:       time.Millisecond,
+		backoff:           backoff,
+		shouldRetryStatus: func(int) bool { return false },
+		updateRequest:     func(*http.Request) {},
+		logger:            log.NewNopLogger(),
+		counter:           permissiveRegistry().NewCounter(DeliveryRetryCounter),
+	}
+
+	var attempts []context.Context
+	next := func(request *http.Request) (*http.Response, error) {
+		attempts = append(attempts, request.Context())
+		if len(attempts) < 3 {
+			// The webhook hangs until the attempt times out.
+			<-request.Context().Done()
+			return nil, request.Context().Err()
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(strings.NewReader("ok"))}, nil
+	}
+
+	request, _ := http.NewRequest("POST", "http://localhost/foo", nil)
+	response, err := p.do(request, nil, attemptTimeout(100*time.Millisecond, next))
+	require.Nil(t, err)
+	assert.Equal(http.StatusOK, response.StatusCode)
+	assert.Len(attempts, 3)
+
+	// The last attempt stays alive until its response body is closed.
+	assert.Nil(attempts[2].Err())
+	response.Body.Close()
+	assert.Equal(context.Canceled, attempts[2].Err())
+}
@@ -0,0 +1,322 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/xmidt-org/webpa-common/logging"
+)
+
+const (
+	defaultRotationOverlap    = 24 * time.Hour
+	defaultMaxRotationOverlap = 7 * 24 * time.Hour
+)
+
+var (
+	errNoRotation          = errors.New("the webhook has no secret rotation")
+	errRotationOverlapping = errors.New("a rotation is already overlapping")
+)
+
+// The states of the secret of a webhook reported by the rotation API.
+const (
+	rotationNone        = "none"
+	rotationOverlapping = "overlapping"
+	rotationCompleted   = "completed"
+)
+
+// SecretRotationConfig configures the rotations of the secrets of the
+// webhooks.
+type SecretRotationConfig struct {
+	// DefaultOverlap is how long the deliveries are signed with both secrets
+	// when a rotation doesn't say.
+	// (Optional) defaults to 24h.
+	DefaultOverlap time.Duration
+
+	// MaxOverlap is the longest overlap a rotation may ask for.
+	// (Optional) defaults to 168h.
+	MaxOverlap time.Duration
+}
+
+// withDefaults validates the configuration, filling in the defaults.
+func (c SecretRotationConfig) withDefaults() (SecretRotationConfig, error) {
+	if c.DefaultOverlap < 0 || c.MaxOverlap < 0 {
+		return c, errors.New("the secret rotation overlap must not be negative")
+	}
+	if 0 == c.MaxOverlap {
+		c.MaxOverlap = defaultMaxRotationOverlap
+	}
+	if 0 == c.DefaultOverlap {
+		c.DefaultOverlap = defaultRotationOverlap
+		if c.MaxOverlap < c.DefaultOverlap {
+			c.DefaultOverlap = c.MaxOverlap
+		}
+	}
+	if c.MaxOverlap < c.DefaultOverlap {
+		return c, errors.New("the secret rotation default overlap must not be longer than the maximum")
+	}
+	return c, nil
+}
+
+// SecretRotation replaces the secret of a webhook.  Until the overlap ends
+// the deliveries are signed with both the old and the new secret, so the
+// consumers can move to the new one at their own pace, and afterwards with
+// the new secret alone.  The rotation is kept with the webhook options until
+// the webhook is registered with the new secret.
+type SecretRotation struct {
+	// Secret is the new secret.
+	Secret string `json:"secret"`
+
+	// Previous is the old secret when it came from an earlier rotation
+	// rather than the registration.
+	Previous string `json:"previous,omitempty"`
+
+	Started time.Time `json:"started"`
+	Until   time.Time `json:"until"`
+}
+
+// overlapping determines if the deliveries are signed with both secrets at
+// the time.
+func (r *SecretRotation) overlapping(now time.Time) bool {
+	return now.Before(r.Until)
+}
+
+// secrets returns the secrets to sign with at the time, given the registered
+// one, the old secret first.
+func (r *SecretRotation) secrets(registered string, now time.Time) []string {
+	if nil == r || "" == r.Secret || r.Secret == registered {
+		if "" == registered {
+			return nil
+		}
+		return []string{registered}
+	}
+	if !r.overlapping(now) {
+		return []string{r.Secret}
+	}
+
+	old := registered
+	if "" != r.Previous {
+		old = r.Previous
+	}
+	if "" == old || old == r.Secret {
+		return []string{r.Secret}
+	}
+	return []string{old, r.Secret}
+}
+
+// SecretRotationRequest starts the rotation of the secret of a webhook.
+type SecretRotationRequest struct {
+	Secret  string       `json:"secret"`
+	Overlap jsonDuration `json:"overlap,omitempty"`
+}
+
+// SecretRotationReport is the state of the secret of a webhook.  The secrets
+// themselves are never reported.
+type SecretRotationReport struct {
+	Webhook string     `json:"webhook"`
+	State   string     `json:"state"`
+	Started *time.Time `json:"started,omitempty"`
+	Until   *time.Time `json:"until,omitempty"`
+}
+
+// secretRotationHandler serves the API to start, inspect and complete the
+// rotations of the secrets of the webhooks.  The webhook is selected by its
+// id in the query, and the rotation is kept with its options, so it is the
+// one the sender of the webhook signs with.  Only the owner of the webhook
+// may rotate its secret and, with partner isolation, only if allowed every
+// partner of the webhook.
+type secretRotationHandler struct {
+	store     WebhookOptionsStore
+	isolation PartnerIsolationConfig
+	config    SecretRotationConfig
+	now       func() time.Time
+}
+
+// report returns the state of the rotation of the webhook at the time.
+func (h secretRotationHandler) report(webhook string, r *SecretRotation, now time.Time) SecretRotationReport {
+	report := SecretRotationReport{Webhook: webhook, State: rotationNone}
+	if nil == r {
+		return report
+	}
+
+	started, until := r.Started, r.Until
+	report.Started, report.Until = &started, &until
+	report.State = rotationCompleted
+	if r.overlapping(now) {
+		report.State = rotationOverlapping
+	}
+	return report
+}
+
+// options returns the webhook in the query with its options, responding with
+// an error if there is none, it isn't registered or the request isn't allowed
+// to act on it.
+func (h secretRotationHandler) options(response http.ResponseWriter, request *http.Request) (string, WebhookOptions, bool) {
+	webhook := request.URL.Query().Get("webhook")
+	if "" == webhook {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write([]byte("The webhook query parameter is required.\n"))
+		return "", WebhookOptions{}, false
+	}
+
+	options := h.store.Get(webhook)
+	if !authorizeWebhook(response, request, h.isolation, options) {
+		return "", WebhookOptions{}, false
+	}
+	return webhook, options, true
+}
+
+func (h secretRotationHandler) timeNow() time.Time {
+	if nil == h.now {
+		return time.Now()
+	}
+	return h.now()
+}
+
+// ServeGet reports the rotation of the secret of a webhook.
+func (h secretRotationHandler) ServeGet(response http.ResponseWriter, request *http.Request) {
+	if webhook, options, ok := h.options(response, request); ok {
+		writeJSON(response, request, http.StatusOK, h.report(webhook, options.SecretRotation, h.timeNow()))
+	}
+}
+
+// ServeStart starts the rotation of the secret of a webhook.  A rotation
+// can't start while another one overlaps.
+func (h secretRotationHandler) ServeStart(response http.ResponseWriter, request *http.Request) {
+	webhook, options, ok := h.options(response, request)
+	if !ok {
+		return
+	}
+
+	var rotation SecretRotationRequest
+	if err := json.NewDecoder(request.Body).Decode(&rotation); nil != err {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write([]byte(fmt.Sprintf("Invalid rotation: %s\n", err)))
+		return
+	}
+
+	overlap := time.Duration(rotation.Overlap)
+	if 0 == overlap {
+		overlap = h.config.DefaultOverlap
+	}
+	var err error
+	switch {
+	case "" == rotation.Secret:
+		err = errors.New("secret is required")
+	case overlap < 0 || h.config.MaxOverlap < overlap:
+		err = fmt.Errorf("overlap must be between 0s and %s", h.config.MaxOverlap)
+	}
+	if nil != err {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write([]byte(fmt.Sprintf("Invalid rotation: %s\n", err)))
+		return
+	}
+
+	now := h.timeNow()
+	next := &SecretRotation{
+		Secret:  rotation.Secret,
+		Started: now,
+		Until:   now.Add(overlap),
+	}
+	if !h.update(response, request, webhook, options, func(o *WebhookOptions) error {
+		next.Previous = ""
+		if previous := o.SecretRotation; nil != previous {
+			if previous.overlapping(now) {
+				return errRotationOverlapping
+			}
+			// The webhook is still registered with the secret the last
+			// rotation retired.
+			next.Previous = previous.Secret
+		}
+		o.SecretRotation = next
+		return nil
+	}) {
+		return
+	}
+	level.Info(logging.GetLogger(request.Context())).Log(logging.MessageKey(), "Started secret rotation.",
+		"webhook", webhook, "until", next.Until)
+	writeJSON(response, request, http.StatusOK, h.report(webhook, next, now))
+}
+
+// ServeComplete retires the old secret of a webhook now, rather than when
+// the overlap ends.
+func (h secretRotationHandler) ServeComplete(response http.ResponseWriter, request *http.Request) {
+	webhook, options, ok := h.options(response, request)
+	if !ok {
+		return
+	}
+
+	now := h.timeNow()
+	completed := false
+	if !h.update(response, request, webhook, options, func(o *WebhookOptions) error {
+		if nil == o.SecretRotation {
+			return errNoRotation
+		}
+		completed = o.SecretRotation.overlapping(now)
+		if completed {
+			r := *o.SecretRotation
+			r.Until = now
+			o.SecretRotation = &r
+		}
+		options = *o
+		return nil
+	}) {
+		return
+	}
+	if completed {
+		level.Info(logging.GetLogger(request.Context())).Log(logging.MessageKey(), "Completed secret rotation.",
+			"webhook", webhook)
+	}
+	writeJSON(response, request, http.StatusOK, h.report(webhook, options.SecretRotation, now))
+}
+
+// update applies the change to the options of the webhook as they are
+// stored, responding with an error if the webhook changed hands since it was
+// authorized, the change fails or the options couldn't be stored.
+func (h secretRotationHandler) update(response http.ResponseWriter, request *http.Request, webhook string, authorized WebhookOptions, change func(*WebhookOptions) error) bool {
+	err := h.store.Update(request.Context(), webhook, func(o *WebhookOptions) error {
+		if o.Owner != authorized.Owner || o.Registered.IsZero() {
+			return errOptionsChanged
+		}
+		return change(o)
+	})
+
+	switch err {
+	case nil:
+		return true
+	case errNoRotation:
+		response.WriteHeader(http.StatusNotFound)
+		response.Write([]byte("The webhook has no secret rotation.\n"))
+	case errRotationOverlapping:
+		response.WriteHeader(http.StatusConflict)
+		response.Write([]byte("A rotation is already overlapping, complete it first.\n"))
+	case errOptionsChanged:
+		response.WriteHeader(http.StatusConflict)
+		response.Write([]byte("The webhook changed meanwhile, try again.\n"))
+	default:
+		level.Error(logging.GetLogger(request.Context())).Log(logging.MessageKey(), "Unable to store webhook options",
+			"webhook", webhook, logging.ErrorKey(), err)
+		response.WriteHeader(http.StatusInternalServerError)
+		response.Write([]byte("Unable to store webhook options.\n"))
+	}
+	return false
+}
@@ -0,0 +1,347 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/webpa-common/secure/handler"
+)
+
+func TestSecretRotationConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := SecretRotationConfig{}.withDefaults()
+	assert.Nil(err)
+	assert.Equal(SecretRotationConfig{DefaultOverlap: 24 * time.Hour, MaxOverlap: 7 * 24 * time.Hour}, c)
+
+	c, err = SecretRotationConfig{MaxOverlap: time.Hour}.withDefaults()
+	assert.Nil(err)
+	assert.Equal(time.Hour, c.DefaultOverlap)
+
+	_, err = SecretRotationConfig{DefaultOverlap: 2 * time.Hour, MaxOverlap: time.Hour}.withDefaults()
+	assert.NotNil(err)
+
+	_, err = SecretRotationConfig{DefaultOverlap: -time.Hour}.withDefaults()
+	assert.NotNil(err)
+}
+
+func TestSecretRotationSecrets(t *testing.T) {
+	started := time.Unix(1600000000, 0)
+	until := started.Add(time.Hour)
+
+	tests := []struct {
+		description string
+		rotation    *SecretRotation
+		registered  string
+		now         time.Time
+		expected    []string
+	}{
+		{
+			description: "No Rotation",
+			registered:  "old",
+			expected:    []string{"old"},
+		},
+		{
+			description: "No Secret",
+		},
+		{
+			description: "Overlapping",
+			rotation:    &SecretRotation{Secret: "new", Started: started, Until: until},
+			registered:  "old",
+			now:         started,
+			expected:    []string{"old", "new"},
+		},
+		{
+			description: "Retired",
+			rotation:    &SecretRotation{Secret: "new", Started: started, Until: until},
+			registered:  "old",
+			now:         until,
+			expected:    []string{"new"},
+		},
+		{
+			description: "Registered With The New Secret",
+			rotation:    &SecretRotation{Secret: "new", Started: started, Until: until},
+			registered:  "new",
+			now:         started,
+			expected:    []string{"new"},
+		},
+		{
+			description: "Previous Rotation",
+			rotation:    &SecretRotation{Secret: "newer", Previous: "new", Started: started, Until: until},
+			registered:  "old",
+			now:         started,
+			expected:    []string{"new", "newer"},
+		},
+		{
+			description: "Secret Added",
+			rotation:    &SecretRotation{Secret: "new", Started: started, Until: until},
+			now:         started,
+			expected:    []string{"new"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.rotation.secrets(tc.registered, tc.now))
+		})
+	}
+}
+
+func TestSecretRotationHandler(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	config, err := SecretRotationConfig{DefaultOverlap: time.Hour, MaxOverlap: 24 * time.Hour}.withDefaults()
+	require.Nil(err)
+
+	now := time.Unix(1600000000, 0).UTC()
+	store := newMemoryOptionsStore()
+	store.Put(context.Background(), "http://localhost/foo", WebhookOptions{MaxPayloadSize: 1, Registered: now})
+	h := secretRotationHandler{
+		store:  store,
+		config: config,
+		now:    func() time.Time { return now },
+	}
+
+	serve := func(f http.HandlerFunc, url, body string) (int, SecretRotationReport) {
+		w := httptest.NewRecorder()
+		f(w, httptest.NewRequest("POST", url, strings.NewReader(body)))
+
+		var report SecretRotationReport
+		if http.StatusOK == w.Code {
+			require.Nil(json.Unmarshal(w.Body.Bytes(), &report))
+		}
+		return w.Code, report
+	}
+
+	status, report := serve(h.ServeGet, "/hook/rotation?webhook=http://localhost/foo", "")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal(SecretRotationReport{Webhook: "http://localhost/foo", State: rotationNone}, report)
+
+	status, _ = serve(h.ServeGet, "/hook/rotation", "")
+	assert.Equal(http.StatusBadRequest, status)
+
+	status, _ = serve(h.ServeStart, "/hook/rotation?webhook=http://localhost/bar", `{"secret":"new"}`)
+	assert.Equal(http.StatusNotFound, status)
+	assert.Equal(WebhookOptions{}, store.Get("http://localhost/bar"))
+
+	status, _ = serve(h.ServeComplete, "/hook/rotation/complete?webhook=http://localhost/foo", "")
+	assert.Equal(http.StatusNotFound, status)
+
+	status, _ = serve(h.ServeStart, "/hook/rotation?webhook=http://localhost/foo", `{"overlap":"1h"}`)
+	assert.Equal(http.StatusBadRequest, status)
+
+	status, _ = serve(h.ServeStart, "/hook/rotation?webhook=http://localhost/foo", `{"secret":"new","overlap":"48h"}`)
+	assert.Equal(http.StatusBadRequest, status)
+	assert.Nil(store.Get("http://localhost/foo").SecretRotation)
+
+	// The default overlap applies.
+	status, report = serve(h.ServeStart, "/hook/rotation?webhook=http://localhost/foo", `{"secret":"new"}`)
+	assert.Equal(http.StatusOK, status)
+	assert.Equal(rotationOverlapping, report.State)
+	require.NotNil(report.Until)
+	assert.Equal(now.Add(time.Hour), *report.Until)
+	assert.Equal(&SecretRotation{Secret: "new", Started: now, Until: now.Add(time.Hour)},
+		store.Get("http://localhost/foo").SecretRotation)
+	assert.Equal(1, store.Get("http://localhost/foo").MaxPayloadSize)
+
+	status, _ = serve(h.ServeStart, "/hook/rotation?webhook=http://localhost/foo", `{"secret":"newer"}`)
+	assert.Equal(http.StatusConflict, status)
+
+	now = now.Add(time.Minute)
+	status, report = serve(h.ServeComplete, "/hook/rotation/complete?webhook=http://localhost/foo", "")
+	assert.Equal(http.StatusOK, status)
+	assert.Equal(rotationCompleted, report.State)
+	assert.Equal(now, store.Get("http://localhost/foo").SecretRotation.Until)
+
+	// The secret retired by the last rotation overlaps with the next one.
+	status, report = serve(h.ServeStart, "/hook/rotation?webhook=http://localhost/foo", `{"secret":"newer","overlap":"30m"}`)
+	assert.Equal(http.StatusOK, status)
+	assert.Equal(rotationOverlapping, report.State)
+	assert.Equal(&SecretRotation{Secret: "newer", Previous: "new", Started: now, Until: now.Add(30 * time.Minute)},
+		store.Get("http://localhost/foo").SecretRotation)
+}
+
+// A rotation only applies to the registration of the owner it is for, not to
+// the other registrations of the URL.
+func TestSecretRotationHandlerWebhookID(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := SecretRotationConfig{}.withDefaults()
+	require.Nil(t, err)
+	store := newMemoryOptionsStore()
+	h := secretRotationHandler{store: store, config: config}
+
+	id := webhookID("client", "http://localhost/foo")
+	store.Put(context.Background(), id, WebhookOptions{MaxPayloadSize: 1, Owner: "client", Registered: time.Now()})
+	store.Put(context.Background(), "http://localhost/foo", WebhookOptions{Registered: time.Now()})
+
+	start := func(values *handler.ContextValues, id string) int {
+		request := httptest.NewRequest("POST", "/hook/rotation?webhook="+url.QueryEscape(id), strings.NewReader(`{"secret":"new"}`))
+		request = request.WithContext(handler.NewContextWithValue(request.Context(), values))
+		response := httptest.NewRecorder()
+		h.ServeStart(response, request)
+		return response.Code
+	}
+
+	assert.Equal(http.StatusOK, start(&handler.ContextValues{SatClientID: "client"}, id))
+	assert.NotNil(store.Get(id).SecretRotation)
+	assert.Equal(1, store.Get(id).MaxPayloadSize)
+	assert.Nil(store.Get("http://localhost/foo").SecretRotation)
+
+	// Only the owner may rotate the secret, whoever else knows the id.
+	assert.Equal(http.StatusForbidden, start(&handler.ContextValues{SatClientID: "other"}, id))
+	assert.Equal(http.StatusForbidden, start(&handler.ContextValues{SatClientID: "client"}, "http://localhost/foo"))
+	assert.Nil(store.Get("http://localhost/foo").SecretRotation)
+}
+
+// The rotation is made to the options as stored, and not made if the webhook
+// changed hands since it was authorized.
+func TestSecretRotationHandlerUpdate(t *testing.T) {
+	assert := assert.New(t)
+
+	config, err := SecretRotationConfig{}.withDefaults()
+	require.Nil(t, err)
+	store := newMemoryOptionsStore()
+	h := secretRotationHandler{store: store, config: config}
+
+	tests := []struct {
+		description    string
+		stored         WebhookOptions
+		expectedStatus int
+	}{
+		{
+			description:    "Renewed",
+			stored:         WebhookOptions{MaxPayloadSize: 1, Registered: time.Now()},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			description:    "Rotated",
+			stored:         WebhookOptions{Registered: time.Now(), SecretRotation: &SecretRotation{Secret: "other", Until: time.Now().Add(time.Hour)}},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			description:    "Other Owner",
+			stored:         WebhookOptions{Owner: "other", Registered: time.Now()},
+			expectedStatus: http.StatusConflict,
+		},
+		{
+			description:    "Removed",
+			expectedStatus: http.StatusConflict,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			store.Put(context.Background(), "http://localhost/foo", WebhookOptions{Registered: time.Now()})
+			authorized := store.Get("http://localhost/foo")
+			store.Put(context.Background(), "http://localhost/foo", tc.stored)
+
+			request := httptest.NewRequest("POST", "/hook/rotation?webhook=http://localhost/foo", nil)
+			response := httptest.NewRecorder()
+			ok := h.update(response, request, "http://localhost/foo", authorized, func(o *WebhookOptions) error {
+				if nil != o.SecretRotation {
+					return errRotationOverlapping
+				}
+				o.SecretRotation = &SecretRotation{Secret: "new"}
+				return nil
+			})
+
+			assert.Equal(http.StatusOK == tc.expectedStatus, ok)
+			assert.Equal(tc.expectedStatus, response.Code)
+			if ok {
+				assert.Equal(tc.stored.MaxPayloadSize, store.Get("http://localhost/foo").MaxPayloadSize)
+				assert.Equal("new", store.Get("http://localhost/foo").SecretRotation.Secret)
+			} else {
+				assert.Equal(tc.stored, store.Get("http://localhost/foo"))
+			}
+		})
+	}
+}
+
+func TestSecretRotationHandlerPartnerIsolation(t *testing.T) {
+	tests := []struct {
+		description    string
+		values         *handler.ContextValues
+		partnerIDs     []string
+		expectedStatus int
+	}{
+		{
+			description:    "Partner Of The Webhook",
+			values:         &handler.ContextValues{SatClientID: "client", PartnerIDs: []string{"comcast"}},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			description:    "Privileged Other Owner",
+			values:         &handler.ContextValues{SatClientID: "admin", PartnerIDs: []string{"*"}},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			description:    "Other Partner",
+			values:         &handler.ContextValues{SatClientID: "client", PartnerIDs: []string{"other"}},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			description:    "One Of The Partners",
+			values:         &handler.ContextValues{SatClientID: "client", PartnerIDs: []string{"comcast"}},
+			partnerIDs:     []string{"comcast", "other"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			description:    "No Token",
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			partnerIDs := tc.partnerIDs
+			if nil == partnerIDs {
+				partnerIDs = []string{"comcast"}
+			}
+			store := newMemoryOptionsStore()
+			store.Put(context.Background(), "http://localhost/foo", WebhookOptions{Owner: "client", Registered: time.Now(), PartnerIDs: partnerIDs})
+
+			h := secretRotationHandler{
+				store: store,
+				isolation: PartnerIsolationConfig{
+					Enabled:           true,
+					PrivilegedClients: []string{"admin"},
+				},
+			}
+
+			request := httptest.NewRequest("GET", "/hook/rotation?webhook=http://localhost/foo", nil)
+			if nil != tc.values {
+				request = request.WithContext(handler.NewContextWithValue(request.Context(), tc.values))
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeGet(w, request)
+			assert.Equal(t, tc.expectedStatus, w.Code)
+		})
+	}
+}
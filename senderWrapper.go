@@ -19,12 +19,18 @@ package main
 import (
 	"errors"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/go-kit/kit/metrics"
 	"github.com/xmidt-org/ancla"
+	"github.com/xmidt-org/webpa-common/logging"
 	"github.com/xmidt-org/wrp-go/v3"
 )
 
@@ -52,6 +58,10 @@ type SenderWrapperFactory struct {
 	// shutting them down and cleaning up the resources associated with them.
 	Linger time.Duration
 
+	// Whether the OutboundSenders of removed webhooks deliver the messages
+	// they already queued before shutting down, instead of dropping them.
+	DrainRemoved bool
+
 	// Metrics registry.
 	MetricsRegistry CaduceusMetricsRegistry
 
@@ -65,11 +75,58 @@ type SenderWrapperFactory struct {
 
 	// The http client Do() function to share with OutboundSenders.
 	Sender func(*http.Request) (*http.Response, error)
+
+	// The trackers of messages waiting for their delivery, shared with
+	// OutboundSenders.
+	DeliveryTrackers *deliveryTrackers
+
+	// The options of the webhooks, shared with OutboundSenders.
+	Options WebhookOptionsStore
+
+	// Whether the OutboundSenders only deliver the events of the partners
+	// their webhook is bound to.
+	PartnerIsolation bool
+
+	// The pool of delivery workers shared by the OutboundSenders instead
+	// of NumWorkersPerSender each.
+	WorkerPool WorkerPoolConfig
+
+	// The budget of the messages queued across all OutboundSenders.
+	QueueBudget *queueBudget
+
+	// The bounds the webhooks may set their own delivery settings within.
+	DeliveryBounds DeliveryBounds
+
+	// The longest a gentle shutdown waits for the OutboundSenders to deliver
+	// what they queued, before spilling the rest to SpillDirectory.
+	// 0 waits for as long as it takes.
+	ShutdownTimeout time.Duration
+
+	// The directory the OutboundSenders spill their queued messages to at
+	// the shutdown deadline and queue them again from on start.
+	SpillDirectory string
+
+	// The durable queues of the webhooks opting in to them.
+	DurableQueue DurableQueueConfig
+
+	// The backoff between the delivery attempts of an event.
+	Backoff BackoffConfig
+
+	// The store of the events the OutboundSenders couldn't deliver.
+	DeadLetters *deadLetterStore
+
+	// The circuit breakers of the URLs of the webhooks.
+	CircuitBreaker CircuitBreakerConfig
+
+	// How the deliveries are signed, unless the webhooks chose otherwise.
+	Signature SignatureConfig
 }
 
 type SenderWrapper interface {
 	Update([]ancla.Webhook)
 	Queue(*wrp.Message)
+	Match(*wrp.Message) []MatchResult
+	Redeliver(string, *wrp.Message) bool
 	Shutdown(bool)
 }
 
@@ -83,13 +140,31 @@ type CaduceusSenderWrapper struct {
 	retryCodes          []int
 	cutOffPeriod        time.Duration
 	linger              time.Duration
+	drainRemoved        bool
 	logger              log.Logger
 	mutex               sync.RWMutex
 	senders             map[string]OutboundSender
+	events              map[string][]string
+	index               *eventIndex
 	metricsRegistry     CaduceusMetricsRegistry
 	eventType           metrics.Counter
+	removedWebhooks     metrics.Counter
 	wg                  sync.WaitGroup
 	shutdown            chan struct{}
+	deliveryTrackers    *deliveryTrackers
+	options             WebhookOptionsStore
+	partnerIsolation    bool
+	workerPool          *workerPool
+	queueBudget         *queueBudget
+	deliveryBounds      DeliveryBounds
+	shutdownTimeout     time.Duration
+	spillDirectory      string
+	durableQueue        DurableQueueConfig
+	backoff             BackoffConfig
+	deadLetters         *deadLetterStore
+	circuitBreaker      CircuitBreakerConfig
+	signature           SignatureConfig
+	retiring            map[OutboundSender]bool
 }
 
 // New produces a new SenderWrapper implemented by CaduceusSenderWrapper
@@ -104,8 +179,17 @@ func (swf SenderWrapperFactory) New() (sw SenderWrapper, err error) {
 		retryCodes:          swf.RetryCodes,
 		cutOffPeriod:        swf.CutOffPeriod,
 		linger:              swf.Linger,
+		drainRemoved:        swf.DrainRemoved,
 		logger:              swf.Logger,
 		metricsRegistry:     swf.MetricsRegistry,
+		deliveryTrackers:    swf.DeliveryTrackers,
+		options:             swf.Options,
+		partnerIsolation:    swf.PartnerIsolation,
+		queueBudget:         swf.QueueBudget,
+		deliveryBounds:      swf.DeliveryBounds,
+		shutdownTimeout:     swf.ShutdownTimeout,
+		spillDirectory:      swf.SpillDirectory,
+		deadLetters:         swf.DeadLetters,
 	}
 
 	if swf.Linger <= 0 {
@@ -114,9 +198,49 @@ func (swf SenderWrapperFactory) New() (sw SenderWrapper, err error) {
 		return
 	}
 
+	caduceusSenderWrapper.workerPool, err = swf.WorkerPool.New(swf.MetricsRegistry)
+	if nil != err {
+		sw = nil
+		return
+	}
+
+	if "" != swf.SpillDirectory {
+		if err = os.MkdirAll(swf.SpillDirectory, 0700); nil != err {
+			sw = nil
+			return
+		}
+	}
+
+	caduceusSenderWrapper.durableQueue, err = swf.DurableQueue.withDefaults()
+	if nil != err {
+		sw = nil
+		return
+	}
+
+	caduceusSenderWrapper.backoff, err = swf.Backoff.withDefaults()
+	if nil != err {
+		sw = nil
+		return
+	}
+
+	caduceusSenderWrapper.circuitBreaker, err = swf.CircuitBreaker.withDefaults()
+	if nil != err {
+		sw = nil
+		return
+	}
+
+	caduceusSenderWrapper.signature, err = swf.Signature.withDefaults()
+	if nil != err {
+		sw = nil
+		return
+	}
+
 	caduceusSenderWrapper.eventType = swf.MetricsRegistry.NewCounter(IncomingEventTypeCounter)
+	caduceusSenderWrapper.removedWebhooks = swf.MetricsRegistry.NewCounter(RemovedWebhookCounter)
 
 	caduceusSenderWrapper.senders = make(map[string]OutboundSender)
+	caduceusSenderWrapper.events = make(map[string][]string)
+	caduceusSenderWrapper.retiring = make(map[OutboundSender]bool)
 	caduceusSenderWrapper.shutdown = make(chan struct{})
 
 	caduceusSenderWrapper.wg.Add(1)
@@ -127,8 +251,9 @@ func (swf SenderWrapperFactory) New() (sw SenderWrapper, err error) {
 }
 
 // Update is called when we get changes to our webhook listeners with either
-// additions, or updates.  This code takes care of building new OutboundSenders
-// and maintaining the existing OutboundSenders.
+// additions, updates, or removals.  This code takes care of building new
+// OutboundSenders, maintaining the existing OutboundSenders and retiring the
+// OutboundSenders of the webhooks no longer in the list.
 func (sw *CaduceusSenderWrapper) Update(list []ancla.Webhook) {
 	// We'll like need this, so let's get one ready
 	osf := OutboundSenderFactory{
@@ -141,32 +266,168 @@ func (sw *CaduceusSenderWrapper) Update(list []ancla.Webhook) {
 		DeliveryInterval: sw.deliveryInterval,
 		RetryCodes:       sw.retryCodes,
 		Logger:           sw.logger,
+		DeliveryTrackers: sw.deliveryTrackers,
+		Options:          sw.options,
+		PartnerIsolation: sw.partnerIsolation,
+		WorkerPool:       sw.workerPool,
+		QueueBudget:      sw.queueBudget,
+		DeliveryBounds:   sw.deliveryBounds,
+		SpillDirectory:   sw.spillDirectory,
+		DurableQueue:     sw.durableQueue,
+		Backoff:          sw.backoff,
+		DeadLetters:      sw.deadLetters,
+		CircuitBreaker:   sw.circuitBreaker,
+		Signature:        sw.signature,
 	}
 
-	ids := make([]struct {
-		Listener ancla.Webhook
-		ID       string
-	}, len(list))
-
-	for i, v := range list {
-		ids[i].Listener = v
-		ids[i].ID = v.Config.URL
+	ids, latest := sw.registrations(list, time.Now())
+	listed := make(map[string]bool, len(ids))
+	for _, r := range ids {
+		listed[r.ID] = true
 	}
 
+	removed := make(map[string]OutboundSender)
+
 	sw.mutex.Lock()
+	// The senders of removed webhooks stop being given messages right away
+	// instead of lingering until their registration expires.
+	for k, v := range sw.senders {
+		if !listed[k] {
+			removed[k] = v
+			delete(sw.senders, k)
+			delete(sw.events, k)
+		}
+	}
 	for _, inValue := range ids {
 		sender, ok := sw.senders[inValue.ID]
 		if !ok {
+			// The latest registration of a URL takes over what was queued
+			// for the URL when the webhooks were keyed by URL, unless
+			// the sender keyed by URL is still around.
+			legacy := webhookID("", inValue.Listener.Config.URL)
+			if _, running := removed[legacy]; latest[inValue.Listener.Config.URL] == inValue.ID && legacy != inValue.ID && !running {
+				sw.adopt(legacy, inValue.ID)
+			}
+
 			osf.Listener = inValue.Listener
+			osf.ID = inValue.ID
 			obs, err := osf.New()
 			if nil == err {
 				sw.senders[inValue.ID] = obs
+				sw.events[inValue.ID] = inValue.Listener.Events
+			}
+			continue
+		}
+		// The sender keeps its previous events when it rejects the update,
+		// so the index must too.
+		if nil == sender.Update(inValue.Listener) {
+			sw.events[inValue.ID] = inValue.Listener.Events
+		}
+	}
+	sw.index = newEventIndex(sw.events)
+	sw.mutex.Unlock()
+
+	for k, v := range removed {
+		sw.retire(k, v)
+	}
+}
+
+// registeredWebhook is a webhook registered by an owner.
+type registeredWebhook struct {
+	Listener ancla.Webhook
+	ID       string
+}
+
+// registrations returns the webhooks to deliver to: the registrations of
+// every owner that haven't expired, and the webhooks listed by ancla without
+// any, keyed by their URL.  ancla keeps a single webhook per URL, the last
+// one registered, so the registrations of the owners are taken from the
+// options store and each expires on its own.  A registration is only
+// delivered to while ancla still lists its URL though, so a webhook deleted
+// from ancla is gone for every owner.  The id of the latest registration of
+// each URL is returned too.
+func (sw *CaduceusSenderWrapper) registrations(list []ancla.Webhook, now time.Time) ([]registeredWebhook, map[string]string) {
+	var webhooks []registeredWebhook
+	latest := make(map[string]string)
+	registered := make(map[string]time.Time)
+	listed := make(map[string]bool, len(list))
+	for _, w := range list {
+		listed[w.Config.URL] = true
+	}
+	if nil != sw.options {
+		for _, id := range sw.options.Registrations() {
+			options := sw.options.Get(id)
+			if nil == options.Registration || !now.Before(options.Registration.Until) ||
+				!listed[options.Registration.Config.URL] {
+				continue
+			}
+			url := options.Registration.Config.URL
+			webhooks = append(webhooks, registeredWebhook{Listener: *options.Registration, ID: id})
+			if t, ok := registered[url]; !ok || t.Before(options.Registered) {
+				registered[url] = options.Registered
+				latest[url] = id
 			}
+		}
+	}
+
+	// Webhooks registered without keeping their registration are delivered
+	// as ancla has them.
+	for _, w := range list {
+		if _, ok := registered[w.Config.URL]; !ok {
+			webhooks = append(webhooks, registeredWebhook{Listener: w, ID: webhookID("", w.Config.URL)})
+		}
+	}
+	return webhooks, latest
+}
+
+// adopt moves the spilled messages and the durable queue of the legacy id,
+// the URL alone, to the webhook with the id, unless it has its own already.
+func (sw *CaduceusSenderWrapper) adopt(legacy, id string) {
+	var moves [][2]string
+	if "" != sw.spillDirectory {
+		moves = append(moves, [2]string{spillFile(sw.spillDirectory, legacy), spillFile(sw.spillDirectory, id)})
+	}
+	if sw.durableQueue.enabled() {
+		moves = append(moves, [2]string{
+			filepath.Join(sw.durableQueue.Directory, webhookFileName(legacy)),
+			filepath.Join(sw.durableQueue.Directory, webhookFileName(id)),
+		})
+	}
+
+	for _, m := range moves {
+		if _, err := os.Stat(m[1]); !os.IsNotExist(err) {
 			continue
 		}
-		sender.Update(inValue.Listener)
+		if err := os.Rename(m[0], m[1]); nil == err {
+			level.Info(sw.logger).Log(logging.MessageKey(), "Moved the queued messages of the URL to its latest registration.",
+				"from", legacy, "url", id)
+		} else if !os.IsNotExist(err) {
+			level.Error(sw.logger).Log(logging.MessageKey(), "Failed to move the queued messages of the URL to its latest registration.",
+				"from", legacy, "url", id, logging.ErrorKey(), err)
+		}
 	}
+}
+
+// retire shuts down the OutboundSender of a removed webhook in the
+// background, delivering what it has queued first if configured to.
+func (sw *CaduceusSenderWrapper) retire(id string, obs OutboundSender) {
+	level.Info(sw.logger).Log(logging.MessageKey(), "Retiring the sender of a removed webhook.",
+		"url", id, "drain", sw.drainRemoved)
+	sw.removedWebhooks.With("url", id).Add(1.0)
+
+	sw.mutex.Lock()
+	sw.retiring[obs] = true
 	sw.mutex.Unlock()
+
+	sw.wg.Add(1)
+	go func() {
+		defer sw.wg.Done()
+		obs.Shutdown(sw.drainRemoved)
+
+		sw.mutex.Lock()
+		delete(sw.retiring, obs)
+		sw.mutex.Unlock()
+	}()
 }
 
 // Queue is used to send all the possible outbound senders a request.  This
@@ -176,10 +437,38 @@ func (sw *CaduceusSenderWrapper) Queue(msg *wrp.Message) {
 
 	sw.eventType.With("event", msg.FindEventStringSubMatch())
 
+	// Only the senders with an event matching the message are given it.
+	sw.index.match(strings.TrimPrefix(msg.Destination, "event:"), func(id string) {
+		sw.senders[id].Queue(msg)
+	})
+	sw.mutex.RUnlock()
+}
+
+// Match explains for every webhook if and why the message would be delivered
+// to it, without delivering it.  The results are ordered by webhook.
+func (sw *CaduceusSenderWrapper) Match(msg *wrp.Message) []MatchResult {
+	sw.mutex.RLock()
+	results := make([]MatchResult, 0, len(sw.senders))
 	for _, v := range sw.senders {
-		v.Queue(msg)
+		results = append(results, v.Match(msg))
 	}
 	sw.mutex.RUnlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Webhook < results[j].Webhook
+	})
+
+	return results
+}
+
+// Redeliver queues the message for the webhook with the id again, reporting
+// if it was queued.  It isn't when the webhook is gone.
+func (sw *CaduceusSenderWrapper) Redeliver(webhook string, msg *wrp.Message) bool {
+	sw.mutex.RLock()
+	obs, ok := sw.senders[webhook]
+	sw.mutex.RUnlock()
+
+	return ok && obs.Redeliver(msg)
 }
 
 // Shutdown closes down the delivery mechanisms and cleans up the underlying
@@ -187,12 +476,58 @@ func (sw *CaduceusSenderWrapper) Queue(msg *wrp.Message) {
 // (dropping enqueued messages)
 func (sw *CaduceusSenderWrapper) Shutdown(gentle bool) {
 	sw.mutex.Lock()
+	var senders sync.WaitGroup
 	for k, v := range sw.senders {
-		v.Shutdown(gentle)
+		senders.Add(1)
+		go func(obs OutboundSender) {
+			defer senders.Done()
+			obs.Shutdown(gentle)
+		}(v)
 		delete(sw.senders, k)
+		delete(sw.events, k)
+		sw.retiring[v] = true
 	}
+	sw.index = nil
 	sw.mutex.Unlock()
-	close(sw.shutdown)
+
+	done := make(chan struct{})
+	go func() {
+		senders.Wait()
+		close(sw.shutdown)
+
+		// Wait for the undertaker and the senders still retiring.
+		sw.wg.Wait()
+		close(done)
+	}()
+
+	if sw.shutdownTimeout <= 0 {
+		<-done
+		return
+	}
+
+	timer := time.NewTimer(sw.shutdownTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		// The deliveries in flight are interrupted and the messages not
+		// yet delivered are kept for the next start rather than being
+		// lost when caduceus is killed.
+		level.Warn(sw.logger).Log(logging.MessageKey(), "Shutdown deadline reached, spilling the undelivered messages.",
+			"spillDirectory", sw.spillDirectory)
+		sw.mutex.RLock()
+		var spilling sync.WaitGroup
+		for obs := range sw.retiring {
+			spilling.Add(1)
+			go func(obs OutboundSender) {
+				defer spilling.Done()
+				obs.Spill()
+			}(obs)
+		}
+		sw.mutex.RUnlock()
+		spilling.Wait()
+		<-done
+	}
 }
 
 // undertaker looks at the OutboundSenders periodically and prunes the ones
@@ -217,8 +552,12 @@ func undertaker(sw *CaduceusSenderWrapper) {
 				if threshold.After(retired) {
 					deadList[k] = v
 					delete(sw.senders, k)
+					delete(sw.events, k)
 				}
 			}
+			if 0 < len(deadList) {
+				sw.index = newEventIndex(sw.events)
+			}
 			sw.mutex.Unlock()
 
 			// Shut them down
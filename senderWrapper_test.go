@@ -18,13 +18,17 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"io/ioutil"
 	"net/http"
+	"os"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
 	"github.com/xmidt-org/ancla"
 	"github.com/xmidt-org/webpa-common/logging"
 	"github.com/xmidt-org/wrp-go/v3"
@@ -77,26 +81,37 @@ func getFakeFactory() *SenderWrapperFactory {
 		On("With", []string{"url", "http://localhost:9999/foo"}).Return(fakeGauge)
 
 	fakeIgnore := new(mockCounter)
-	fakeIgnore.On("Add", 1.0).Return().On("Add", 0.0).Return().
+	fakeIgnore.On("Add", mock.Anything).Return().
 		On("With", []string{"url", "http://localhost:8888/foo"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:9999/foo"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:8888/foo", "event", "unknown"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:9999/foo", "event", "unknown"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:8888/foo", "event", "test"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:8888/foo", "reason", "cut_off"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:8888/foo", "reason", "queue_full"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:8888/foo", "reason", "expired"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:8888/foo", "reason", "expired_before_queueing"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:8888/foo", "reason", "network_err"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:8888/foo", "reason", "invalid_config"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:8888/foo", "reason", "payload_too_large"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:8888/foo", "reason", "shutdown"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:8888/foo", "reason", "durable_queue_full"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:8888/foo", "reason", "durable_queue_error"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:9999/foo", "reason", "cut_off"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:9999/foo", "reason", "queue_full"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:9999/foo", "reason", "expired"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:9999/foo", "reason", "expired_before_queueing"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:9999/foo", "reason", "network_err"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:9999/foo", "reason", "invalid_config"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:9999/foo", "reason", "payload_too_large"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:9999/foo", "reason", "shutdown"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:9999/foo", "reason", "durable_queue_full"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:9999/foo", "reason", "durable_queue_error"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:8888/foo", "code", "200", "event", "unknown"}).Return(fakeIgnore).
 		On("With", []string{"url", "http://localhost:9999/foo", "code", "200", "event", "unknown"}).Return(fakeIgnore).
+		On("With", []string{"url", "http://localhost:8888/foo", "code", "200", "event", "test"}).Return(fakeIgnore).
 		On("With", []string{"event", "iot"}).Return(fakeIgnore).
+		On("With", []string{"event", "test"}).Return(fakeIgnore).
 		On("With", []string{"event", "test/extra-stuff"}).Return(fakeIgnore).
 		On("With", []string{"event", "bob/magic/dog"}).Return(fakeIgnore).
 		On("With", []string{"event", "unknown"}).Return(fakeIgnore).
@@ -112,7 +127,10 @@ func getFakeFactory() *SenderWrapperFactory {
 	fakeRegistry.On("NewCounter", SlowConsumerCounter).Return(fakeIgnore)
 	fakeRegistry.On("NewCounter", SlowConsumerDroppedMsgCounter).Return(fakeIgnore)
 	fakeRegistry.On("NewCounter", IncomingEventTypeCounter).Return(fakeIgnore)
+	fakeRegistry.On("NewCounter", RemovedWebhookCounter).Return(fakeIgnore)
 	fakeRegistry.On("NewCounter", DropsDueToPanic).Return(fakeIgnore)
+	fakeRegistry.On("NewCounter", SpilledMessageCounter).Return(fakeIgnore)
+	fakeRegistry.On("NewCounter", RestoredMessageCounter).Return(fakeIgnore)
 	fakeRegistry.On("NewGauge", OutgoingQueueDepth).Return(fakeGauge)
 	fakeRegistry.On("NewGauge", DeliveryRetryMaxGauge).Return(fakeGauge)
 	fakeRegistry.On("NewGauge", ConsumerRenewalTimeGauge).Return(fakeGauge)
@@ -120,6 +138,8 @@ func getFakeFactory() *SenderWrapperFactory {
 	fakeRegistry.On("NewGauge", ConsumerDropUntilGauge).Return(fakeGauge)
 	fakeRegistry.On("NewGauge", ConsumerDeliveryWorkersGauge).Return(fakeGauge)
 	fakeRegistry.On("NewGauge", ConsumerMaxDeliveryWorkersGauge).Return(fakeGauge)
+	fakeRegistry.On("NewGauge", CircuitBreakerStateGauge).Return(fakeGauge)
+	fakeRegistry.On("NewCounter", BatchDeliveryCounter).Return(fakeIgnore)
 
 	return &SenderWrapperFactory{
 		NumWorkersPerSender: 10,
@@ -234,3 +254,339 @@ func TestSwSimple(t *testing.T) {
 	sw.Shutdown(true)
 	//assert.Equal(int32(4), atomic.LoadInt32(&trans.i))
 }
+
+func TestSwMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	swf := getFakeFactory()
+	swf.Sender = (&swTransport{}).RoundTrip
+	swf.Linger = 1 * time.Second
+	sw, err := swf.New()
+	assert.Nil(err)
+
+	w1 := ancla.Webhook{
+		Until:  time.Now().Add(6 * time.Second),
+		Events: []string{"iot"},
+	}
+	w1.Config.URL = "http://localhost:9999/foo"
+	w1.Config.ContentType = wrp.MimeTypeJson
+
+	w2 := ancla.Webhook{
+		Until:  time.Now().Add(6 * time.Second),
+		Events: []string{"test"},
+	}
+	w2.Config.URL = "http://localhost:8888/foo"
+	w2.Config.ContentType = wrp.MimeTypeJson
+
+	sw.Update([]ancla.Webhook{w1, w2})
+
+	msg := simpleRequest()
+	msg.Destination = "event:iot"
+	results := sw.Match(msg)
+
+	assert.Equal(2, len(results))
+	assert.Equal("http://localhost:8888/foo", results[0].Webhook)
+	assert.False(results[0].Matched)
+	assert.Equal("http://localhost:9999/foo", results[1].Webhook)
+	assert.True(results[1].Matched)
+
+	sw.Shutdown(true)
+}
+
+func TestSwRemoved(t *testing.T) {
+	assert := assert.New(t)
+
+	trans := &swTransport{}
+
+	swf := getFakeFactory()
+	swf.Sender = trans.RoundTrip
+	swf.Linger = 1 * time.Minute
+	swf.DrainRemoved = true
+	sw, err := swf.New()
+	assert.Nil(err)
+
+	w1 := ancla.Webhook{
+		Until:  time.Now().Add(time.Minute),
+		Events: []string{"iot"},
+	}
+	w1.Config.URL = "http://localhost:9999/foo"
+	w1.Config.ContentType = wrp.MimeTypeJson
+
+	w2 := ancla.Webhook{
+		Until:  time.Now().Add(time.Minute),
+		Events: []string{"test"},
+	}
+	w2.Config.URL = "http://localhost:8888/foo"
+	w2.Config.ContentType = wrp.MimeTypeJson
+
+	sw.Update([]ancla.Webhook{w1, w2})
+
+	msg := simpleRequest()
+	msg.Destination = "event:test"
+
+	// Queued before the removal, so it is drained.
+	sw.Queue(msg)
+
+	sw.Update([]ancla.Webhook{w1})
+
+	results := sw.Match(msg)
+	assert.Equal(1, len(results))
+	assert.Equal("http://localhost:9999/foo", results[0].Webhook)
+
+	// Not delivered since the webhook is gone.
+	sw.Queue(msg)
+
+	sw.Shutdown(true)
+
+	trans.mutex.Lock()
+	defer trans.mutex.Unlock()
+	assert.Equal(1, len(trans.results))
+	assert.Equal("http://localhost:8888/foo", trans.results[0].URL)
+}
+
+// permissiveRegistry provides metrics accepting any labels and values.
+func permissiveRegistry() *mockCaduceusMetricsRegistry {
+	counter := new(mockCounter)
+	counter.On("Add", mock.Anything).Return().
+		On("With", mock.Anything).Return(counter)
+
+	gauge := new(mockGauge)
+	gauge.On("Add", mock.Anything).Return().
+		On("With", mock.Anything).Return(gauge)
+
+	registry := new(mockCaduceusMetricsRegistry)
+	registry.On("NewCounter", mock.Anything).Return(counter)
+	registry.On("NewGauge", mock.Anything).Return(gauge)
+	return registry
+}
+
+// A registration renewed from another address is the same webhook, so its
+// events are delivered once.
+func TestSwSameURL(t *testing.T) {
+	assert := assert.New(t)
+
+	trans := &swTransport{}
+	swf := getFakeFactory()
+	swf.Sender = trans.RoundTrip
+	swf.Linger = 1 * time.Minute
+	swf.MetricsRegistry = permissiveRegistry()
+	sw, err := swf.New()
+	assert.Nil(err)
+
+	w1 := ancla.Webhook{
+		Address: "10.0.0.1",
+		Until:   time.Now().Add(time.Minute),
+		Events:  []string{"iot"},
+	}
+	w1.Config.URL = "http://localhost:9999/foo"
+	w1.Config.ContentType = wrp.MimeTypeJson
+
+	w2 := w1
+	w2.Address = "10.0.0.2"
+
+	sw.Update([]ancla.Webhook{w1})
+	sw.Update([]ancla.Webhook{w2})
+
+	msg := simpleRequest()
+	msg.Destination = "event:iot"
+	results := sw.Match(msg)
+
+	assert.Equal(1, len(results))
+	assert.Equal("http://localhost:9999/foo", results[0].Webhook)
+	assert.True(results[0].Matched)
+
+	sw.Queue(msg)
+	sw.Shutdown(true)
+
+	trans.mutex.Lock()
+	defer trans.mutex.Unlock()
+	assert.Equal(1, len(trans.results))
+}
+
+// Registrations of one URL by different owners are delivered to
+// independently, each with its own events.
+func TestSwOwners(t *testing.T) {
+	assert := assert.New(t)
+
+	trans := &swTransport{}
+	swf := getFakeFactory()
+	swf.Sender = trans.RoundTrip
+	swf.Linger = 1 * time.Minute
+	swf.MetricsRegistry = permissiveRegistry()
+	swf.Options = newMemoryOptionsStore()
+	sw, err := swf.New()
+	assert.Nil(err)
+
+	a := &ancla.Webhook{Events: []string{"iot"}, Until: time.Now().Add(time.Hour)}
+	a.Config.URL = "http://localhost:9999/foo"
+	a.Config.ContentType = wrp.MimeTypeJson
+	b := &ancla.Webhook{Events: []string{"test"}, Until: time.Now().Add(time.Minute)}
+	b.Config.URL = "http://localhost:9999/foo"
+	b.Config.ContentType = wrp.MimeTypeJson
+	c := &ancla.Webhook{Events: []string{"iot"}, Until: time.Now().Add(-time.Second)}
+	c.Config.URL = "http://localhost:9999/foo"
+	c.Config.ContentType = wrp.MimeTypeJson
+	swf.Options.Put(context.Background(), webhookID("a", a.Config.URL), WebhookOptions{Registration: a})
+	swf.Options.Put(context.Background(), webhookID("b", b.Config.URL), WebhookOptions{Registration: b})
+
+	// Each registration expires on its own.
+	swf.Options.Put(context.Background(), webhookID("c", c.Config.URL), WebhookOptions{Registration: c})
+
+	// ancla only lists the last registration of the URL.
+	w := *b
+	w.Until = time.Now().Add(time.Minute)
+	sw.Update([]ancla.Webhook{w})
+
+	msg := simpleRequest()
+	msg.Destination = "event:iot"
+	results := sw.Match(msg)
+
+	assert.Equal(2, len(results))
+	assert.Equal(webhookID("a", a.Config.URL), results[0].Webhook)
+	assert.True(results[0].Matched)
+	assert.Equal(webhookID("b", b.Config.URL), results[1].Webhook)
+	assert.False(results[1].Matched)
+
+	sw.Queue(msg)
+	sw.Shutdown(true)
+
+	trans.mutex.Lock()
+	defer trans.mutex.Unlock()
+	assert.Equal(1, len(trans.results))
+}
+
+// The registrations of every owner of a URL are gone once ancla no longer
+// lists it, whenever they would expire.
+func TestSwOwnersRemoved(t *testing.T) {
+	assert := assert.New(t)
+
+	trans := &swTransport{}
+	swf := getFakeFactory()
+	swf.Sender = trans.RoundTrip
+	swf.Linger = 1 * time.Minute
+	swf.MetricsRegistry = permissiveRegistry()
+	swf.Options = newMemoryOptionsStore()
+	sw, err := swf.New()
+	assert.Nil(err)
+
+	url := "http://localhost:9999/foo"
+	for _, owner := range []string{"a", "b"} {
+		r := &ancla.Webhook{Events: []string{"iot"}, Until: time.Now().Add(time.Hour)}
+		r.Config.URL = url
+		r.Config.ContentType = wrp.MimeTypeJson
+		swf.Options.Put(context.Background(), webhookID(owner, url), WebhookOptions{Registration: r, Registered: time.Now()})
+	}
+
+	sw.Update([]ancla.Webhook{*swf.Options.Get(webhookID("b", url)).Registration})
+	msg := simpleRequest()
+	msg.Destination = "event:iot"
+	assert.Equal(2, len(sw.Match(msg)))
+
+	// The webhook is deleted from Argus.
+	sw.Update(nil)
+	assert.Empty(sw.Match(msg))
+
+	sw.Queue(msg)
+	sw.Shutdown(true)
+
+	trans.mutex.Lock()
+	defer trans.mutex.Unlock()
+	assert.Empty(trans.results)
+}
+
+// The latest registration of a URL takes over the messages spilled when the
+// webhooks were keyed by URL.
+func TestSwOwnersAdoptURL(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "spill")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	url := "http://localhost:9999/foo"
+	spilled := []*wrp.Message{simpleRequest(), simpleRequest()}
+	assert.Nil(writeSpillFile(spillFile(dir, webhookID("", url)), spilled))
+
+	trans := &swTransport{}
+	swf := getFakeFactory()
+	swf.Sender = trans.RoundTrip
+	swf.Linger = 1 * time.Minute
+	swf.SpillDirectory = dir
+	swf.MetricsRegistry = permissiveRegistry()
+	swf.Options = newMemoryOptionsStore()
+	sw, err := swf.New()
+	assert.Nil(err)
+
+	now := time.Now()
+	for i, owner := range []string{"a", "b"} {
+		r := &ancla.Webhook{Events: []string{"iot"}, Until: now.Add(time.Hour)}
+		r.Config.URL = url
+		r.Config.ContentType = wrp.MimeTypeJson
+		swf.Options.Put(context.Background(), webhookID(owner, url), WebhookOptions{
+			Registration: r,
+			Registered:   now.Add(time.Duration(i) * time.Second),
+		})
+	}
+	sw.Update([]ancla.Webhook{*swf.Options.Get(webhookID("b", url)).Registration})
+
+	_, err = os.Stat(spillFile(dir, webhookID("", url)))
+	assert.True(os.IsNotExist(err))
+	sw.Shutdown(true)
+
+	trans.mutex.Lock()
+	defer trans.mutex.Unlock()
+	assert.Equal(len(spilled), len(trans.results))
+}
+
+// A gentle shutdown stuck on a slow consumer gives up at the deadline and
+// spills what is still queued.
+func TestSwShutdownDeadline(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "spill")
+	assert.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// The delivery only ends when it is interrupted.
+	swf := getFakeFactory()
+	swf.Sender = func(req *http.Request) (*http.Response, error) {
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+	swf.NumWorkersPerSender = 1
+	swf.Linger = 1 * time.Minute
+	swf.ShutdownTimeout = 100 * time.Millisecond
+	swf.SpillDirectory = dir
+	swf.MetricsRegistry = permissiveRegistry()
+	sw, err := swf.New()
+	assert.Nil(err)
+
+	w := ancla.Webhook{
+		Until:  time.Now().Add(time.Minute),
+		Events: []string{"iot"},
+	}
+	w.Config.URL = "http://localhost:9999/foo"
+	w.Config.ContentType = wrp.MimeTypeJson
+	sw.Update([]ancla.Webhook{w})
+
+	for i := 0; i < 5; i++ {
+		msg := simpleRequest()
+		msg.Destination = "event:iot"
+		sw.Queue(msg)
+	}
+
+	start := time.Now()
+	sw.Shutdown(true)
+	assert.True(time.Since(start) < time.Second)
+
+	// The message in flight is spilled along with the queued ones.
+	f, err := os.Open(spillFile(dir, webhookID("", w.Config.URL)))
+	assert.Nil(err)
+	spilled := 0
+	decoder := wrp.NewDecoder(f, wrp.Msgpack)
+	for nil == decoder.Decode(new(wrp.Message)) {
+		spilled++
+	}
+	f.Close()
+	assert.Equal(5, spilled)
+}
@@ -0,0 +1,144 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The algorithms of the signatures of the deliveries.
+const (
+	sha256Signature = "sha256"
+	sha512Signature = "sha512"
+)
+
+// The headers of the signatures of the deliveries.
+const (
+	// signatureHeader is the HMAC of the timestamp, a dot and the body,
+	// prefixed with the algorithm like "sha256=".
+	signatureHeader = "X-Caduceus-Signature"
+
+	// timestampHeader is the time the delivery was signed at, in seconds
+	// since the epoch.  Consumers reject old timestamps to prevent replays.
+	timestampHeader = "X-Caduceus-Timestamp"
+
+	// legacySignatureHeader is the SHA-1 HMAC of the body alone, prefixed
+	// with "sha1=".
+	legacySignatureHeader = "X-Webpa-Signature"
+)
+
+// SignatureConfig configures how the deliveries to the webhooks with a secret
+// are signed.
+type SignatureConfig struct {
+	// Algorithm is the hash of the signatures, sha256 or sha512, unless the
+	// webhook chose its own.
+	// (Optional) defaults to sha256.
+	Algorithm string
+
+	// DisableLegacy stops signing with the SHA-1 header of the older
+	// releases, unless the webhook asks for it.  Consumers should move to
+	// the X-Caduceus-Signature header before it is set.
+	DisableLegacy bool
+}
+
+// withDefaults validates the configuration, filling in the defaults.
+func (c SignatureConfig) withDefaults() (SignatureConfig, error) {
+	if "" == c.Algorithm {
+		c.Algorithm = sha256Signature
+	}
+	return c, validateSignatureAlgorithm(c.Algorithm)
+}
+
+// validateSignatureAlgorithm checks the algorithm is supported.  Empty means
+// the configured one.
+func validateSignatureAlgorithm(algorithm string) error {
+	switch algorithm {
+	case "", sha256Signature, sha512Signature:
+		return nil
+	}
+	return fmt.Errorf("signature_algorithm must be %s or %s", sha256Signature, sha512Signature)
+}
+
+// signer signs the deliveries to a webhook with its secret.  Without a secret
+// nothing is signed.
+type signer struct {
+	secret    string
+	algorithm string
+
+	// rotation is the rotation of the secret, if any.  While it overlaps the
+	// deliveries carry a signature for each secret.
+	rotation *SecretRotation
+
+	// legacy also signs with the SHA-1 header of the older releases, for the
+	// webhooks that haven't moved on yet.
+	legacy bool
+}
+
+// sign sets the signature headers of the request with the body, signed at
+// the time.  The retries are signed again, so their timestamps are recent.
+// With several secrets the signatures of every header are separated by
+// commas, the old secret first.
+func (s signer) sign(header http.Header, body []byte, now time.Time) {
+	secrets := s.rotation.secrets(s.secret, now)
+	if 0 == len(secrets) {
+		return
+	}
+
+	newHash := sha256.New
+	if sha512Signature == s.algorithm {
+		newHash = sha512.New
+	}
+	algorithm := s.algorithm
+	if "" == algorithm {
+		algorithm = sha256Signature
+	}
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	header.Set(timestampHeader, timestamp)
+	signatures := make([]string, len(secrets))
+	for i, secret := range secrets {
+		signatures[i] = fmt.Sprintf("%s=%s", algorithm, hmacHex(newHash, secret, []byte(timestamp+"."), body))
+	}
+	header.Set(signatureHeader, strings.Join(signatures, ","))
+
+	if s.legacy {
+		legacy := make([]string, len(secrets))
+		for i, secret := range secrets {
+			legacy[i] = fmt.Sprintf("sha1=%s", hmacHex(sha1.New, secret, body))
+		}
+		header.Set(legacySignatureHeader, strings.Join(legacy, ","))
+	}
+}
+
+// hmacHex returns the HMAC of the parts in hex.
+func hmacHex(newHash func() hash.Hash, secret string, parts ...[]byte) string {
+	mac := hmac.New(newHash, []byte(secret))
+	for _, p := range parts {
+		mac.Write(p)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,141 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignatureConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	c, err := SignatureConfig{}.withDefaults()
+	assert.Nil(err)
+	assert.Equal(sha256Signature, c.Algorithm)
+
+	_, err = SignatureConfig{Algorithm: "sha1"}.withDefaults()
+	assert.NotNil(err)
+}
+
+func TestSign(t *testing.T) {
+	body := []byte(`{"hello":"world"}`)
+	now := time.Unix(1600000000, 0)
+
+	expected := func(newHash func() hash.Hash, message string) string {
+		mac := hmac.New(newHash, []byte("secret"))
+		mac.Write([]byte(message))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	tests := []struct {
+		description       string
+		signer            signer
+		expectedSignature string
+		expectedLegacy    string
+	}{
+		{
+			description: "No Secret",
+			signer:      signer{algorithm: sha256Signature, legacy: true},
+		},
+		{
+			description:       "SHA-256",
+			signer:            signer{secret: "secret", algorithm: sha256Signature},
+			expectedSignature: "sha256=" + expected(sha256.New, "1600000000."+string(body)),
+		},
+		{
+			description:       "SHA-512",
+			signer:            signer{secret: "secret", algorithm: sha512Signature},
+			expectedSignature: "sha512=" + expected(sha512.New, "1600000000."+string(body)),
+		},
+		{
+			description:       "Legacy",
+			signer:            signer{secret: "secret", legacy: true},
+			expectedSignature: "sha256=" + expected(sha256.New, "1600000000."+string(body)),
+			expectedLegacy:    "sha1=" + expected(sha1.New, string(body)),
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			header := http.Header{}
+			tc.signer.sign(header, body, now)
+
+			assert.Equal(tc.expectedSignature, header.Get(signatureHeader))
+			assert.Equal(tc.expectedLegacy, header.Get(legacySignatureHeader))
+			if "" != tc.expectedSignature {
+				assert.Equal("1600000000", header.Get(timestampHeader))
+			} else {
+				assert.Empty(header.Get(timestampHeader))
+			}
+		})
+	}
+}
+
+func TestSignRotation(t *testing.T) {
+	body := []byte(`{"hello":"world"}`)
+	started := time.Unix(1600000000, 0)
+
+	expected := func(newHash func() hash.Hash, secret, message string) string {
+		mac := hmac.New(newHash, []byte(secret))
+		mac.Write([]byte(message))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	s := signer{
+		secret:    "old",
+		algorithm: sha256Signature,
+		legacy:    true,
+		rotation:  &SecretRotation{Secret: "new", Started: started, Until: started.Add(time.Hour)},
+	}
+
+	t.Run("Overlapping", func(t *testing.T) {
+		assert := assert.New(t)
+		now := started.Add(time.Minute)
+
+		header := http.Header{}
+		s.sign(header, body, now)
+
+		message := "1600000060." + string(body)
+		assert.Equal("sha256="+expected(sha256.New, "old", message)+",sha256="+expected(sha256.New, "new", message),
+			header.Get(signatureHeader))
+		assert.Equal("sha1="+expected(sha1.New, "old", string(body))+",sha1="+expected(sha1.New, "new", string(body)),
+			header.Get(legacySignatureHeader))
+	})
+
+	t.Run("Retired", func(t *testing.T) {
+		assert := assert.New(t)
+		now := started.Add(time.Hour)
+
+		header := http.Header{}
+		s.sign(header, body, now)
+
+		assert.Equal("sha256="+expected(sha256.New, "new", "1600003600."+string(body)), header.Get(signatureHeader))
+		assert.Equal("sha1="+expected(sha1.New, "new", string(body)), header.Get(legacySignatureHeader))
+	})
+}
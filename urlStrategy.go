@@ -0,0 +1,197 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"container/ring"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"time"
+
+	"github.com/xmidt-org/webpa-common/device"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+// The strategies picking the URL of a webhook an event is delivered to
+// first.  Whatever the strategy, the retries of the event move on to the
+// following URLs in turn.
+const (
+	// roundRobinStrategy delivers to the URLs in turn.
+	roundRobinStrategy = "round_robin"
+
+	// failoverStrategy always delivers to the first URL, only moving on to
+	// the others when it fails.
+	failoverStrategy = "failover"
+
+	// weightedStrategy delivers to the URLs at random, in proportion to
+	// their weights.
+	weightedStrategy = "weighted"
+
+	// stickyStrategy delivers the events of a device to the same URL, picked
+	// by the hash of the device id.
+	stickyStrategy = "sticky"
+)
+
+// validateURLStrategy checks the strategy and its weights are usable.
+func validateURLStrategy(strategy string, weights []int) error {
+	switch strategy {
+	case "", roundRobinStrategy, failoverStrategy, stickyStrategy:
+		if 0 < len(weights) {
+			return fmt.Errorf("url_weights are only used by the %s url_strategy", weightedStrategy)
+		}
+	case weightedStrategy:
+		total := 0
+		for _, w := range weights {
+			if w < 0 {
+				return fmt.Errorf("url_weights must not be negative")
+			}
+			total += w
+		}
+		if 0 == total {
+			return fmt.Errorf("url_weights must have a positive weight")
+		}
+	default:
+		return fmt.Errorf("url_strategy must be one of %s, %s, %s or %s",
+			roundRobinStrategy, failoverStrategy, weightedStrategy, stickyStrategy)
+	}
+	return nil
+}
+
+// urlSelector picks the URL of a webhook an event is delivered to first,
+// returning where it is in the ring of all the URLs.  Only the dispatcher
+// picks URLs.
+type urlSelector interface {
+	first(msg *wrp.Message) *ring.Ring
+}
+
+// newURLSelector creates the selector of the strategy for the URLs.  Unknown
+// strategies deliver in turn, and the URLs missing a weight weigh 1.
+func newURLSelector(strategy string, weights []int, urls []string) urlSelector {
+	r := ring.New(len(urls))
+	elements := make([]*ring.Ring, len(urls))
+	for i, u := range urls {
+		r.Value = u
+		elements[i] = r
+		r = r.Next()
+	}
+
+	switch strategy {
+	case failoverStrategy:
+		return failoverSelector{head: r}
+	case stickyStrategy:
+		return stickySelector{urls: elements}
+	case weightedStrategy:
+		s := &weightedSelector{urls: elements, cumulative: make([]int, len(urls))}
+		for i := range urls {
+			w := 1
+			if i < len(weights) {
+				w = weights[i]
+			}
+			s.total += w
+			s.cumulative[i] = s.total
+		}
+		if 0 < s.total {
+			return s
+		}
+	}
+
+	// Randomize where we start so all the instances don't synchronize
+	offset := rand.New(rand.NewSource(time.Now().UnixNano())).Intn(len(urls))
+	return &roundRobinSelector{next: r.Move(offset)}
+}
+
+// roundRobinSelector delivers to the URLs in turn.
+type roundRobinSelector struct {
+	next *ring.Ring
+}
+
+func (s *roundRobinSelector) first(*wrp.Message) *ring.Ring {
+	r := s.next
+	// Move to the next URL to try 1st the next time.
+	s.next = s.next.Next()
+	return r
+}
+
+// failoverSelector always delivers to the first URL.
+type failoverSelector struct {
+	head *ring.Ring
+}
+
+func (s failoverSelector) first(*wrp.Message) *ring.Ring {
+	return s.head
+}
+
+// weightedSelector delivers to the URLs at random, in proportion to their
+// weights.
+type weightedSelector struct {
+	urls       []*ring.Ring
+	cumulative []int
+	total      int
+}
+
+func (s *weightedSelector) first(*wrp.Message) *ring.Ring {
+	n := rand.Intn(s.total)
+	for i, c := range s.cumulative {
+		if n < c {
+			return s.urls[i]
+		}
+	}
+	return s.urls[len(s.urls)-1]
+}
+
+// stickySelector delivers the events of a device to the same URL.
+type stickySelector struct {
+	urls []*ring.Ring
+}
+
+func (s stickySelector) first(msg *wrp.Message) *ring.Ring {
+	// The service of the source doesn't change the device.
+	key := msg.Source
+	if id, err := device.ParseID(msg.Source); nil == err {
+		key = string(id)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return s.urls[h.Sum32()%uint32(len(s.urls))]
+}
+
+// urlBatch is the messages of a batch delivered to the same URL first.
+type urlBatch struct {
+	urls *ring.Ring
+	msgs []*wrp.Message
+}
+
+// groupByURL splits the batch by the URL the selector picks for each of its
+// messages, so every message goes where it would have gone on its own.  The
+// order of the messages is kept within each group.
+func groupByURL(selector urlSelector, batch []*wrp.Message) []urlBatch {
+	var groups []urlBatch
+	for _, msg := range batch {
+		urls := selector.first(msg)
+		i := 0
+		for i < len(groups) && groups[i].urls != urls {
+			i++
+		}
+		if len(groups) == i {
+			groups = append(groups, urlBatch{urls: urls})
+		}
+		groups[i].msgs = append(groups[i].msgs, msg)
+	}
+	return groups
+}
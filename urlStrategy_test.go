@@ -0,0 +1,95 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func TestValidateURLStrategy(t *testing.T) {
+	tests := []struct {
+		description string
+		strategy    string
+		weights     []int
+		expectedErr bool
+	}{
+		{description: "Default"},
+		{description: "Round Robin", strategy: roundRobinStrategy},
+		{description: "Failover", strategy: failoverStrategy},
+		{description: "Sticky", strategy: stickyStrategy},
+		{description: "Weighted", strategy: weightedStrategy, weights: []int{3, 0, 1}},
+		{description: "Unknown", strategy: "random", expectedErr: true},
+		{description: "Weights Not Used", strategy: failoverStrategy, weights: []int{1}, expectedErr: true},
+		{description: "Negative Weight", strategy: weightedStrategy, weights: []int{2, -1}, expectedErr: true},
+		{description: "No Weight", strategy: weightedStrategy, weights: []int{0, 0}, expectedErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			err := validateURLStrategy(tc.strategy, tc.weights)
+			if tc.expectedErr {
+				assert.NotNil(t, err)
+			} else {
+				assert.Nil(t, err)
+			}
+		})
+	}
+}
+
+func firstURLs(s urlSelector, sources ...string) []string {
+	urls := []string{}
+	for _, source := range sources {
+		urls = append(urls, s.first(&wrp.Message{Source: source}).Value.(string))
+	}
+	return urls
+}
+
+func TestURLSelectors(t *testing.T) {
+	assert := assert.New(t)
+	urls := []string{"a", "b", "c"}
+
+	// Round robin goes through every URL in turn, wherever it starts.
+	picked := firstURLs(newURLSelector("", nil, urls), "", "", "", "")
+	assert.ElementsMatch(urls, picked[:3])
+	assert.Equal(picked[0], picked[3])
+
+	assert.Equal([]string{"a", "a", "a"}, firstURLs(newURLSelector(failoverStrategy, nil, urls), "", "", ""))
+
+	// The retries of a failover still move on to the other URLs.
+	assert.Equal("b", newURLSelector(failoverStrategy, nil, urls).first(&wrp.Message{}).Next().Value)
+
+	assert.Equal([]string{"b", "b", "b"}, firstURLs(newURLSelector(weightedStrategy, []int{0, 1, 0}, urls), "", "", ""))
+
+	// The URLs missing a weight weigh 1.
+	weighted := firstURLs(newURLSelector(weightedStrategy, []int{0, 0}, urls), "", "", "")
+	assert.Equal([]string{"c", "c", "c"}, weighted)
+
+	// Every service of a device goes to the same URL.
+	sticky := newURLSelector(stickyStrategy, nil, urls)
+	device := firstURLs(sticky, "mac:112233445566", "mac:112233445566/lmlite", "MAC:11:22:33:44:55:66/config")
+	assert.Equal([]string{device[0], device[0], device[0]}, device)
+
+	spread := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		spread[sticky.first(&wrp.Message{Source: fmt.Sprintf("mac:%012x", i)}).Value.(string)] = true
+	}
+	assert.Equal(3, len(spread))
+}
@@ -0,0 +1,370 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/xmidt-org/ancla"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/webpa-common/secure/handler"
+)
+
+// webhookIDHeader reports the id of the webhook registered.
+const webhookIDHeader = "X-Caduceus-Webhook-Id"
+
+// WebhookOptions are the settings of a webhook registration that are
+// specific to caduceus and so aren't part of ancla.Webhook.  They are sent
+// as the "options" object of the registration.
+type WebhookOptions struct {
+	// MaxPayloadSize is the largest event payload in bytes delivered to the
+	// webhook.  Larger events are dropped.  0 means there is no limit.
+	MaxPayloadSize int `json:"max_payload_size,omitempty"`
+
+	// PartnerIDs are the partners whose events are delivered to the webhook
+	// when the partners are isolated.  They are taken from the credentials
+	// of the registration, whatever the registration says.
+	PartnerIDs []string `json:"partner_ids,omitempty"`
+
+	// The delivery settings of the webhook, overriding the sender
+	// configuration within the bounds set by the operator.
+	DeliveryRetries  *int         `json:"delivery_retries,omitempty"`
+	DeliveryInterval jsonDuration `json:"delivery_interval,omitempty"`
+	QueueSize        int          `json:"queue_size,omitempty"`
+	Workers          int          `json:"workers,omitempty"`
+	CutOffPeriod     jsonDuration `json:"cut_off_period,omitempty"`
+	ClientTimeout    jsonDuration `json:"client_timeout,omitempty"`
+
+	// MinWorkers and Weight are the share of the shared worker pool, within
+	// the bounds set by the operator: the concurrent deliveries the webhook
+	// is served first with, and its weight against the other webhooks once
+	// they all have their minimum.  Workers is its most concurrent
+	// deliveries.
+	MinWorkers int `json:"min_workers,omitempty"`
+	Weight     int `json:"weight,omitempty"`
+
+	// DeliveryMaxInterval is the longest wait between the delivery attempts
+	// of an event, within the bounds set by the operator.
+	DeliveryMaxInterval jsonDuration `json:"delivery_max_interval,omitempty"`
+
+	// DurableQueue keeps the events queued for the webhook on disk until
+	// they are delivered, so they survive restarts.  Only allowed when the
+	// durable queues are configured.
+	DurableQueue bool `json:"durable_queue,omitempty"`
+
+	// BatchSize is the most events delivered in a single request, as an
+	// array of WRP messages, within the bounds set by the operator.  Less
+	// than 2 delivers the events one at a time.
+	BatchSize int `json:"batch_size,omitempty"`
+
+	// BatchBytes is the most payload bytes of the events of a batch.
+	BatchBytes int `json:"batch_bytes,omitempty"`
+
+	// BatchLinger is the longest a batch waits for more events before it is
+	// delivered.
+	BatchLinger jsonDuration `json:"batch_linger,omitempty"`
+
+	// SignatureAlgorithm is the hash of the signatures of the deliveries,
+	// sha256 or sha512.  Empty means the configured one.
+	SignatureAlgorithm string `json:"signature_algorithm,omitempty"`
+
+	// LegacySignature determines if the deliveries are also signed with the
+	// SHA-1 header of the older releases, for consumers that haven't moved
+	// on yet.  Nil means the configured default.
+	LegacySignature *bool `json:"legacy_signature,omitempty"`
+
+	// URLStrategy picks which of the alternative URLs each event is
+	// delivered to first: round_robin, failover, weighted or sticky.
+	// Empty means round_robin.
+	URLStrategy string `json:"url_strategy,omitempty"`
+
+	// URLWeights are the weights of the alternative URLs, in order, for the
+	// weighted strategy.
+	URLWeights []int `json:"url_weights,omitempty"`
+
+	// SecretRotation is the rotation of the secret of the webhook, started
+	// through the rotation API whatever the registration says.
+	SecretRotation *SecretRotation `json:"secret_rotation,omitempty"`
+
+	// Owner is the owner of the webhook, the subject of the JWT it was
+	// registered with, whatever the registration says.
+	Owner string `json:"owner,omitempty"`
+
+	// Registered is when the webhook was last registered, whatever the
+	// registration says.
+	Registered time.Time `json:"registered"`
+
+	// Registration is the webhook as its owner registered it, whatever the
+	// registration says.  ancla keeps a single webhook per URL, so this is
+	// what the webhook is delivered with, until it expires, when the
+	// webhooks are keyed by owner.
+	Registration *ancla.Webhook `json:"registration,omitempty"`
+}
+
+// Validate checks that the options are usable.
+func (o WebhookOptions) Validate() error {
+	if o.MaxPayloadSize < 0 {
+		return errors.New("max_payload_size must not be negative")
+	}
+	if err := validateSignatureAlgorithm(o.SignatureAlgorithm); nil != err {
+		return err
+	}
+	return validateURLStrategy(o.URLStrategy, o.URLWeights)
+}
+
+// webhookID returns the id used to key everything caduceus keeps per webhook,
+// such as its sender, options, dead letters and metrics.  A webhook is its
+// owner's registration for a URL, so the registrations of different owners
+// for the same URL are different webhooks with their own events, secret and
+// queue, while a registration renewed from another address is the same one.
+// The registrations made without an owner are identified by their URL.
+func webhookID(owner, url string) string {
+	if "" == owner {
+		return url
+	}
+	return fmt.Sprintf("%s (%s)", url, owner)
+}
+
+// registrationOwner returns the owner of the webhooks registered in the
+// context, the subject of its JWT.
+func registrationOwner(ctx context.Context) string {
+	if values, ok := handler.FromContext(ctx); ok {
+		return values.SatClientID
+	}
+	return ""
+}
+
+// errOtherOwner is the reason a request is refused to act on the webhook of
+// another owner.
+var errOtherOwner = errors.New("the webhook belongs to another owner")
+
+// authorizeWebhook responds with a 404 unless the webhook with the options is
+// registered, and with a 403 unless the request is made by the owner of the
+// webhook and, with partner isolation, is allowed every partner of it.
+func authorizeWebhook(response http.ResponseWriter, request *http.Request, isolation PartnerIsolationConfig, options WebhookOptions) bool {
+	if options.Registered.IsZero() {
+		response.WriteHeader(http.StatusNotFound)
+		response.Write([]byte("Webhook not found.\n"))
+		return false
+	}
+
+	err := isolation.authorize(request.Context(), options.PartnerIDs)
+	if nil == err && registrationOwner(request.Context()) != options.Owner {
+		err = errOtherOwner
+	}
+	if nil != err {
+		response.WriteHeader(http.StatusForbidden)
+		response.Write([]byte(fmt.Sprintf("Forbidden: %s.\n", err)))
+		return false
+	}
+	return true
+}
+
+// registrationDuration is how long a registration lasts unless it says
+// until when, as ancla has it.
+const registrationDuration = 5 * time.Minute
+
+// webhookRegistration is the part of a webhook registration request caduceus
+// looks at before handing the request to ancla.
+type webhookRegistration struct {
+	Address    string                      `json:"registered_from_address"`
+	Config     ancla.DeliveryConfig        `json:"config"`
+	FailureURL string                      `json:"failure_url"`
+	Events     []string                    `json:"events"`
+	Matcher    ancla.MetadataMatcherConfig `json:"matcher"`
+	Until      time.Time                   `json:"until"`
+	Options    WebhookOptions              `json:"options"`
+}
+
+// webhook returns the webhook registered from the address at the time, with
+// the defaults ancla gives it.
+func (r webhookRegistration) webhook(remoteAddr string, now time.Time) *ancla.Webhook {
+	w := &ancla.Webhook{
+		Address:    r.Address,
+		Config:     r.Config,
+		FailureURL: r.FailureURL,
+		Events:     r.Events,
+		Matcher:    r.Matcher,
+		Duration:   registrationDuration,
+		Until:      r.Until,
+	}
+	if 0 == len(w.Matcher.DeviceID) {
+		w.Matcher.DeviceID = []string{".*"}
+	}
+	if "" == w.Address {
+		w.Address, _, _ = net.SplitHostPort(remoteAddr)
+	}
+	if w.Until.IsZero() {
+		w.Until = now.Add(w.Duration)
+	}
+	return w
+}
+
+// bufferedResponse holds the response of the registration handler until
+// the options are stored.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponse() *bufferedResponse {
+	return &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+// writeTo writes the response held to the actual response.
+func (b *bufferedResponse) writeTo(response http.ResponseWriter) {
+	for k, v := range b.header {
+		response.Header()[k] = v
+	}
+	response.WriteHeader(b.status)
+	response.Write(b.body.Bytes())
+}
+
+// webhookOptionsHandler decorates the webhook registration handler, storing
+// the options of the registration once the webhook itself is registered.
+type webhookOptionsHandler struct {
+	next      http.Handler
+	store     WebhookOptionsStore
+	isolation PartnerIsolationConfig
+	bounds    DeliveryBounds
+	durable   bool
+
+	// byOwner keys the webhooks by owner and URL and keeps the registration
+	// of each owner, which takes a store shared by all the instances.
+	// Otherwise the webhooks are keyed by URL, as ancla keeps them.
+	byOwner bool
+}
+
+func (h webhookOptionsHandler) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	logger := logging.GetLogger(request.Context())
+
+	payload, err := ioutil.ReadAll(request.Body)
+	if nil != err {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write([]byte("Unable to read the request body.\n"))
+		return
+	}
+	request.Body.Close()
+
+	var registration webhookRegistration
+	if err = json.Unmarshal(payload, &registration); nil != err {
+		// Let ancla report what is wrong with the registration.
+		request.Body = ioutil.NopCloser(bytes.NewReader(payload))
+		h.next.ServeHTTP(response, request)
+		return
+	}
+
+	if err = registration.Options.Validate(); nil == err {
+		err = h.bounds.validate(registration.Options)
+	}
+	if nil == err && registration.Options.DurableQueue && !h.durable {
+		err = errors.New("durable_queue is not available")
+	}
+	if nil == err && 0 < len(registration.Options.URLWeights) &&
+		len(registration.Options.URLWeights) != len(registration.Config.AlternativeURLs) {
+		err = errors.New("url_weights must have a weight for every alternative URL")
+	}
+	if nil != err {
+		response.WriteHeader(http.StatusBadRequest)
+		response.Write([]byte(fmt.Sprintf("Invalid options: %s\n", err)))
+		return
+	}
+
+	owner := registrationOwner(request.Context())
+	id := webhookID("", registration.Config.URL)
+	if h.byOwner {
+		id = webhookID(owner, registration.Config.URL)
+	}
+	existing := h.store.Get(id)
+
+	// A registration can't choose the partners whose events it gets, nor
+	// take a webhook over from other partners.
+	registration.Options.PartnerIDs, err = h.isolation.bindPartnerIDs(request.Context())
+	if nil == err && h.isolation.Enabled && !partnersCover(registration.Options.PartnerIDs, existing.PartnerIDs) {
+		err = errOtherPartners
+	}
+	if nil != err {
+		response.WriteHeader(http.StatusForbidden)
+		response.Write([]byte(fmt.Sprintf("Forbidden: %s.\n", err)))
+		return
+	}
+
+	now := time.Now()
+	registration.Options.Owner = owner
+	registration.Options.Registered = now
+	registration.Options.Registration = nil
+	if h.byOwner {
+		registration.Options.Registration = registration.webhook(request.RemoteAddr, now)
+	}
+
+	// The options are only stored once ancla registered the webhook, so a
+	// registration it rejects leaves nothing behind.
+	buffered := newBufferedResponse()
+	request.Body = ioutil.NopCloser(bytes.NewReader(payload))
+	h.next.ServeHTTP(buffered, request)
+	if buffered.status < 200 || 299 < buffered.status {
+		buffered.writeTo(response)
+		return
+	}
+
+	// The rotation of the secret outlives the registrations until the webhook
+	// is registered with the new secret.  It is taken from the options as
+	// stored, so a rotation started on another instance since the last
+	// refresh isn't dropped.
+	err = h.store.Update(request.Context(), id, func(o *WebhookOptions) error {
+		rotation := o.SecretRotation
+		*o = registration.Options
+		o.SecretRotation = nil
+		if nil != rotation && rotation.Secret != registration.Config.Secret {
+			o.SecretRotation = rotation
+		}
+		return nil
+	})
+	if nil != err {
+		logger.Log(level.Key(), level.ErrorValue(), logging.MessageKey(), "Unable to store webhook options",
+			"webhook", id, logging.ErrorKey(), err)
+		response.WriteHeader(http.StatusInternalServerError)
+		response.Write([]byte("Unable to store webhook options.\n"))
+		return
+	}
+
+	// The owner needs the id to manage the webhook.
+	buffered.header.Set(webhookIDHeader, id)
+	buffered.writeTo(response)
+}
@@ -0,0 +1,459 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xmidt-org/webpa-common/secure/handler"
+)
+
+func TestWebhookID(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("http://localhost/foo", webhookID("", "http://localhost/foo"))
+	assert.Equal("http://localhost/foo (client)", webhookID("client", "http://localhost/foo"))
+	assert.NotEqual(webhookID("client", "http://localhost/foo"), webhookID("other", "http://localhost/foo"))
+}
+
+func TestWebhookOptionsHandler(t *testing.T) {
+	tests := []struct {
+		description    string
+		body           string
+		expectedStatus int
+		expectedNext   bool
+		expected       WebhookOptions
+	}{
+		{
+			description:    "With Options",
+			body:           `{"config":{"url":"http://localhost/foo"},"events":["iot"],"options":{"max_payload_size":1024}}`,
+			expectedStatus: http.StatusOK,
+			expectedNext:   true,
+			expected:       WebhookOptions{MaxPayloadSize: 1024},
+		},
+		{
+			description:    "Without Options",
+			body:           `{"config":{"url":"http://localhost/foo"},"events":["iot"]}`,
+			expectedStatus: http.StatusOK,
+			expectedNext:   true,
+		},
+		{
+			description:    "Invalid Options",
+			body:           `{"config":{"url":"http://localhost/foo"},"events":["iot"],"options":{"max_payload_size":-1}}`,
+			expectedStatus: http.StatusBadRequest,
+			expected:       WebhookOptions{MaxPayloadSize: 1},
+		},
+		{
+			description:    "Delivery Settings",
+			body:           `{"config":{"url":"http://localhost/foo"},"events":["iot"],"options":{"delivery_retries":0,"queue_size":500}}`,
+			expectedStatus: http.StatusOK,
+			expectedNext:   true,
+			expected:       WebhookOptions{DeliveryRetries: intPtr(0), QueueSize: 500},
+		},
+		{
+			description:    "Delivery Settings Out Of Bounds",
+			body:           `{"config":{"url":"http://localhost/foo"},"events":["iot"],"options":{"queue_size":5000}}`,
+			expectedStatus: http.StatusBadRequest,
+			expected:       WebhookOptions{MaxPayloadSize: 1},
+		},
+		{
+			description:    "Delivery Settings Without Bounds",
+			body:           `{"config":{"url":"http://localhost/foo"},"events":["iot"],"options":{"workers":5}}`,
+			expectedStatus: http.StatusBadRequest,
+			expected:       WebhookOptions{MaxPayloadSize: 1},
+		},
+		{
+			description:    "Durable Queue Not Available",
+			body:           `{"config":{"url":"http://localhost/foo"},"events":["iot"],"options":{"durable_queue":true}}`,
+			expectedStatus: http.StatusBadRequest,
+			expected:       WebhookOptions{MaxPayloadSize: 1},
+		},
+		{
+			description:    "URL Weights",
+			body:           `{"config":{"url":"http://localhost/foo","alt_urls":["http://localhost/foo","http://localhost/bar"]},"events":["iot"],"options":{"url_strategy":"weighted","url_weights":[3,1]}}`,
+			expectedStatus: http.StatusOK,
+			expectedNext:   true,
+			expected:       WebhookOptions{URLStrategy: "weighted", URLWeights: []int{3, 1}},
+		},
+		{
+			description:    "URL Weights Missing",
+			body:           `{"config":{"url":"http://localhost/foo","alt_urls":["http://localhost/foo","http://localhost/bar"]},"events":["iot"],"options":{"url_strategy":"weighted","url_weights":[3]}}`,
+			expectedStatus: http.StatusBadRequest,
+			expected:       WebhookOptions{MaxPayloadSize: 1},
+		},
+		{
+			description:    "Unknown Signature Algorithm",
+			body:           `{"config":{"url":"http://localhost/foo"},"events":["iot"],"options":{"signature_algorithm":"md5"}}`,
+			expectedStatus: http.StatusBadRequest,
+			expected:       WebhookOptions{MaxPayloadSize: 1},
+		},
+		{
+			description:    "Unknown URL Strategy",
+			body:           `{"config":{"url":"http://localhost/foo"},"events":["iot"],"options":{"url_strategy":"random"}}`,
+			expectedStatus: http.StatusBadRequest,
+			expected:       WebhookOptions{MaxPayloadSize: 1},
+		},
+		{
+			description:    "Partner IDs Ignored",
+			body:           `{"config":{"url":"http://localhost/foo"},"events":["iot"],"options":{"partner_ids":["*"]}}`,
+			expectedStatus: http.StatusOK,
+			expectedNext:   true,
+		},
+		{
+			description:    "Invalid JSON",
+			body:           `{"config":`,
+			expectedStatus: http.StatusOK,
+			expectedNext:   true,
+			expected:       WebhookOptions{MaxPayloadSize: 1},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			store := newMemoryOptionsStore()
+			store.Put(context.Background(), "http://localhost/foo", WebhookOptions{MaxPayloadSize: 1})
+
+			var nextBody string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				nextBody = string(body)
+				w.WriteHeader(http.StatusOK)
+			})
+
+			h := webhookOptionsHandler{
+				next:   next,
+				store:  store,
+				bounds: DeliveryBounds{MaxDeliveryRetries: 3, MaxQueueSize: 1000},
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("POST", "/hook", strings.NewReader(tc.body)))
+
+			assert.Equal(tc.expectedStatus, w.Code)
+			if tc.expectedNext {
+				assert.Equal(tc.body, nextBody)
+			} else {
+				assert.Empty(nextBody)
+			}
+			options := store.Get("http://localhost/foo")
+			assert.Nil(options.Registration)
+			options.Registered = time.Time{}
+			assert.Equal(tc.expected, options)
+		})
+	}
+}
+
+// Registrations of a URL by different owners are kept as different webhooks
+// when the store is shared, each with its own registration.
+func TestWebhookOptionsHandlerOwner(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newMemoryOptionsStore()
+	h := webhookOptionsHandler{
+		next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}),
+		store:   store,
+		byOwner: true,
+	}
+
+	register := func(owner, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "/hook", strings.NewReader(body))
+		request = request.WithContext(handler.NewContextWithValue(request.Context(), &handler.ContextValues{SatClientID: owner}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, request)
+		return w
+	}
+
+	until := time.Now().Add(time.Hour).Round(time.Second)
+	w := register("a", `{"config":{"url":"http://localhost/foo","secret":"a"},"events":["iot"],"until":"`+
+		until.Format(time.RFC3339)+`","options":{"max_payload_size":10}}`)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(webhookID("a", "http://localhost/foo"), w.Header().Get(webhookIDHeader))
+
+	start := time.Now()
+	w = register("b", `{"config":{"url":"http://localhost/foo","secret":"b"},"events":["online"]}`)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(webhookID("b", "http://localhost/foo"), w.Header().Get(webhookIDHeader))
+
+	a := store.Get(webhookID("a", "http://localhost/foo"))
+	assert.Equal(10, a.MaxPayloadSize)
+	assert.Equal("a", a.Owner)
+	if assert.NotNil(a.Registration) {
+		assert.Equal("a", a.Registration.Config.Secret)
+		assert.Equal([]string{"iot"}, a.Registration.Events)
+		assert.Equal([]string{".*"}, a.Registration.Matcher.DeviceID)
+		assert.Equal("192.0.2.1", a.Registration.Address)
+		assert.True(until.Equal(a.Registration.Until))
+	}
+
+	// Each registration lasts as long as it says, or as ancla has it.
+	b := store.Get(webhookID("b", "http://localhost/foo"))
+	assert.Equal(0, b.MaxPayloadSize)
+	assert.Equal("b", b.Owner)
+	assert.True(a.Registered.Before(b.Registered))
+	if assert.NotNil(b.Registration) {
+		assert.Equal("b", b.Registration.Config.Secret)
+		assert.Equal([]string{"online"}, b.Registration.Events)
+		assert.Equal(registrationDuration, b.Registration.Duration)
+		assert.False(b.Registration.Until.Before(start.Add(registrationDuration)))
+	}
+
+	assert.Equal([]string{webhookID("a", "http://localhost/foo"), webhookID("b", "http://localhost/foo")},
+		store.Registrations())
+
+	// Without a shared store the webhooks are keyed by URL, as ancla keeps
+	// them.
+	store = newMemoryOptionsStore()
+	h.store = store
+	h.byOwner = false
+	w = register("a", `{"config":{"url":"http://localhost/foo"},"events":["iot"]}`)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal("http://localhost/foo", w.Header().Get(webhookIDHeader))
+	assert.Equal("a", store.Get("http://localhost/foo").Owner)
+	assert.Empty(store.Registrations())
+}
+
+// failingOptionsStore can't store any options.
+type failingOptionsStore struct {
+	*memoryOptionsStore
+}
+
+func (failingOptionsStore) Put(context.Context, string, WebhookOptions) error {
+	return errors.New("unavailable")
+}
+
+func (failingOptionsStore) Update(context.Context, string, func(*WebhookOptions) error) error {
+	return errors.New("unavailable")
+}
+
+// staleOptionsStore has none of the options it stores in its copy in memory,
+// as if they were written by another instance since the last refresh.
+type staleOptionsStore struct {
+	*memoryOptionsStore
+}
+
+func (staleOptionsStore) Get(string) WebhookOptions {
+	return WebhookOptions{}
+}
+
+// The options are only stored once ancla registered the webhook.
+func TestWebhookOptionsHandlerRegistrationFailed(t *testing.T) {
+	assert := assert.New(t)
+	body := `{"config":{"url":"http://localhost/foo"},"events":["iot"],"options":{"max_payload_size":10}}`
+
+	store := newMemoryOptionsStore()
+	h := webhookOptionsHandler{
+		next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message":"invalid"}`))
+		}),
+		store: store,
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/hook", strings.NewReader(body)))
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Equal("application/json", w.Header().Get("Content-Type"))
+	assert.Equal(`{"message":"invalid"}`, w.Body.String())
+	assert.Empty(w.Header().Get(webhookIDHeader))
+	assert.Equal(WebhookOptions{}, store.Get("http://localhost/foo"))
+
+	// The registration can't be reported as done without its options.
+	h.next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	h.store = failingOptionsStore{store}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "/hook", strings.NewReader(body)))
+	assert.Equal(http.StatusInternalServerError, w.Code)
+	assert.Empty(w.Header().Get(webhookIDHeader))
+}
+
+func TestWebhookOptionsHandlerPartnerIsolation(t *testing.T) {
+	body := `{"config":{"url":"http://localhost/foo"},"events":["iot"],"options":{"partner_ids":["*"]}}`
+
+	tests := []struct {
+		description    string
+		values         *handler.ContextValues
+		existing       []string
+		expectedStatus int
+		expected       []string
+	}{
+		{
+			description:    "Partner IDs Of The Token",
+			values:         &handler.ContextValues{SatClientID: "client", PartnerIDs: []string{"comcast"}},
+			expectedStatus: http.StatusOK,
+			expected:       []string{"comcast"},
+		},
+		{
+			description:    "Privileged",
+			values:         &handler.ContextValues{SatClientID: "admin", PartnerIDs: []string{"*"}},
+			expectedStatus: http.StatusOK,
+			expected:       []string{"*"},
+		},
+		{
+			description:    "Same Partner",
+			values:         &handler.ContextValues{SatClientID: "client", PartnerIDs: []string{"comcast", "sky"}},
+			existing:       []string{"comcast"},
+			expectedStatus: http.StatusOK,
+			expected:       []string{"comcast", "sky"},
+		},
+		{
+			description:    "Other Partner",
+			values:         &handler.ContextValues{SatClientID: "client", PartnerIDs: []string{"sky"}},
+			existing:       []string{"comcast"},
+			expectedStatus: http.StatusForbidden,
+			expected:       []string{"comcast"},
+		},
+		{
+			description:    "Privileged Over Partner",
+			values:         &handler.ContextValues{SatClientID: "admin", PartnerIDs: []string{"*"}},
+			existing:       []string{"comcast"},
+			expectedStatus: http.StatusOK,
+			expected:       []string{"*"},
+		},
+		{
+			description:    "Partner Over Privileged",
+			values:         &handler.ContextValues{SatClientID: "client", PartnerIDs: []string{"comcast"}},
+			existing:       []string{"*"},
+			expectedStatus: http.StatusForbidden,
+			expected:       []string{"*"},
+		},
+		{
+			description:    "No Partner IDs",
+			values:         &handler.ContextValues{SatClientID: "client"},
+			expectedStatus: http.StatusForbidden,
+		},
+		{
+			description:    "No Token",
+			expectedStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			id := webhookID("", "http://localhost/foo")
+			if nil != tc.values {
+				id = webhookID(tc.values.SatClientID, "http://localhost/foo")
+			}
+
+			store := newMemoryOptionsStore()
+			if nil != tc.existing {
+				store.Put(context.Background(), id, WebhookOptions{PartnerIDs: tc.existing})
+			}
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+
+			h := webhookOptionsHandler{
+				next:    next,
+				store:   store,
+				byOwner: true,
+				isolation: PartnerIsolationConfig{
+					Enabled:           true,
+					PrivilegedClients: []string{"admin"},
+				},
+			}
+
+			request := httptest.NewRequest("POST", "/hook", strings.NewReader(body))
+			if nil != tc.values {
+				request = request.WithContext(handler.NewContextWithValue(request.Context(), tc.values))
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, request)
+
+			assert.Equal(tc.expectedStatus, w.Code)
+			assert.Equal(tc.expected, store.Get(id).PartnerIDs)
+		})
+	}
+}
+
+func TestWebhookOptionsHandlerSecretRotation(t *testing.T) {
+	rotation := &SecretRotation{Secret: "new", Started: time.Unix(1600000000, 0), Until: time.Unix(1600003600, 0)}
+
+	tests := []struct {
+		description string
+		body        string
+		stale       bool
+		expected    *SecretRotation
+	}{
+		{
+			description: "Old Secret",
+			body:        `{"config":{"url":"http://localhost/foo","secret":"old"},"events":["iot"]}`,
+			expected:    rotation,
+		},
+		{
+			description: "New Secret",
+			body:        `{"config":{"url":"http://localhost/foo","secret":"new"},"events":["iot"]}`,
+		},
+		{
+			description: "Rotation Ignored",
+			body:        `{"config":{"url":"http://localhost/foo","secret":"old"},"events":["iot"],"options":{"secret_rotation":{"secret":"mine"}}}`,
+			expected:    rotation,
+		},
+		{
+			description: "Rotation Ignored With New Secret",
+			body:        `{"config":{"url":"http://localhost/foo","secret":"new"},"events":["iot"],"options":{"secret_rotation":{"secret":"mine"}}}`,
+		},
+		{
+			description: "Stale Copy",
+			body:        `{"config":{"url":"http://localhost/foo","secret":"old"},"events":["iot"]}`,
+			stale:       true,
+			expected:    rotation,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+
+			store := newMemoryOptionsStore()
+			store.Put(context.Background(), "http://localhost/foo", WebhookOptions{SecretRotation: rotation})
+
+			h := webhookOptionsHandler{
+				next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusOK)
+				}),
+				store: store,
+			}
+			if tc.stale {
+				h.store = staleOptionsStore{store}
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("POST", "/hook", strings.NewReader(tc.body)))
+
+			assert.Equal(http.StatusOK, w.Code)
+			assert.Equal(tc.expected, store.Get("http://localhost/foo").SecretRotation)
+		})
+	}
+}
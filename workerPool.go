@@ -0,0 +1,283 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// WorkerPoolConfig configures a pool of delivery workers shared by all the
+// senders, instead of each sender having numWorkersPerSender workers of its
+// own.
+type WorkerPoolConfig struct {
+	// Size is the number of workers shared by all the senders.
+	// 0 disables the shared pool.
+	Size int
+
+	// MinPerSender is the number of concurrent deliveries each sender is
+	// served first with, before the senders already delivering that many.
+	// (Optional) defaults to 1.
+	MinPerSender int
+
+	// MaxPerSender is the most concurrent deliveries of a sender.
+	// (Optional) defaults to the size of the pool.
+	MaxPerSender int
+}
+
+// deliveryWorkers limits the concurrent deliveries of a sender.
+type deliveryWorkers interface {
+	// Acquire blocks until the sender may start a delivery.
+	Acquire()
+
+	// Release ends a delivery.
+	Release()
+
+	// Wait blocks until all the deliveries ended.
+	Wait()
+
+	// resize changes the concurrent deliveries the sender is served first
+	// with, the most concurrent deliveries and the weight of the sender.
+	// The deliveries already started aren't stopped.  Only the shared pool
+	// has use for the minimum and the weight.
+	resize(min, max, weight int)
+}
+
+// semaphoreWorkers are the workers of a sender that has its own.
+type semaphoreWorkers struct {
+	mutex sync.Mutex
+	cond  *sync.Cond
+	busy  int
+	max   int
+}
+
+func newSemaphoreWorkers(max int) *semaphoreWorkers {
+	w := &semaphoreWorkers{max: max}
+	w.cond = sync.NewCond(&w.mutex)
+	return w
+}
+
+func (w *semaphoreWorkers) Acquire() {
+	w.mutex.Lock()
+	for w.max <= w.busy {
+		w.cond.Wait()
+	}
+	w.busy++
+	w.mutex.Unlock()
+}
+
+func (w *semaphoreWorkers) Release() {
+	w.mutex.Lock()
+	w.busy--
+	w.mutex.Unlock()
+	w.cond.Broadcast()
+}
+
+func (w *semaphoreWorkers) Wait() {
+	w.mutex.Lock()
+	for 0 < w.busy {
+		w.cond.Wait()
+	}
+	w.mutex.Unlock()
+}
+
+func (w *semaphoreWorkers) resize(_, max, _ int) {
+	if max <= 0 {
+		max = 1
+	}
+	w.mutex.Lock()
+	w.max = max
+	w.mutex.Unlock()
+	w.cond.Broadcast()
+}
+
+// workerPool shares its workers between the senders with weighted fair
+// queuing: a free worker goes to the waiting sender below its minimum with
+// the fewest deliveries, otherwise to the waiting sender that received the
+// least service for its weight.  Senders at their maximum wait even if
+// workers are free.
+type workerPool struct {
+	mutex        sync.Mutex
+	size         int
+	busy         int
+	minPerSender int
+	maxPerSender int
+	waiting      []*poolWorkers
+
+	// virtualTime is the service each sender is entitled to by now, so the
+	// senders that were idle don't make up for the time they didn't use.
+	virtualTime float64
+
+	busyGauge    metrics.Gauge
+	waitingGauge metrics.Gauge
+}
+
+// New creates the shared pool, or nil when it is disabled.
+func (c WorkerPoolConfig) New(m CaduceusMetricsRegistry) (*workerPool, error) {
+	if c.Size < 0 {
+		return nil, errors.New("the worker pool size must not be negative")
+	}
+	if 0 == c.Size {
+		return nil, nil
+	}
+
+	if c.MinPerSender <= 0 {
+		c.MinPerSender = 1
+	}
+	if c.MaxPerSender <= 0 || c.Size < c.MaxPerSender {
+		c.MaxPerSender = c.Size
+	}
+	if c.MaxPerSender < c.MinPerSender {
+		return nil, errors.New("the worker pool minimum per sender must not be larger than the maximum")
+	}
+
+	p := &workerPool{
+		size:         c.Size,
+		minPerSender: c.MinPerSender,
+		maxPerSender: c.MaxPerSender,
+		busyGauge:    m.NewGauge(WorkerPoolBusyGauge),
+		waitingGauge: m.NewGauge(WorkerPoolWaitingGauge),
+	}
+	m.NewGauge(WorkerPoolSizeGauge).Set(float64(c.Size))
+	p.busyGauge.Set(0)
+	p.waitingGauge.Set(0)
+
+	return p, nil
+}
+
+// workers returns the share of the pool of a sender with the weight.
+func (p *workerPool) workers(weight int) *poolWorkers {
+	if weight <= 0 {
+		weight = 1
+	}
+	return &poolWorkers{
+		pool:   p,
+		weight: float64(weight),
+		min:    p.minPerSender,
+		max:    p.maxPerSender,
+		ready:  make(chan struct{}, 1),
+	}
+}
+
+// dispatch hands the free workers to the waiting senders.  The pool's mutex
+// must be held.
+func (p *workerPool) dispatch() {
+	for p.busy < p.size {
+		next := -1
+		for i, w := range p.waiting {
+			if w.max <= w.busy {
+				continue
+			}
+			if next < 0 || w.before(p.waiting[next]) {
+				next = i
+			}
+		}
+		if next < 0 {
+			break
+		}
+
+		w := p.waiting[next]
+		p.waiting = append(p.waiting[:next], p.waiting[next+1:]...)
+
+		if w.finish < p.virtualTime {
+			w.finish = p.virtualTime
+		}
+		p.virtualTime = w.finish
+		w.finish += 1 / w.weight
+
+		w.busy++
+		p.busy++
+		w.ready <- struct{}{}
+	}
+
+	p.busyGauge.Set(float64(p.busy))
+	p.waitingGauge.Set(float64(len(p.waiting)))
+}
+
+// poolWorkers are the workers of a sender taken from the shared pool.
+type poolWorkers struct {
+	pool  *workerPool
+	ready chan struct{}
+	wg    sync.WaitGroup
+
+	// Guarded by the pool's mutex.
+	weight float64
+	busy   int
+	min    int
+	max    int
+	finish float64
+}
+
+// before determines if the sender is served before the other one.
+func (w *poolWorkers) before(other *poolWorkers) bool {
+	below, otherBelow := w.busy < w.min, other.busy < other.min
+	if below != otherBelow {
+		return below
+	}
+	if below {
+		return w.busy < other.busy
+	}
+	return w.finish < other.finish
+}
+
+func (w *poolWorkers) Acquire() {
+	w.pool.mutex.Lock()
+	w.pool.waiting = append(w.pool.waiting, w)
+	w.pool.dispatch()
+	w.pool.mutex.Unlock()
+
+	<-w.ready
+	w.wg.Add(1)
+}
+
+func (w *poolWorkers) Release() {
+	w.pool.mutex.Lock()
+	w.busy--
+	w.pool.busy--
+	w.pool.dispatch()
+	w.pool.mutex.Unlock()
+
+	w.wg.Done()
+}
+
+func (w *poolWorkers) Wait() {
+	w.wg.Wait()
+}
+
+// resize changes the share of the pool of the sender.  The maximum can't be
+// more than the maximum of the pool, and the minimum more than the maximum.
+// Zero values fall back to the pool configuration.
+func (w *poolWorkers) resize(min, max, weight int) {
+	w.pool.mutex.Lock()
+	if max <= 0 || w.pool.maxPerSender < max {
+		max = w.pool.maxPerSender
+	}
+	if min <= 0 {
+		min = w.pool.minPerSender
+	}
+	if max < min {
+		min = max
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+	w.min, w.max, w.weight = min, max, float64(weight)
+	w.pool.dispatch()
+	w.pool.mutex.Unlock()
+}
@@ -0,0 +1,224 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkerPoolConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := WorkerPoolConfig{}.New(permissiveRegistry())
+	assert.Nil(p)
+	assert.Nil(err)
+
+	_, err = WorkerPoolConfig{Size: -1}.New(permissiveRegistry())
+	assert.NotNil(err)
+
+	_, err = WorkerPoolConfig{Size: 10, MinPerSender: 5, MaxPerSender: 2}.New(permissiveRegistry())
+	assert.NotNil(err)
+
+	p, err = WorkerPoolConfig{Size: 10, MaxPerSender: 20}.New(permissiveRegistry())
+	assert.Nil(err)
+	assert.Equal(1, p.minPerSender)
+	assert.Equal(10, p.maxPerSender)
+}
+
+func acquired(w *poolWorkers) bool {
+	select {
+	case <-w.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// A sender below its minimum is served before a busier one.
+func TestWorkerPoolMinimum(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := WorkerPoolConfig{Size: 2}.New(permissiveRegistry())
+	require.Nil(t, err)
+
+	hot, cold := p.workers(1), p.workers(1)
+	hot.Acquire()
+	hot.Acquire()
+
+	p.mutex.Lock()
+	p.waiting = append(p.waiting, hot, cold)
+	p.busy--
+	hot.busy--
+	p.dispatch()
+	p.mutex.Unlock()
+
+	assert.False(acquired(hot))
+	assert.True(acquired(cold))
+}
+
+// A sender at its maximum waits even when workers are free.
+func TestWorkerPoolMaximum(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := WorkerPoolConfig{Size: 3, MaxPerSender: 1}.New(permissiveRegistry())
+	require.Nil(t, err)
+
+	w := p.workers(1)
+	w.Acquire()
+
+	done := make(chan struct{})
+	go func() {
+		w.Acquire()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		assert.Fail("the sender exceeded its maximum")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	w.Release()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail("the sender didn't get the released worker")
+	}
+
+	w.Release()
+	w.Wait()
+	assert.Equal(0, p.busy)
+}
+
+// Raising the maximum of a sender hands it the free workers it waits for.
+func TestWorkerResize(t *testing.T) {
+	p, err := WorkerPoolConfig{Size: 3}.New(permissiveRegistry())
+	require.Nil(t, err)
+
+	for _, w := range []deliveryWorkers{p.workers(1), newSemaphoreWorkers(3)} {
+		assert := assert.New(t)
+
+		w.resize(0, 1, 0)
+		w.Acquire()
+
+		done := make(chan struct{})
+		go func() {
+			w.Acquire()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			assert.Fail("the sender exceeded its maximum")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		w.resize(0, 2, 0)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			assert.Fail("the sender didn't get a worker after the resize")
+		}
+
+		w.Release()
+		w.Release()
+		w.Wait()
+	}
+	assert.Equal(t, 0, p.busy)
+}
+
+// Senders always waiting are served in proportion to their weights.
+func TestWorkerPoolWeights(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := WorkerPoolConfig{Size: 1, MinPerSender: 1}.New(permissiveRegistry())
+	require.Nil(t, err)
+	// Nobody is below a minimum of 0, so only the weights matter.
+	p.minPerSender = 0
+
+	heavy, light := p.workers(2), p.workers(1)
+	counts := map[*poolWorkers]int{}
+
+	p.mutex.Lock()
+	p.waiting = append(p.waiting, heavy, light)
+	for i := 0; i < 30; i++ {
+		p.dispatch()
+
+		var served *poolWorkers
+		if acquired(heavy) {
+			served = heavy
+		} else if acquired(light) {
+			served = light
+		}
+		require.NotNil(t, served)
+		counts[served]++
+
+		// The delivery ends and the sender waits again.
+		served.busy--
+		p.busy--
+		p.waiting = append(p.waiting, served)
+	}
+	p.mutex.Unlock()
+
+	assert.Equal(20, counts[heavy])
+	assert.Equal(10, counts[light])
+}
+
+// The share of a sender set by its webhook options decides how it is served.
+func TestWorkerPoolResizeShare(t *testing.T) {
+	assert := assert.New(t)
+
+	p, err := WorkerPoolConfig{Size: 1, MinPerSender: 1, MaxPerSender: 1}.New(permissiveRegistry())
+	require.Nil(t, err)
+
+	heavy, light := p.workers(1), p.workers(1)
+	// Nobody is below a minimum of 0, so only the weights matter.
+	heavy.resize(0, 5, 3)
+	light.resize(0, 0, 1)
+	assert.Equal(1, heavy.max)
+	assert.Equal(1, heavy.min)
+	heavy.min, light.min = 0, 0
+
+	counts := map[*poolWorkers]int{}
+
+	p.mutex.Lock()
+	p.waiting = append(p.waiting, heavy, light)
+	for i := 0; i < 40; i++ {
+		p.dispatch()
+
+		var served *poolWorkers
+		if acquired(heavy) {
+			served = heavy
+		} else if acquired(light) {
+			served = light
+		}
+		require.NotNil(t, served)
+		counts[served]++
+
+		served.busy--
+		p.busy--
+		p.waiting = append(p.waiting, served)
+	}
+	p.mutex.Unlock()
+
+	assert.Equal(30, counts[heavy])
+	assert.Equal(10, counts[light])
+}
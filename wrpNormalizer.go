@@ -0,0 +1,200 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/xmidt-org/webpa-common/device"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+const (
+	// The names of the available normalizers.
+	contentTypeNormalizer     = "content_type"
+	transactionUUIDNormalizer = "transaction_uuid"
+	receivedAtNormalizer      = "received_at"
+	fqdnNormalizer            = "fqdn"
+	sourceNormalizer          = "source"
+	partnerIDsNormalizer      = "partner_ids"
+
+	// receivedAtMetadataKey is the metadata entry holding the time caduceus
+	// received the message.
+	receivedAtMetadataKey = "/caduceus/received-at"
+
+	// fqdnMetadataKey is the metadata entry holding the fqdn of the caduceus
+	// instance that received the message.
+	fqdnMetadataKey = "/caduceus/fqdn"
+)
+
+// defaultNormalizerChain is the chain used when none is configured.
+var defaultNormalizerChain = []string{contentTypeNormalizer, transactionUUIDNormalizer}
+
+// NormalizerConfig configures the normalizers applied to every incoming WRP
+// message before it is delivered.
+type NormalizerConfig struct {
+	// Chain is the ordered list of normalizers to apply.
+	// (Optional) defaults to content_type and transaction_uuid.
+	Chain []string
+
+	// FQDN is the value stamped by the fqdn normalizer.
+	FQDN string
+
+	// PartnerIDs are the partner ids given to messages without any by the
+	// partner_ids normalizer.
+	PartnerIDs []string
+}
+
+// wrpNormalizer modifies a message as needed, returning the reason the
+// message was modified or an empty string if it wasn't.
+type wrpNormalizer func(*wrp.Message) string
+
+// wrpNormalizers is an ordered chain of normalizers.  A nil *wrpNormalizers
+// applies the default chain.
+type wrpNormalizers struct {
+	chain []wrpNormalizer
+}
+
+var defaultNormalizers, _ = NormalizerConfig{}.New()
+
+// New creates the chain of normalizers described by the configuration, or
+// returns an error if a normalizer is unknown or misconfigured.
+func (c NormalizerConfig) New() (*wrpNormalizers, error) {
+	names := c.Chain
+	if 0 == len(names) {
+		names = defaultNormalizerChain
+	}
+
+	n := &wrpNormalizers{}
+	for _, name := range names {
+		var normalizer wrpNormalizer
+		switch strings.ToLower(name) {
+		case contentTypeNormalizer:
+			normalizer = normalizeContentType
+		case transactionUUIDNormalizer:
+			normalizer = normalizeTransactionUUID
+		case receivedAtNormalizer:
+			normalizer = normalizeReceivedAt
+		case fqdnNormalizer:
+			if "" == c.FQDN {
+				return nil, fmt.Errorf("the %s normalizer requires an fqdn", fqdnNormalizer)
+			}
+			normalizer = newFQDNNormalizer(c.FQDN)
+		case sourceNormalizer:
+			normalizer = normalizeSource
+		case partnerIDsNormalizer:
+			if 0 == len(c.PartnerIDs) {
+				return nil, fmt.Errorf("the %s normalizer requires partner ids", partnerIDsNormalizer)
+			}
+			normalizer = newPartnerIDsNormalizer(c.PartnerIDs)
+		default:
+			return nil, fmt.Errorf("unknown normalizer '%s'", name)
+		}
+		n.chain = append(n.chain, normalizer)
+	}
+
+	return n, nil
+}
+
+// normalize applies the chain to the message and returns the reasons of the
+// modifications made.
+func (n *wrpNormalizers) normalize(msg *wrp.Message) []string {
+	if nil == n {
+		n = defaultNormalizers
+	}
+
+	var reasons []string
+	for _, normalizer := range n.chain {
+		if reason := normalizer(msg); "" != reason {
+			reasons = append(reasons, reason)
+		}
+	}
+	return reasons
+}
+
+// normalizeContentType defaults to "application/json" if there is no content
+// type, otherwise the one the source specified is used.
+func normalizeContentType(msg *wrp.Message) string {
+	if "" != msg.ContentType {
+		return ""
+	}
+	msg.ContentType = wrp.MimeTypeJson
+	return emptyContentTypeReason
+}
+
+// normalizeTransactionUUID ensures there is a transaction id even if we make
+// one up.
+func normalizeTransactionUUID(msg *wrp.Message) string {
+	if "" != msg.TransactionUUID {
+		return ""
+	}
+	msg.TransactionUUID = uuid.NewV4().String()
+	return emptyUUIDReason
+}
+
+func normalizeReceivedAt(msg *wrp.Message) string {
+	setMetadata(msg, receivedAtMetadataKey, time.Now().UTC().Format(time.RFC3339Nano))
+	return addedReceivedAtReason
+}
+
+func newFQDNNormalizer(fqdn string) wrpNormalizer {
+	return func(msg *wrp.Message) string {
+		setMetadata(msg, fqdnMetadataKey, fqdn)
+		return addedFQDNReason
+	}
+}
+
+// normalizeSource rewrites the device id of the source in its canonical form,
+// keeping any service or path that follows it.
+func normalizeSource(msg *wrp.Message) string {
+	id, rest := msg.Source, ""
+	if i := strings.Index(msg.Source, "/"); 0 <= i {
+		id, rest = msg.Source[:i], msg.Source[i:]
+	}
+
+	canonical, err := device.ParseID(id)
+	if nil != err {
+		return ""
+	}
+
+	source := string(canonical) + rest
+	if source == msg.Source {
+		return ""
+	}
+	msg.Source = source
+	return canonicalizedSourceReason
+}
+
+func newPartnerIDsNormalizer(partnerIDs []string) wrpNormalizer {
+	return func(msg *wrp.Message) string {
+		if 0 != len(msg.PartnerIDs) {
+			return ""
+		}
+		msg.PartnerIDs = append([]string{}, partnerIDs...)
+		return addedPartnerIDsReason
+	}
+}
+
+func setMetadata(msg *wrp.Message, key, value string) {
+	if nil == msg.Metadata {
+		msg.Metadata = make(map[string]string)
+	}
+	msg.Metadata[key] = value
+}
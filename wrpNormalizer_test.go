@@ -0,0 +1,109 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func TestNormalizerConfigNew(t *testing.T) {
+	tests := []struct {
+		description string
+		config      NormalizerConfig
+		expectedErr bool
+	}{
+		{description: "Default", config: NormalizerConfig{}},
+		{
+			description: "All",
+			config: NormalizerConfig{
+				Chain:      []string{"content_type", "transaction_uuid", "received_at", "fqdn", "source", "partner_ids"},
+				FQDN:       "caduceus.example.com",
+				PartnerIDs: []string{"comcast"},
+			},
+		},
+		{description: "Unknown", config: NormalizerConfig{Chain: []string{"shiny"}}, expectedErr: true},
+		{description: "Missing FQDN", config: NormalizerConfig{Chain: []string{"fqdn"}}, expectedErr: true},
+		{description: "Missing Partner IDs", config: NormalizerConfig{Chain: []string{"partner_ids"}}, expectedErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.description, func(t *testing.T) {
+			assert := assert.New(t)
+			n, err := tc.config.New()
+			if tc.expectedErr {
+				assert.NotNil(err)
+				assert.Nil(n)
+				return
+			}
+			assert.Nil(err)
+			assert.NotNil(n)
+		})
+	}
+}
+
+func TestWrpNormalizersNormalize(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	n, err := NormalizerConfig{
+		Chain:      []string{"content_type", "transaction_uuid", "received_at", "fqdn", "source", "partner_ids"},
+		FQDN:       "caduceus.example.com",
+		PartnerIDs: []string{"comcast"},
+	}.New()
+	require.Nil(err)
+
+	msg := &wrp.Message{Source: "MAC:11-22-33-44-55-66/lmlite"}
+	before := time.Now().UTC()
+	reasons := n.normalize(msg)
+
+	assert.Equal([]string{
+		emptyContentTypeReason,
+		emptyUUIDReason,
+		addedReceivedAtReason,
+		addedFQDNReason,
+		canonicalizedSourceReason,
+		addedPartnerIDsReason,
+	}, reasons)
+	assert.Equal(wrp.MimeTypeJson, msg.ContentType)
+	assert.NotEmpty(msg.TransactionUUID)
+	assert.Equal("caduceus.example.com", msg.Metadata[fqdnMetadataKey])
+	assert.Equal("mac:112233445566/lmlite", msg.Source)
+	assert.Equal([]string{"comcast"}, msg.PartnerIDs)
+
+	receivedAt, err := time.Parse(time.RFC3339Nano, msg.Metadata[receivedAtMetadataKey])
+	require.Nil(err)
+	assert.False(receivedAt.Before(before))
+
+	// only the stamping normalizers modify an already normal message
+	reasons = n.normalize(msg)
+	assert.Equal([]string{addedReceivedAtReason, addedFQDNReason}, reasons)
+}
+
+func TestWrpNormalizersDefault(t *testing.T) {
+	assert := assert.New(t)
+
+	var n *wrpNormalizers
+	msg := &wrp.Message{Source: "MAC:11-22-33-44-55-66"}
+	assert.Equal([]string{emptyContentTypeReason, emptyUUIDReason}, n.normalize(msg))
+	assert.Equal("MAC:11-22-33-44-55-66", msg.Source)
+	assert.Nil(msg.Metadata)
+}
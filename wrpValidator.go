@@ -0,0 +1,142 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/xmidt-org/webpa-common/device"
+	"github.com/xmidt-org/webpa-common/logging"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+const (
+	// StrictValidation rejects messages that break the rule.
+	StrictValidation = "strict"
+
+	// LenientValidation logs messages that break the rule but still
+	// delivers them.
+	LenientValidation = "lenient"
+)
+
+// ValidationConfig sets how strictly each rule is applied to the incoming WRP
+// messages.  Each rule is either StrictValidation or LenientValidation, and
+// defaults to LenientValidation.
+type ValidationConfig struct {
+	// MessageType requires the message to be a simple event.
+	MessageType string
+
+	// Destination requires the destination to be of the form "event:<type>".
+	Destination string
+
+	// Source requires the source to be a valid device id.
+	Source string
+}
+
+// validationRule is a single check of a WRP message.
+type validationRule struct {
+	reason string
+	strict bool
+	check  func(*wrp.Message) error
+}
+
+// wrpValidator applies the validation rules to incoming messages.  A nil
+// *wrpValidator accepts every message.
+type wrpValidator struct {
+	rules []validationRule
+}
+
+// New creates the validator described by the configuration, or returns an
+// error if a rule has an unknown mode.
+func (c ValidationConfig) New() (*wrpValidator, error) {
+	rules := []struct {
+		name   string
+		mode   string
+		reason string
+		check  func(*wrp.Message) error
+	}{
+		{"messageType", c.MessageType, invalidMessageTypeReason, checkMessageType},
+		{"destination", c.Destination, invalidDestinationReason, checkDestination},
+		{"source", c.Source, invalidSourceReason, checkSource},
+	}
+
+	v := &wrpValidator{}
+	for _, r := range rules {
+		var strict bool
+		switch strings.ToLower(r.mode) {
+		case StrictValidation:
+			strict = true
+		case LenientValidation, "":
+		default:
+			return nil, fmt.Errorf("invalid validation mode '%s' for %s", r.mode, r.name)
+		}
+		v.rules = append(v.rules, validationRule{
+			reason: r.reason,
+			strict: strict,
+			check:  r.check,
+		})
+	}
+
+	return v, nil
+}
+
+// validate returns the reason and error of the first strict rule the message
+// breaks.  Broken lenient rules are only logged.
+func (v *wrpValidator) validate(msg *wrp.Message, logger log.Logger) (string, error) {
+	if nil == v {
+		return "", nil
+	}
+
+	for _, rule := range v.rules {
+		err := rule.check(msg)
+		if nil == err {
+			continue
+		}
+		if rule.strict {
+			return rule.reason, err
+		}
+		level.Debug(logger).Log(logging.MessageKey(), "Accepting invalid WRP message.",
+			"reason", rule.reason, logging.ErrorKey(), err, "transactionUUID", msg.TransactionUUID)
+	}
+
+	return "", nil
+}
+
+func checkMessageType(msg *wrp.Message) error {
+	if wrp.SimpleEventMessageType != msg.Type {
+		return fmt.Errorf("message type must be %s, not %s", wrp.SimpleEventMessageType, msg.Type)
+	}
+	return nil
+}
+
+func checkDestination(msg *wrp.Message) error {
+	if !strings.HasPrefix(msg.Destination, "event:") || "" == strings.TrimPrefix(msg.Destination, "event:") {
+		return errors.New("destination must be of the form 'event:<type>'")
+	}
+	return nil
+}
+
+func checkSource(msg *wrp.Message) error {
+	if _, err := device.ParseID(msg.Source); nil != err {
+		return fmt.Errorf("source is not a valid device id: %v", err)
+	}
+	return nil
+}
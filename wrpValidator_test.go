@@ -0,0 +1,74 @@
+/**
+ * Copyright 2021 Comcast Cable Communications Management, LLC
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ */
+package main
+
+import (
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xmidt-org/wrp-go/v3"
+)
+
+func TestValidationConfigNew(t *testing.T) {
+	assert := assert.New(t)
+
+	v, err := ValidationConfig{}.New()
+	assert.Nil(err)
+	assert.NotNil(v)
+
+	v, err = ValidationConfig{Source: "Strict", Destination: LenientValidation}.New()
+	assert.Nil(err)
+	assert.NotNil(v)
+
+	v, err = ValidationConfig{MessageType: "pedantic"}.New()
+	assert.NotNil(err)
+	assert.Nil(v)
+}
+
+func TestWrpValidatorValidate(t *testing.T) {
+	assert := assert.New(t)
+	require := require.New(t)
+
+	msg := &wrp.Message{
+		Type:        wrp.SimpleEventMessageType,
+		Source:      "mac:112233445566",
+		Destination: "event:",
+	}
+
+	var nilValidator *wrpValidator
+	reason, err := nilValidator.validate(msg, log.NewNopLogger())
+	assert.Empty(reason)
+	assert.Nil(err)
+
+	v, err := ValidationConfig{
+		MessageType: StrictValidation,
+		Destination: StrictValidation,
+		Source:      StrictValidation,
+	}.New()
+	require.Nil(err)
+
+	reason, err = v.validate(msg, log.NewNopLogger())
+	assert.Equal(invalidDestinationReason, reason)
+	assert.NotNil(err)
+
+	msg.Destination = "event:device-status"
+	reason, err = v.validate(msg, log.NewNopLogger())
+	assert.Empty(reason)
+	assert.Nil(err)
+}